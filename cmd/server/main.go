@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"os"
 	"os/signal"
 	"syscall"
@@ -18,6 +19,15 @@ func main() {
 
 	ctxWithLogger := logger.WithLogger(ctxWithCancel, zapLogger)
 
+	// calc-server migrate ... - только миграции схемы, без запуска оркестратора
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := runMigrate(ctxWithLogger, os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	server := server.New(ctxWithLogger)
 
 	// Запуск оркестратора в отдельной горутине чтобы не блокировать дальнейший код
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/YattaDeSune/calc-project/internal/db"
+	"github.com/YattaDeSune/calc-project/internal/server"
+)
+
+const migrateUsage = `usage: calc-server migrate <command>
+
+commands:
+  status     show applied and pending migrations
+  up [N]     apply N pending migrations (all by default)
+  down [N]   roll back N last migrations (1 by default)`
+
+// calc-server migrate status|up|down - ручное управление схемой бд из DATABASE_DSN
+func runMigrate(ctx context.Context, args []string) error {
+	if len(args) == 0 || len(args) > 2 {
+		return errors.New(migrateUsage)
+	}
+
+	steps := 0
+	if args[0] == "down" {
+		steps = 1
+	}
+	if len(args) == 2 {
+		n, err := strconv.Atoi(args[1])
+		if err != nil || n < 1 {
+			return fmt.Errorf("invalid number of migrations %q", args[1])
+		}
+		steps = n
+	}
+
+	cfg := server.GetCfgFromEnv(ctx)
+	database, err := db.Open(ctx, cfg.DatabaseDSN)
+	if err != nil {
+		return err
+	}
+	defer database.Close()
+
+	switch args[0] {
+	case "status":
+		return printMigrationStatus(ctx, database)
+	case "up":
+		applied, err := database.MigrateUp(ctx, steps)
+		for _, migration := range applied {
+			fmt.Printf("applied %04d_%s\n", migration.Version, migration.Name)
+		}
+		if err == nil && len(applied) == 0 {
+			fmt.Println("no pending migrations")
+		}
+		return err
+	case "down":
+		rolledBack, err := database.MigrateDown(ctx, steps)
+		for _, migration := range rolledBack {
+			fmt.Printf("rolled back %04d_%s\n", migration.Version, migration.Name)
+		}
+		if err == nil && len(rolledBack) == 0 {
+			fmt.Println("no applied migrations")
+		}
+		return err
+	}
+	return errors.New(migrateUsage)
+}
+
+func printMigrationStatus(ctx context.Context, database db.Migrator) error {
+	statuses, err := database.MigrationStatus(ctx)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "VERSION\tNAME\tAPPLIED AT")
+	for _, status := range statuses {
+		appliedAt := "pending"
+		if status.AppliedAt != nil {
+			appliedAt = status.AppliedAt.Format(time.RFC3339)
+		}
+		name := status.Name
+		if name == "" {
+			name = "(unknown, newer version)"
+		}
+		fmt.Fprintf(w, "%04d\t%s\t%s\n", status.Version, name, appliedAt)
+	}
+	return w.Flush()
+}
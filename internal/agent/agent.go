@@ -2,6 +2,10 @@ package agent
 
 import (
 	"context"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/YattaDeSune/calc-project/internal/logger"
 	pb "github.com/YattaDeSune/calc-project/internal/proto"
@@ -21,6 +25,8 @@ type Config struct {
 	TimeSubtractionMs    int `env:"TIME_SUBTRACTION_MS"`
 	TimeMultiplicationMs int `env:"TIME_MULTIPLICATIONS_MS"`
 	TimeDivisionMs       int `env:"TIME_DIVISIONS_MS"`
+	TimePowerMs          int `env:"TIME_POWER_MS"`
+	TimeFunctionMs       int `env:"TIME_FUNCTIONS_MS"`
 	ComputingPower       int `env:"COMPUTING_POWER"`
 }
 
@@ -38,6 +44,8 @@ func GetCfgFromEnv(ctx context.Context) *Config {
 			TimeSubtractionMs    = 2000
 			TimeMultiplicationMs = 5000
 			TimeDivisionMs       = 5000
+			TimePowerMs          = 5000
+			TimeFunctionMs       = 5000
 			ComputingPower       = 4
 		)
 
@@ -49,6 +57,8 @@ func GetCfgFromEnv(ctx context.Context) *Config {
 			zap.Int("TimeSubtractionMs", TimeSubtractionMs),
 			zap.Int("TimeMultiplicationMs", TimeMultiplicationMs),
 			zap.Int("TimeDivisionMs", TimeDivisionMs),
+			zap.Int("TimePowerMs", TimePowerMs),
+			zap.Int("TimeFunctionMs", TimeFunctionMs),
 			zap.Int("ComputingPower", ComputingPower),
 		)
 		return &Config{
@@ -58,6 +68,8 @@ func GetCfgFromEnv(ctx context.Context) *Config {
 			TimeSubtractionMs:    TimeSubtractionMs,
 			TimeMultiplicationMs: TimeMultiplicationMs,
 			TimeDivisionMs:       TimeDivisionMs,
+			TimePowerMs:          TimePowerMs,
+			TimeFunctionMs:       TimeFunctionMs,
 			ComputingPower:       ComputingPower,
 		}
 	}
@@ -69,17 +81,34 @@ func GetCfgFromEnv(ctx context.Context) *Config {
 		zap.Int("TimeSubtractionMs", cfg.TimeSubtractionMs),
 		zap.Int("TimeMultiplicationMs", cfg.TimeMultiplicationMs),
 		zap.Int("TimeDivisionMs", cfg.TimeDivisionMs),
+		zap.Int("TimePowerMs", cfg.TimePowerMs),
+		zap.Int("TimeFunctionMs", cfg.TimeFunctionMs),
 		zap.Int("ComputingPower", cfg.ComputingPower),
 	)
 
 	return &cfg
 }
 
+// Пауза между запросами задач, если оркестратор не поддерживает поток
+const pollInterval = 500 * time.Millisecond
+
+// Интервал heartbeat, если оркестратор не прислал свой (как HEARTBEAT_INTERVAL_MS по умолчанию)
+const defaultHeartbeatInterval = 5 * time.Second
+
+// Версия агента, сообщается оркестратору при регистрации
+const Version = "1.1.0"
+
 type Agent struct {
 	client        pb.TaskServiceClient
 	cfg           *Config
 	taskChan      chan *pb.GetTaskResponse
 	readyTaskChan chan *pb.SubmitResultRequest
+
+	id atomic.Value // string, выдается оркестратором при регистрации, пусто - агент не зарегистрирован
+
+	// поток с оркестратором, nil - результаты отправляются через SubmitResult
+	streamMu sync.Mutex
+	stream   pb.TaskService_TaskStreamClient
 }
 
 func New(ctx context.Context) *Agent {
@@ -107,22 +136,193 @@ func (a *Agent) RunAgent(ctx context.Context, cancel context.CancelFunc) error {
 	for i := 1; i <= a.cfg.ComputingPower; i++ {
 		go a.worker(ctx, cancel, i)
 	}
+	go a.submitter(ctx, cancel)
 
-	// Бесконечный цикл для запроса задач
-	func() {
-		for {
-			task, err := a.client.GetTask(ctx, &pb.GetTaskRequest{})
-			// Если нет подключения к оркестратору - кладем агента
-			if status.Code(err) == codes.Unavailable {
-				logger.Warn("Failed to connect gRPC server", zap.Error(err))
-				cancel()
-			}
+	id, interval, err := a.register(ctx)
+	switch {
+	case err == nil:
+		a.id.Store(id)
+		go a.heartbeats(ctx, cancel, interval)
+	case status.Code(err) == codes.Unimplemented:
+		// старый оркестратор про агентов не знает, работаем анонимно
+		logger.Warn("Agent registration is not supported", zap.Error(err))
+	default:
+		logger.Warn("Failed to register agent", zap.Error(err))
+		cancel()
+		return nil
+	}
+
+	err = a.runStream(ctx)
+	// Старый оркестратор - опрашиваем его как раньше
+	if status.Code(err) == codes.Unimplemented {
+		logger.Warn("Task stream is not supported, falling back to polling")
+		a.poll(ctx, cancel)
+		return nil
+	}
+
+	// Если нет подключения к оркестратору - кладем агента
+	logger.Warn("Task stream closed", zap.Error(err))
+	cancel()
+	return nil
+}
+
+// Получение задач через поток: оркестратор сам присылает таски на свободные воркеры
+func (a *Agent) runStream(ctx context.Context) error {
+	stream, err := a.client.TaskStream(ctx)
+	if err != nil {
+		return err
+	}
+
+	a.streamMu.Lock()
+	a.stream = stream
+	err = stream.Send(&pb.AgentMessage{Payload: &pb.AgentMessage_Ready{Ready: &pb.Ready{Slots: int32(a.cfg.ComputingPower), AgentId: a.agentID()}}})
+	a.streamMu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		a.streamMu.Lock()
+		a.stream = nil
+		a.streamMu.Unlock()
+	}()
+
+	for {
+		msg, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+		if task := msg.GetTask(); task != nil {
+			a.taskChan <- task
+		}
+	}
+}
+
+// Цикл запроса задач для оркестратора без потока
+func (a *Agent) poll(ctx context.Context, cancel context.CancelFunc) {
+	logger := logger.FromContext(ctx)
+
+	for {
+		task, err := a.client.GetTask(ctx, &pb.GetTaskRequest{AgentId: a.agentID()})
+		// Если нет подключения к оркестратору - кладем агента
+		if status.Code(err) == codes.Unavailable {
+			logger.Warn("Failed to connect gRPC server", zap.Error(err))
+			cancel()
+			return
+		}
+
+		if task == nil {
+			time.Sleep(pollInterval)
+			continue
+		}
+		a.taskChan <- task
+	}
+}
+
+// Отправляет готовые результаты оркестратору
+func (a *Agent) submitter(ctx context.Context, cancel context.CancelFunc) {
+	for readyTask := range a.readyTaskChan {
+		// Если нет подключения к оркестратору - кладем агента
+		err := a.submit(ctx, readyTask)
+		if status.Code(err) == codes.Unavailable {
+			cancel()
+		}
+	}
+}
+
+func (a *Agent) submit(ctx context.Context, readyTask *pb.SubmitResultRequest) error {
+	readyTask.AgentId = a.agentID()
+
+	a.streamMu.Lock()
+	defer a.streamMu.Unlock()
+
+	if a.stream == nil {
+		_, err := a.client.SubmitResult(ctx, readyTask)
+		return err
+	}
+
+	if err := a.stream.Send(&pb.AgentMessage{Payload: &pb.AgentMessage_Result{Result: readyTask}}); err != nil {
+		return err
+	}
+	// воркер освободился
+	return a.stream.Send(&pb.AgentMessage{Payload: &pb.AgentMessage_Ready{Ready: &pb.Ready{Slots: 1}}})
+}
+
+// Регистрация у оркестратора, он выдает агенту новый id
+func (a *Agent) register(ctx context.Context) (string, time.Duration, error) {
+	hostname, _ := os.Hostname()
 
-			if task != nil {
-				a.taskChan <- task
+	resp, err := a.client.RegisterAgent(ctx, &pb.RegisterAgentRequest{
+		Hostname:       hostname,
+		Version:        Version,
+		ComputingPower: int32(a.cfg.ComputingPower),
+	})
+	if err != nil {
+		return "", 0, err
+	}
+	return resp.AgentId, time.Duration(resp.HeartbeatIntervalMs) * time.Millisecond, nil
+}
+
+// Периодически сообщает оркестратору, что агент жив и какие таски считает
+func (a *Agent) heartbeats(ctx context.Context, cancel context.CancelFunc, interval time.Duration) {
+	logger := logger.FromContext(ctx)
+
+	if interval <= 0 {
+		logger.Warn("Invalid heartbeat interval from server, using default value",
+			zap.Duration("interval", interval),
+			zap.Duration("default", defaultHeartbeatInterval),
+		)
+		interval = defaultHeartbeatInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		_, err := a.client.Heartbeat(ctx, &pb.HeartbeatRequest{AgentId: a.agentID()})
+		switch status.Code(err) {
+		case codes.OK:
+		case codes.NotFound:
+			// оркестратор нас забыл, а наши таски вернул в очередь - регистрируемся заново под новым id
+			logger.Warn("Agent is not registered, registering again", zap.String("agent id", a.agentID()))
+			if err := a.reregister(ctx); err != nil {
+				logger.Warn("Failed to register agent", zap.Error(err))
 			}
+		case codes.Unavailable:
+			// Если нет подключения к оркестратору - кладем агента
+			logger.Warn("Failed to connect gRPC server", zap.Error(err))
+			cancel()
+			return
+		default:
+			logger.Warn("Failed to send heartbeat", zap.Error(err))
 		}
-	}()
+	}
+}
 
-	return nil
+// Получает новый id и сообщает его в поток, чтобы дальше таски выдавались уже под ним
+func (a *Agent) reregister(ctx context.Context) error {
+	id, _, err := a.register(ctx)
+	if err != nil {
+		return err
+	}
+	a.id.Store(id)
+
+	a.streamMu.Lock()
+	defer a.streamMu.Unlock()
+
+	if a.stream == nil {
+		return nil
+	}
+	return a.stream.Send(&pb.AgentMessage{Payload: &pb.AgentMessage_Ready{Ready: &pb.Ready{AgentId: id}}})
+}
+
+func (a *Agent) agentID() string {
+	id, _ := a.id.Load().(string)
+	return id
 }
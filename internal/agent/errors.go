@@ -6,4 +6,6 @@ var (
 	ErrDevisionByZero   = errors.New("devision by zero")
 	ErrInvalidOperator  = errors.New("operator is not a number")
 	ErrInvalidOperation = errors.New("invalid operation")
+	ErrInvalidPower     = errors.New("power result is not a real number")
+	ErrNotExact         = errors.New("operation is not supported in exact mode")
 )
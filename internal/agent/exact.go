@@ -0,0 +1,152 @@
+package agent
+
+import (
+	"context"
+	"math/big"
+	"time"
+
+	"github.com/YattaDeSune/calc-project/internal/logger"
+	pb "github.com/YattaDeSune/calc-project/internal/proto"
+	"github.com/YattaDeSune/calc-project/pkg/decimal"
+	"go.uber.org/zap"
+)
+
+// Максимальный показатель степени в точном режиме, иначе числа становятся огромными
+const maxExactExponent = 1000
+
+// Точное вычисление таски: аргументы - десятичные строки, результат округляется до заданной точности
+func (a *Agent) processExactTask(ctx context.Context, task *pb.GetTaskResponse) *pb.SubmitResultRequest {
+	logger := logger.FromContext(ctx)
+
+	scale, rounding := int(task.Precision.Scale), task.Precision.Rounding
+
+	args := make([]*big.Rat, 0, len(taskArgs(task)))
+	for _, arg := range taskArgs(task) {
+		value, err := decimal.Parse(arg)
+		if err != nil {
+			return &pb.SubmitResultRequest{Id: task.Id, Error: ErrInvalidOperator.Error()}
+		}
+		args = append(args, value)
+	}
+
+	result, err := exactOperation(task.Operation, args, scale, rounding)
+	if err != nil {
+		logger.Info("Exact operation failed", zap.String("task id", task.Id), zap.String("operation", task.Operation), zap.Error(err))
+		return &pb.SubmitResultRequest{Id: task.Id, Error: err.Error()}
+	}
+
+	time.Sleep(a.operationTime(task.Operation))
+	exact := decimal.Round(result, scale, rounding)
+	approx, _ := result.Float64()
+	return &pb.SubmitResultRequest{Id: task.Id, Result: approx, ExactResult: exact}
+}
+
+func exactOperation(operation string, args []*big.Rat, scale int, rounding string) (*big.Rat, error) {
+	switch operation {
+	case "~":
+		return new(big.Rat).Neg(args[0]), nil
+	case "abs":
+		return new(big.Rat).Abs(args[0]), nil
+	case "min", "max":
+		result := args[0]
+		for _, arg := range args[1:] {
+			if (operation == "min") == (arg.Cmp(result) < 0) {
+				result = arg
+			}
+		}
+		return result, nil
+	case "floor", "ceil":
+		mode := decimal.Floor
+		if operation == "ceil" {
+			mode = decimal.Ceiling
+		}
+		return decimal.Parse(decimal.Round(args[0], 0, mode))
+	case "round":
+		digits := 0
+		if len(args) > 1 {
+			if !args[1].IsInt() || !args[1].Num().IsInt64() {
+				return nil, ErrInvalidOperator
+			}
+			digits = int(args[1].Num().Int64())
+		}
+		if digits < 0 || digits > decimal.MaxScale {
+			return nil, ErrInvalidOperator
+		}
+		return decimal.Parse(decimal.Round(args[0], digits, rounding))
+	case "sqrt":
+		if args[0].Sign() < 0 {
+			return nil, ErrInvalidPower
+		}
+		// считаем с запасом точности, дальше результат все равно округляется до scale
+		prec := uint(args[0].Num().BitLen()+args[0].Denom().BitLen()) + uint(scale)*4 + 64
+		root := new(big.Float).SetPrec(prec).SetRat(args[0])
+		root.Sqrt(root)
+		result, _ := root.Rat(nil)
+		return result, nil
+	}
+
+	// Дальше только бинарные операции
+	if len(args) != 2 {
+		return nil, ErrNotExact
+	}
+	arg1, arg2 := args[0], args[1]
+
+	switch operation {
+	case "+":
+		return new(big.Rat).Add(arg1, arg2), nil
+	case "-":
+		return new(big.Rat).Sub(arg1, arg2), nil
+	case "*":
+		return new(big.Rat).Mul(arg1, arg2), nil
+	case "/":
+		if arg2.Sign() == 0 {
+			return nil, ErrDevisionByZero
+		}
+		return new(big.Rat).Quo(arg1, arg2), nil
+	case "^":
+		// точно можно возвести только в целую степень
+		if !arg2.IsInt() || !arg2.Num().IsInt64() || abs(arg2.Num().Int64()) > maxExactExponent {
+			return nil, ErrNotExact
+		}
+		exp := arg2.Num().Int64()
+		if arg1.Sign() == 0 && exp < 0 {
+			return nil, ErrInvalidPower
+		}
+		num := new(big.Int).Exp(arg1.Num(), big.NewInt(abs(exp)), nil)
+		denom := new(big.Int).Exp(arg1.Denom(), big.NewInt(abs(exp)), nil)
+		if exp < 0 {
+			num, denom = denom, num
+		}
+		return new(big.Rat).SetFrac(num, denom), nil
+	default:
+		// log, sin, ... точно не посчитать
+		return nil, ErrNotExact
+	}
+}
+
+// Время выполнения операции из конфига
+func (a *Agent) operationTime(operation string) time.Duration {
+	var ms int
+	switch operation {
+	case "+":
+		ms = a.cfg.TimeAdditionMs
+	case "-", "~":
+		ms = a.cfg.TimeSubtractionMs
+	case "*":
+		ms = a.cfg.TimeMultiplicationMs
+	case "/":
+		ms = a.cfg.TimeDivisionMs
+	case "^":
+		ms = a.cfg.TimePowerMs
+	default:
+		ms = a.cfg.TimeFunctionMs
+	}
+	return time.Duration(ms) * time.Millisecond
+}
+
+func abs(n int64) int64 {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
@@ -2,11 +2,14 @@ package agent
 
 import (
 	"context"
+	"math"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/YattaDeSune/calc-project/internal/logger"
 	pb "github.com/YattaDeSune/calc-project/internal/proto"
+	"github.com/YattaDeSune/calc-project/pkg/calculation"
 	"go.uber.org/zap"
 )
 
@@ -16,20 +19,45 @@ func (a *Agent) processTask(ctx context.Context, task *pb.GetTaskResponse) *pb.S
 
 	logger.Info("Processed task",
 		zap.String("task id", task.Id),
-		zap.String("arg1", task.Arg1),
-		zap.String("arg2", task.Arg2),
+		zap.String("args", strings.Join(taskArgs(task), ", ")),
 		zap.String("operation", task.Operation),
 	)
 
+	if task.Precision != nil {
+		return a.processExactTask(ctx, task)
+	}
+
 	// Нет смысла обрабатывать err потому что такого рода ошибки сюда не дойдут
-	arg1, err := strconv.ParseFloat(task.Arg1, 64)
-	if err != nil {
-		return &pb.SubmitResultRequest{Id: task.Id, Error: ErrInvalidOperator.Error()}
+	args := make([]float64, 0, len(taskArgs(task)))
+	for _, arg := range taskArgs(task) {
+		value, err := strconv.ParseFloat(arg, 64)
+		if err != nil {
+			return &pb.SubmitResultRequest{Id: task.Id, Error: ErrInvalidOperator.Error()}
+		}
+		args = append(args, value)
+	}
+
+	// Встроенные функции: sqrt, max, ...
+	if _, ok := calculation.Functions[task.Operation]; ok {
+		result, err := calculation.CallFunction(task.Operation, args)
+		if err != nil {
+			return &pb.SubmitResultRequest{Id: task.Id, Error: err.Error()}
+		}
+		time.Sleep(time.Duration(a.cfg.TimeFunctionMs) * time.Millisecond)
+		return &pb.SubmitResultRequest{Id: task.Id, Result: result}
+	}
+
+	if task.Operation == "~" {
+		time.Sleep(time.Duration(a.cfg.TimeSubtractionMs) * time.Millisecond)
+		return &pb.SubmitResultRequest{Id: task.Id, Result: -args[0]}
 	}
-	arg2, err := strconv.ParseFloat(task.Arg2, 64)
-	if err != nil && task.Operation != "~" {
-		return &pb.SubmitResultRequest{Id: task.Id, Error: ErrInvalidOperator.Error()}
+
+	// Дальше только бинарные операции
+	if len(args) != 2 {
+		logger.Error("Invalid operation", zap.String("task id", task.Id), zap.String("operation", task.Operation))
+		return &pb.SubmitResultRequest{Id: task.Id, Error: ErrInvalidOperation.Error()}
 	}
+	arg1, arg2 := args[0], args[1]
 
 	switch task.Operation {
 	case "+":
@@ -47,11 +75,27 @@ func (a *Agent) processTask(ctx context.Context, task *pb.GetTaskResponse) *pb.S
 		}
 		time.Sleep(time.Duration(a.cfg.TimeDivisionMs) * time.Millisecond)
 		return &pb.SubmitResultRequest{Id: task.Id, Result: arg1 / arg2}
-	case "~":
-		time.Sleep(time.Duration(a.cfg.TimeSubtractionMs) * time.Millisecond)
-		return &pb.SubmitResultRequest{Id: task.Id, Result: -arg1}
+	case "^":
+		result := math.Pow(arg1, arg2)
+		// например 0^-1 или (-8)^(1/3)
+		if math.IsNaN(result) || math.IsInf(result, 0) {
+			return &pb.SubmitResultRequest{Id: task.Id, Error: ErrInvalidPower.Error()}
+		}
+		time.Sleep(time.Duration(a.cfg.TimePowerMs) * time.Millisecond)
+		return &pb.SubmitResultRequest{Id: task.Id, Result: result}
 	default:
 		logger.Error("Invalid operation", zap.String("task id", task.Id), zap.String("operation", task.Operation))
 		return &pb.SubmitResultRequest{Id: task.Id, Error: ErrInvalidOperation.Error()}
 	}
 }
+
+// Аргументы таски: старый оркестратор присылает только arg1 и arg2
+func taskArgs(task *pb.GetTaskResponse) []string {
+	if len(task.Args) > 0 {
+		return task.Args
+	}
+	if task.Operation == "~" {
+		return []string{task.Arg1}
+	}
+	return []string{task.Arg1, task.Arg2}
+}
@@ -2,11 +2,11 @@ package agent
 
 import (
 	"context"
+	"time"
 
 	"github.com/YattaDeSune/calc-project/internal/logger"
+	pb "github.com/YattaDeSune/calc-project/internal/proto"
 	"go.uber.org/zap"
-	"google.golang.org/grpc/codes"
-	"google.golang.org/grpc/status"
 )
 
 // Воркер принимает задачу из канала и возвращает результат в другой канал
@@ -20,20 +20,51 @@ func (a *Agent) worker(ctx context.Context, cancel context.CancelFunc, num int)
 			zap.Int("worker number", num),
 			zap.String("task id", task.Id),
 		)
-		a.readyTaskChan <- a.processTask(ctx, task)
-
-		// Ожидание результата
-
-		readyTask := <-a.readyTaskChan
+		stopLease := a.keepLease(ctx, task)
+		readyTask := a.processTask(ctx, task)
+		stopLease()
 		logger.Info("Worker finished to process task",
 			zap.Int("worker number", num),
 			zap.String("task id", readyTask.Id),
 			zap.Float64("task result", readyTask.Result),
 		)
 
-		// Если нет подключения к оркестратору - кладем агента
-		if _, err := a.client.SubmitResult(ctx, readyTask); status.Code(err) == codes.Unavailable {
-			cancel()
-		}
+		// Отправкой результата занимается submitter
+		a.readyTaskChan <- readyTask
+	}
+}
+
+// Продлевает аренду таски, пока воркер ее считает. Возвращает функцию остановки
+func (a *Agent) keepLease(ctx context.Context, task *pb.GetTaskResponse) func() {
+	logger := logger.FromContext(ctx)
+
+	// старый оркестратор аренду не выдает
+	if task.LeaseMs <= 0 {
+		return func() {}
 	}
+
+	done := make(chan struct{})
+	go func() {
+		lease := time.Duration(task.LeaseMs) * time.Millisecond
+		for {
+			// продлеваем заранее, на середине срока
+			select {
+			case <-done:
+				return
+			case <-ctx.Done():
+				return
+			case <-time.After(lease / 2):
+			}
+
+			resp, err := a.client.RenewLease(ctx, &pb.RenewLeaseRequest{TaskId: task.Id, AgentId: a.agentID()})
+			if err != nil {
+				// таску уже отдали другому агенту - результат все равно отправим, оркестратор разберется
+				logger.Warn("Failed to renew task lease", zap.String("task id", task.Id), zap.Error(err))
+				return
+			}
+			lease = time.Duration(resp.LeaseMs) * time.Millisecond
+		}
+	}()
+
+	return func() { close(done) }
 }
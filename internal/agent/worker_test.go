@@ -17,6 +17,8 @@ func TestWorker_ProcessTask(t *testing.T) {
 		TimeSubtractionMs:    1,
 		TimeMultiplicationMs: 1,
 		TimeDivisionMs:       1,
+		TimePowerMs:          1,
+		TimeFunctionMs:       1,
 	}
 
 	agent := &Agent{
@@ -56,6 +58,8 @@ func TestWorker_InvalidTask(t *testing.T) {
 		TimeSubtractionMs:    1,
 		TimeMultiplicationMs: 1,
 		TimeDivisionMs:       1,
+		TimePowerMs:          1,
+		TimeFunctionMs:       1,
 	}
 
 	agent := &Agent{
@@ -94,6 +98,8 @@ func TestWorker_DivisionByZero(t *testing.T) {
 		TimeSubtractionMs:    1,
 		TimeMultiplicationMs: 1,
 		TimeDivisionMs:       1,
+		TimePowerMs:          1,
+		TimeFunctionMs:       1,
 	}
 
 	agent := &Agent{
@@ -125,3 +131,127 @@ func TestWorker_DivisionByZero(t *testing.T) {
 		t.Fatal("Timeout waiting for result")
 	}
 }
+
+func TestWorker_Power(t *testing.T) {
+	cfg := &Config{
+		TimeAdditionMs:       1,
+		TimeSubtractionMs:    1,
+		TimeMultiplicationMs: 1,
+		TimeDivisionMs:       1,
+		TimePowerMs:          1,
+		TimeFunctionMs:       1,
+	}
+
+	agent := &Agent{
+		cfg:           cfg,
+		taskChan:      make(chan *pb.GetTaskResponse, 1),
+		readyTaskChan: make(chan *pb.SubmitResultRequest, 1),
+	}
+
+	ctx := logger.WithLogger(context.Background(), zap.NewNop())
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	go agent.worker(ctx, cancel, 1)
+
+	task := &pb.GetTaskResponse{
+		Id:        "123",
+		Arg1:      "2",
+		Arg2:      "9",
+		Operation: "^",
+	}
+
+	agent.taskChan <- task
+
+	select {
+	case result := <-agent.readyTaskChan:
+		assert.Equal(t, "123", result.Id)
+		assert.Equal(t, 512.0, result.Result)
+	case <-time.After(2 * time.Second):
+		t.Fatal("Timeout waiting for result")
+	}
+}
+
+func TestWorker_Function(t *testing.T) {
+	cfg := &Config{
+		TimeAdditionMs:       1,
+		TimeSubtractionMs:    1,
+		TimeMultiplicationMs: 1,
+		TimeDivisionMs:       1,
+		TimePowerMs:          1,
+		TimeFunctionMs:       1,
+	}
+
+	agent := &Agent{
+		cfg:           cfg,
+		taskChan:      make(chan *pb.GetTaskResponse, 1),
+		readyTaskChan: make(chan *pb.SubmitResultRequest, 1),
+	}
+
+	ctx := logger.WithLogger(context.Background(), zap.NewNop())
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	go agent.worker(ctx, cancel, 1)
+
+	task := &pb.GetTaskResponse{
+		Id:        "123",
+		Arg1:      "4",
+		Arg2:      "9",
+		Args:      []string{"4", "9", "1"},
+		Operation: "max",
+	}
+
+	agent.taskChan <- task
+
+	select {
+	case result := <-agent.readyTaskChan:
+		assert.Equal(t, "123", result.Id)
+		assert.Equal(t, 9.0, result.Result)
+	case <-time.After(2 * time.Second):
+		t.Fatal("Timeout waiting for result")
+	}
+}
+
+func TestWorker_ExactTask(t *testing.T) {
+	cfg := &Config{
+		TimeAdditionMs:       1,
+		TimeSubtractionMs:    1,
+		TimeMultiplicationMs: 1,
+		TimeDivisionMs:       1,
+		TimePowerMs:          1,
+		TimeFunctionMs:       1,
+	}
+
+	agent := &Agent{
+		cfg:           cfg,
+		taskChan:      make(chan *pb.GetTaskResponse, 1),
+		readyTaskChan: make(chan *pb.SubmitResultRequest, 1),
+	}
+
+	ctx := logger.WithLogger(context.Background(), zap.NewNop())
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	go agent.worker(ctx, cancel, 1)
+
+	task := &pb.GetTaskResponse{
+		Id:        "123",
+		Arg1:      "0.1",
+		Arg2:      "0.2",
+		Args:      []string{"0.1", "0.2"},
+		Operation: "+",
+		Precision: &pb.Precision{Scale: 2, Rounding: "half_even"},
+	}
+
+	agent.taskChan <- task
+
+	select {
+	case result := <-agent.readyTaskChan:
+		assert.Equal(t, "123", result.Id)
+		assert.Equal(t, "0.30", result.ExactResult)
+		assert.Equal(t, 0.3, result.Result)
+	case <-time.After(2 * time.Second):
+		t.Fatal("Timeout waiting for result")
+	}
+}
@@ -1,7 +1,11 @@
 package auth
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
+	"fmt"
+	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
@@ -13,22 +17,81 @@ var (
 	ErrTokenExpired = errors.New("token expired")
 )
 
+// Минимальная длина секрета HS256
+const MinKeySize = 32
+
 type Claims struct {
 	UserID int
 	Login  string
 	jwt.RegisteredClaims
 }
 
+// Ключ подписи токенов, ID попадает в заголовок kid
+type Key struct {
+	ID     string
+	Secret []byte
+}
+
+// Подписывает токены первым ключом, а проверяет любым из keys по kid.
+// Ротация: новый ключ ставится первым, старый остается в списке, пока не истекут подписанные им токены
 type JWTManager struct {
-	secretKey     string
+	signingKey    Key
+	keys          map[string][]byte
 	tokenDuration time.Duration
 }
 
-func NewJWTManager(secretKey string, tokenDuration time.Duration) *JWTManager {
+func NewJWTManager(keys []Key, tokenDuration time.Duration) (*JWTManager, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("no JWT keys")
+	}
+
+	byID := make(map[string][]byte, len(keys))
+	for _, key := range keys {
+		if key.ID == "" {
+			return nil, errors.New("JWT key without id")
+		}
+		if len(key.Secret) < MinKeySize {
+			return nil, fmt.Errorf("JWT key %q is shorter than %d bytes", key.ID, MinKeySize)
+		}
+		if _, ok := byID[key.ID]; ok {
+			return nil, fmt.Errorf("duplicate JWT key %q", key.ID)
+		}
+		byID[key.ID] = key.Secret
+	}
+
 	return &JWTManager{
-		secretKey:     secretKey,
+		signingKey:    keys[0],
+		keys:          byID,
 		tokenDuration: tokenDuration,
+	}, nil
+}
+
+// Разбирает ключи из строк "kid:secret", разделенных запятыми или переводами строк.
+// Пустые строки и строки с # пропускаются
+func ParseKeys(s string) ([]Key, error) {
+	var keys []Key
+	for _, line := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == '\n' }) {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		id, secret, ok := strings.Cut(line, ":")
+		if !ok {
+			// строку целиком не показываем - в ней может быть секрет
+			return nil, fmt.Errorf("invalid JWT key %d, expected kid:secret", len(keys)+1)
+		}
+		keys = append(keys, Key{ID: strings.TrimSpace(id), Secret: []byte(strings.TrimSpace(secret))})
+	}
+	return keys, nil
+}
+
+// Случайный ключ, если ключи не настроены: токены перестанут действовать после перезапуска
+func GenerateKey() (Key, error) {
+	secret := make([]byte, MinKeySize)
+	if _, err := rand.Read(secret); err != nil {
+		return Key{}, err
 	}
+	return Key{ID: "random", Secret: []byte(hex.EncodeToString(secret))}, nil
 }
 
 func (m *JWTManager) Generate(id int, username string) (string, error) {
@@ -41,7 +104,8 @@ func (m *JWTManager) Generate(id int, username string) (string, error) {
 	}
 
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString([]byte(m.secretKey))
+	token.Header["kid"] = m.signingKey.ID
+	return token.SignedString(m.signingKey.Secret)
 }
 
 func (m *JWTManager) Verify(accessToken string) (*Claims, error) {
@@ -49,12 +113,15 @@ func (m *JWTManager) Verify(accessToken string) (*Claims, error) {
 		accessToken,
 		&Claims{},
 		func(token *jwt.Token) (interface{}, error) {
-			_, ok := token.Method.(*jwt.SigningMethodHMAC)
+			// токены без kid или с удаленным ключом не принимаем
+			kid, _ := token.Header["kid"].(string)
+			secret, ok := m.keys[kid]
 			if !ok {
 				return nil, ErrInvalidToken
 			}
-			return []byte(m.secretKey), nil
+			return secret, nil
 		},
+		jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}),
 	)
 
 	if err != nil {
@@ -0,0 +1,140 @@
+package auth
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var (
+	oldKey = Key{ID: "2024", Secret: []byte(strings.Repeat("o", MinKeySize))}
+	newKey = Key{ID: "2025", Secret: []byte(strings.Repeat("n", MinKeySize))}
+)
+
+func newManager(t *testing.T, keys ...Key) *JWTManager {
+	t.Helper()
+
+	m, err := NewJWTManager(keys, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestJWTManager_Rotation(t *testing.T) {
+	before := newManager(t, oldKey)
+	oldToken, err := before.Generate(1, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// новый ключ подписывает, старый еще принимается
+	rotated := newManager(t, newKey, oldKey)
+	newToken, err := rotated.Generate(2, "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, _, err := jwt.NewParser().ParseUnverified(newToken, &Claims{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kid := parsed.Header["kid"]; kid != newKey.ID {
+		t.Errorf("expected kid %q, got %v", newKey.ID, kid)
+	}
+
+	for token, userID := range map[string]int{oldToken: 1, newToken: 2} {
+		claims, err := rotated.Verify(token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if claims.UserID != userID {
+			t.Errorf("expected user %d, got %d", userID, claims.UserID)
+		}
+	}
+
+	// старый ключ удален
+	after := newManager(t, newKey)
+	if _, err := after.Verify(oldToken); err != ErrInvalidToken {
+		t.Errorf("expected ErrInvalidToken for removed key, got %v", err)
+	}
+	if _, err := after.Verify(newToken); err != nil {
+		t.Errorf("expected new token to be valid, got %v", err)
+	}
+}
+
+func TestJWTManager_Verify(t *testing.T) {
+	m := newManager(t, newKey)
+
+	sign := func(header map[string]any, method jwt.SigningMethod, secret any, expiresAt time.Time) string {
+		token := jwt.NewWithClaims(method, Claims{
+			UserID:           1,
+			RegisteredClaims: jwt.RegisteredClaims{ExpiresAt: jwt.NewNumericDate(expiresAt)},
+		})
+		for k, v := range header {
+			token.Header[k] = v
+		}
+		signed, err := token.SignedString(secret)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signed
+	}
+
+	hour := time.Now().Add(time.Hour)
+	testCases := []struct {
+		name  string
+		token string
+		err   error
+	}{
+		{name: "valid", token: sign(map[string]any{"kid": newKey.ID}, jwt.SigningMethodHS256, newKey.Secret, hour)},
+		{name: "no kid", token: sign(nil, jwt.SigningMethodHS256, newKey.Secret, hour), err: ErrInvalidToken},
+		{name: "unknown kid", token: sign(map[string]any{"kid": "other"}, jwt.SigningMethodHS256, newKey.Secret, hour), err: ErrInvalidToken},
+		{name: "wrong secret", token: sign(map[string]any{"kid": newKey.ID}, jwt.SigningMethodHS256, oldKey.Secret, hour), err: ErrInvalidToken},
+		{name: "other method", token: sign(map[string]any{"kid": newKey.ID}, jwt.SigningMethodHS512, newKey.Secret, hour), err: ErrInvalidToken},
+		{name: "expired", token: sign(map[string]any{"kid": newKey.ID}, jwt.SigningMethodHS256, newKey.Secret, time.Now().Add(-time.Minute)), err: ErrTokenExpired},
+		{name: "garbage", token: "not.a.token", err: ErrInvalidToken},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := m.Verify(tc.token); err != tc.err {
+				t.Errorf("expected %v, got %v", tc.err, err)
+			}
+		})
+	}
+}
+
+func TestNewJWTManager_InvalidKeys(t *testing.T) {
+	invalid := [][]Key{
+		nil,
+		{{ID: "", Secret: newKey.Secret}},
+		{{ID: "short", Secret: []byte("secret")}},
+		{newKey, {ID: newKey.ID, Secret: oldKey.Secret}},
+	}
+	for _, keys := range invalid {
+		if _, err := NewJWTManager(keys, time.Hour); err == nil {
+			t.Errorf("expected error for keys %v", keys)
+		}
+	}
+}
+
+func TestParseKeys(t *testing.T) {
+	keys, err := ParseKeys("# current\n2025: secret1 \n\n2024:secret:2,  old:x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Key{{"2025", []byte("secret1")}, {"2024", []byte("secret:2")}, {"old", []byte("x")}}
+	if len(keys) != len(want) {
+		t.Fatalf("expected %d keys, got %+v", len(want), keys)
+	}
+	for i := range want {
+		if keys[i].ID != want[i].ID || string(keys[i].Secret) != string(want[i].Secret) {
+			t.Errorf("expected %+v, got %+v", want[i], keys[i])
+		}
+	}
+
+	if _, err := ParseKeys("no-colon-secret"); err == nil || strings.Contains(err.Error(), "no-colon-secret") {
+		t.Errorf("expected error without the key itself, got %v", err)
+	}
+}
@@ -0,0 +1,116 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Различия между бд, с которыми работает Database
+type dialect interface {
+	driver() string
+	migrationsDir() string
+	// Плейсхолдеры в запросе: запросы пишутся с ?, а бд может ждать $1, $2...
+	rebind(query string) string
+	// Значение для сравнения с expressions.created_at
+	createdAt(t time.Time) any
+	// Условие "column содержит подстроку ?"
+	contains(column string) string
+	tableExists(ctx context.Context, db *dbConn, name string) (bool, error)
+	// Доводит бд, созданную до миграций, до первой миграции
+	adoptLegacySchema(ctx context.Context, db *dbConn, logger *zap.Logger) error
+}
+
+// Выбирает бд по DSN: postgres://... или postgresql://... - PostgreSQL,
+// иначе путь к файлу SQLite (можно с префиксом sqlite://)
+func dialectFromDSN(dsn string) (dialect, string) {
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		return postgresDialect{}, dsn
+	}
+	return sqliteDialect{}, strings.TrimPrefix(dsn, "sqlite://")
+}
+
+// DSN без пароля, чтобы его можно было писать в логи
+func RedactDSN(dsn string) string {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return "(invalid DSN)"
+	}
+	return u.Redacted()
+}
+
+// Обертки над sql.DB и sql.Tx, переписывающие плейсхолдеры под диалект
+type dbConn struct {
+	*sql.DB
+	dialect dialect
+}
+
+func (c *dbConn) ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	return c.DB.ExecContext(ctx, c.dialect.rebind(query), args...)
+}
+
+func (c *dbConn) QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error) {
+	return c.DB.QueryContext(ctx, c.dialect.rebind(query), args...)
+}
+
+func (c *dbConn) QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row {
+	return c.DB.QueryRowContext(ctx, c.dialect.rebind(query), args...)
+}
+
+func (c *dbConn) BeginTx(ctx context.Context, opts *sql.TxOptions) (*dbTx, error) {
+	tx, err := c.DB.BeginTx(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &dbTx{Tx: tx, dialect: c.dialect}, nil
+}
+
+type dbTx struct {
+	*sql.Tx
+	dialect dialect
+}
+
+func (t *dbTx) ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	return t.Tx.ExecContext(ctx, t.dialect.rebind(query), args...)
+}
+
+func (t *dbTx) QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error) {
+	return t.Tx.QueryContext(ctx, t.dialect.rebind(query), args...)
+}
+
+func (t *dbTx) QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row {
+	return t.Tx.QueryRowContext(ctx, t.dialect.rebind(query), args...)
+}
+
+type sqliteDialect struct{}
+
+func (sqliteDialect) driver() string        { return "sqlite3" }
+func (sqliteDialect) migrationsDir() string { return "migrations/sqlite" }
+
+func (sqliteDialect) rebind(query string) string { return query }
+
+// Формат CURRENT_TIMESTAMP, в нем хранится expressions.created_at
+const sqliteTimeFormat = "2006-01-02 15:04:05"
+
+// Время в SQLite - строка, сравнивать надо в том же формате
+func (sqliteDialect) createdAt(t time.Time) any {
+	return t.UTC().Format(sqliteTimeFormat)
+}
+
+func (sqliteDialect) contains(column string) string {
+	return fmt.Sprintf("instr(%s, ?) > 0", column)
+}
+
+func (sqliteDialect) tableExists(ctx context.Context, db *dbConn, name string) (bool, error) {
+	var count int
+	const query = `SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?`
+	if err := db.QueryRowContext(ctx, query, name).Scan(&count); err != nil {
+		return false, fmt.Errorf("failed to check table %s: %w", name, err)
+	}
+	return count > 0, nil
+}
@@ -0,0 +1,336 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/YattaDeSune/calc-project/internal/entities"
+	"go.uber.org/zap"
+)
+
+//go:embed migrations/*/*.sql
+var migrationsFS embed.FS
+
+// Миграция схемы: файлы migrations/<бд>/<версия>_<имя>.up.sql и .down.sql
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string // пусто - откатить нельзя
+}
+
+type MigrationStatus struct {
+	Migration
+	AppliedAt *time.Time // nil - не применена
+}
+
+var migrationFile = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+// Читает миграции из fsys и сортирует по версии
+func LoadMigrations(fsys fs.FS) ([]Migration, error) {
+	files, err := fs.Glob(fsys, "*.sql")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int]*Migration)
+	for _, file := range files {
+		match := migrationFile.FindStringSubmatch(file)
+		if match == nil {
+			return nil, fmt.Errorf("invalid migration file name %q", file)
+		}
+		version, _ := strconv.Atoi(match[1])
+		data, err := fs.ReadFile(fsys, file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read migration %q: %w", file, err)
+		}
+
+		migration, ok := byVersion[version]
+		if !ok {
+			migration = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = migration
+		}
+		if migration.Name != match[2] {
+			return nil, fmt.Errorf("migrations %s and %s have the same version %d", migration.Name, match[2], version)
+		}
+		if match[3] == "up" {
+			migration.Up = string(data)
+		} else {
+			migration.Down = string(data)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, migration := range byVersion {
+		if migration.Up == "" {
+			return nil, fmt.Errorf("migration %d_%s has no up file", migration.Version, migration.Name)
+		}
+		migrations = append(migrations, *migration)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+func (d *Database) createMigrationsTable(ctx context.Context) error {
+	const query = `
+	CREATE TABLE IF NOT EXISTS schema_migrations(
+		version INTEGER PRIMARY KEY,
+		name TEXT NOT NULL,
+		applied_at TIMESTAMP NOT NULL
+	);`
+	if _, err := d.db.ExecContext(ctx, query); err != nil {
+		return fmt.Errorf("failed to create schema_migrations table: %w", err)
+	}
+	return nil
+}
+
+// Примененные миграции: версия -> время применения
+func (d *Database) appliedMigrations(ctx context.Context) (map[int]time.Time, error) {
+	if err := d.createMigrationsTable(ctx); err != nil {
+		return nil, err
+	}
+
+	rows, err := d.db.QueryContext(ctx, `SELECT version, applied_at FROM schema_migrations`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query schema migrations: %w", err)
+	}
+	defer rows.Close()
+
+	applied := make(map[int]time.Time)
+	for rows.Next() {
+		var version int
+		var appliedAt time.Time
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan schema migration: %w", err)
+		}
+		applied[version] = appliedAt
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows error: %w", err)
+	}
+
+	return applied, nil
+}
+
+// В бд есть миграции, которых не знает эта сборка - схема новее кода, менять ее нельзя
+func (d *Database) checkUnknownMigrations(applied map[int]time.Time) error {
+	for version := range applied {
+		if !d.hasMigration(version) {
+			return fmt.Errorf("database has unknown migration %d, it was migrated by a newer version", version)
+		}
+	}
+	return nil
+}
+
+func (d *Database) hasMigration(version int) bool {
+	for _, migration := range d.migrations {
+		if migration.Version == version {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *Database) MigrationStatus(ctx context.Context) ([]MigrationStatus, error) {
+	applied, err := d.appliedMigrations(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]MigrationStatus, len(d.migrations))
+	for i, migration := range d.migrations {
+		statuses[i].Migration = migration
+		if appliedAt, ok := applied[migration.Version]; ok {
+			statuses[i].AppliedAt = &appliedAt
+		}
+	}
+	// миграции более новой сборки показываем без имени
+	for version, appliedAt := range applied {
+		if !d.hasMigration(version) {
+			statuses = append(statuses, MigrationStatus{Migration: Migration{Version: version}, AppliedAt: &appliedAt})
+		}
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Version < statuses[j].Version })
+	return statuses, nil
+}
+
+// Применяет steps еще не примененных миграций по порядку (steps <= 0 - все), каждую в своей транзакции.
+// Возвращает примененные миграции
+func (d *Database) MigrateUp(ctx context.Context, steps int) ([]Migration, error) {
+	applied, err := d.appliedMigrations(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := d.checkUnknownMigrations(applied); err != nil {
+		return nil, err
+	}
+	if len(applied) == 0 {
+		if err := d.dialect.adoptLegacySchema(ctx, d.db, d.logger); err != nil {
+			return nil, err
+		}
+	}
+
+	var done []Migration
+	for _, migration := range d.migrations {
+		if steps > 0 && len(done) == steps {
+			break
+		}
+		if _, ok := applied[migration.Version]; ok {
+			continue
+		}
+
+		if err := d.applyMigration(ctx, migration.Up, func(tx *dbTx) error {
+			const query = `INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)`
+			_, err := tx.ExecContext(ctx, query, migration.Version, migration.Name, time.Now().UTC())
+			return err
+		}); err != nil {
+			return done, fmt.Errorf("failed to apply migration %d_%s: %w", migration.Version, migration.Name, err)
+		}
+		d.logger.Info("Migration applied", zap.Int("version", migration.Version), zap.String("name", migration.Name))
+		done = append(done, migration)
+	}
+	return done, nil
+}
+
+// Откатывает steps последних примененных миграций (steps <= 0 - все), каждую в своей транзакции.
+// Возвращает откаченные миграции
+func (d *Database) MigrateDown(ctx context.Context, steps int) ([]Migration, error) {
+	applied, err := d.appliedMigrations(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := d.checkUnknownMigrations(applied); err != nil {
+		return nil, err
+	}
+
+	var done []Migration
+	for i := len(d.migrations) - 1; i >= 0; i-- {
+		migration := d.migrations[i]
+		if steps > 0 && len(done) == steps {
+			break
+		}
+		if _, ok := applied[migration.Version]; !ok {
+			continue
+		}
+		if migration.Down == "" {
+			return done, fmt.Errorf("migration %d_%s cannot be rolled back", migration.Version, migration.Name)
+		}
+
+		if err := d.applyMigration(ctx, migration.Down, func(tx *dbTx) error {
+			_, err := tx.ExecContext(ctx, `DELETE FROM schema_migrations WHERE version = ?`, migration.Version)
+			return err
+		}); err != nil {
+			return done, fmt.Errorf("failed to roll back migration %d_%s: %w", migration.Version, migration.Name, err)
+		}
+		d.logger.Info("Migration rolled back", zap.Int("version", migration.Version), zap.String("name", migration.Name))
+		done = append(done, migration)
+	}
+	return done, nil
+}
+
+// Выполняет скрипт миграции и запись о ней в одной транзакции: при ошибке схема не меняется
+func (d *Database) applyMigration(ctx context.Context, script string, record func(tx *dbTx) error) error {
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, script); err != nil {
+		return err
+	}
+	if err := record(tx); err != nil {
+		return fmt.Errorf("failed to record migration: %w", err)
+	}
+
+	return tx.Commit()
+}
+
+// Бд, созданная до миграций: в ее таблицах может не хватать колонок, добавленных позже.
+// Добавляем их, дальше первая миграция досоздает недостающие таблицы и индексы
+func (d sqliteDialect) adoptLegacySchema(ctx context.Context, db *dbConn, logger *zap.Logger) error {
+	exists, err := d.tableExists(ctx, db, "expressions")
+	if err != nil {
+		return fmt.Errorf("failed to check legacy schema: %w", err)
+	}
+	if !exists {
+		return nil
+	}
+
+	columns := []struct{ table, name, definition string }{
+		{"expressions", "scale", "INTEGER"},
+		{"expressions", "rounding", "TEXT"},
+		{"expressions", "exact_result", "TEXT"},
+		{"expressions", "priority", "INTEGER NOT NULL DEFAULT 0"},
+		{"expressions", "callback_url", "TEXT"},
+		{"expressions", "callback_secret", "TEXT"},
+		{"expressions", "error_code", "TEXT"},
+		{"expressions", "error_message", "TEXT"},
+		{"expressions", "started_at", "DATETIME"},
+		{"expressions", "finished_at", "DATETIME"},
+		{"expressions", "task_count", "INTEGER NOT NULL DEFAULT 0"},
+		{"expressions", "compute_ms", "INTEGER NOT NULL DEFAULT 0"},
+		{"tasks", "attempts", "INTEGER NOT NULL DEFAULT 0"},
+		{"users", "max_priority", "INTEGER"},
+	}
+	for _, column := range columns {
+		if err := addColumnIfNotExists(ctx, db, column.table, column.name, column.definition); err != nil {
+			return err
+		}
+	}
+
+	// Раньше текст ошибки писался в result, переносим его в error_message
+	const moveErrors = `
+	UPDATE expressions SET error_code = ?, error_message = result, result = NULL
+	WHERE status = ? AND error_message IS NULL AND typeof(result) = 'text'`
+	if _, err := db.ExecContext(ctx, moveErrors, entities.ErrorCodeUnknown, entities.CompletedWithError); err != nil {
+		return fmt.Errorf("failed to move expression errors: %w", err)
+	}
+
+	logger.Info("Legacy database schema adopted")
+	return nil
+}
+
+// Добавляет колонку, если ее нет (tasks в старой бд может не быть - тогда ее создаст миграция)
+func addColumnIfNotExists(ctx context.Context, db *dbConn, table, column, definition string) error {
+	rows, err := db.QueryContext(ctx, fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return fmt.Errorf("failed to get %s columns: %w", table, err)
+	}
+	defer rows.Close()
+
+	found := false
+	for rows.Next() {
+		var (
+			cid, notNull, pk int
+			name, colType    string
+			defaultValue     sql.NullString
+		)
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &defaultValue, &pk); err != nil {
+			return fmt.Errorf("failed to scan %s columns: %w", table, err)
+		}
+		found = true
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("rows error: %w", err)
+	}
+	// таблицы нет
+	if !found {
+		return nil
+	}
+
+	if _, err := db.ExecContext(ctx, fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition)); err != nil {
+		return fmt.Errorf("failed to add column %s.%s: %w", table, column, err)
+	}
+	return nil
+}
@@ -0,0 +1,173 @@
+package db
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+
+	"github.com/YattaDeSune/calc-project/internal/entities"
+	"github.com/YattaDeSune/calc-project/internal/logger"
+	"go.uber.org/zap"
+)
+
+// Открывает пустую бд во временной директории без миграций
+func openTestDatabase(t *testing.T) (context.Context, *Database) {
+	t.Helper()
+
+	ctx := logger.WithLogger(context.Background(), zap.NewNop())
+	database, err := Open(ctx, filepath.Join(t.TempDir(), "calculator.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { database.Close() })
+	return ctx, database
+}
+
+func (d *Database) tableExists(t *testing.T, name string) bool {
+	t.Helper()
+
+	exists, err := d.dialect.tableExists(context.Background(), d.db, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return exists
+}
+
+func TestLoadMigrations(t *testing.T) {
+	migrations, err := LoadMigrations(fstest.MapFS{
+		"0002_second.up.sql":  {Data: []byte("2 up")},
+		"0001_first.up.sql":   {Data: []byte("1 up")},
+		"0001_first.down.sql": {Data: []byte("1 down")},
+		"0010_tenth.up.sql":   {Data: []byte("10 up")},
+		"0010_tenth.down.sql": {Data: []byte("10 down")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(migrations) != 3 || migrations[0].Version != 1 || migrations[1].Version != 2 || migrations[2].Version != 10 {
+		t.Fatalf("expected migrations 1, 2, 10, got %+v", migrations)
+	}
+	if migrations[0].Name != "first" || migrations[0].Down != "1 down" || migrations[1].Down != "" {
+		t.Errorf("unexpected migration %+v", migrations[0])
+	}
+
+	invalid := []fstest.MapFS{
+		{"first.up.sql": {}},
+		{"0001_first.down.sql": {}},
+		{"0001_first.up.sql": {}, "0001_other.up.sql": {}},
+	}
+	for _, fsys := range invalid {
+		if _, err := LoadMigrations(fsys); err == nil {
+			t.Errorf("expected error for %v", fsys)
+		}
+	}
+}
+
+func TestMigrate_UpDown(t *testing.T) {
+	ctx, database := openTestDatabase(t)
+	database.migrations = []Migration{
+		{Version: 1, Name: "a", Up: "CREATE TABLE a(id INTEGER);", Down: "DROP TABLE a;"},
+		{Version: 2, Name: "b", Up: "CREATE TABLE b(id INTEGER);", Down: "DROP TABLE b;"},
+		{Version: 3, Name: "broken", Up: "CREATE TABLE c(id INTEGER); INSERT INTO missing VALUES (1);"},
+	}
+
+	applied, err := database.MigrateUp(ctx, 1)
+	if err != nil || len(applied) != 1 || applied[0].Version != 1 {
+		t.Fatalf("expected migration 1 to be applied, got %v, %v", applied, err)
+	}
+
+	// вторая применяется, третья падает и откатывается целиком
+	applied, err = database.MigrateUp(ctx, 0)
+	if err == nil || len(applied) != 1 || applied[0].Version != 2 {
+		t.Fatalf("expected migration 2 to be applied and 3 to fail, got %v, %v", applied, err)
+	}
+	if !database.tableExists(t, "b") || database.tableExists(t, "c") {
+		t.Error("expected table b without table c")
+	}
+
+	statuses, err := database.MigrationStatus(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(statuses) != 3 || statuses[0].AppliedAt == nil || statuses[1].AppliedAt == nil || statuses[2].AppliedAt != nil {
+		t.Errorf("expected 1 and 2 applied, got %+v", statuses)
+	}
+
+	rolledBack, err := database.MigrateDown(ctx, 1)
+	if err != nil || len(rolledBack) != 1 || rolledBack[0].Version != 2 {
+		t.Fatalf("expected migration 2 to be rolled back, got %v, %v", rolledBack, err)
+	}
+	if !database.tableExists(t, "a") || database.tableExists(t, "b") {
+		t.Error("expected table a without table b")
+	}
+
+	// бд мигрирована более новой сборкой
+	database.migrations = database.migrations[1:]
+	if _, err := database.MigrateUp(ctx, 0); err == nil {
+		t.Error("expected error for unknown applied migration")
+	}
+}
+
+func TestMigrate_Embedded(t *testing.T) {
+	ctx, database := openTestDatabase(t)
+
+	if _, err := database.MigrateUp(ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := database.CreateExpression(ctx, 1, entities.Accepted, entities.NewExpression{Expression: "1+2"}); err != nil {
+		t.Fatal(err)
+	}
+	if applied, err := database.MigrateUp(ctx, 0); err != nil || len(applied) != 0 {
+		t.Fatalf("expected no pending migrations, got %v, %v", applied, err)
+	}
+
+	if _, err := database.MigrateDown(ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+	if database.tableExists(t, "expressions") {
+		t.Error("expected all tables to be dropped")
+	}
+	if _, err := database.MigrateUp(ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMigrate_LegacyDatabase(t *testing.T) {
+	ctx, database := openTestDatabase(t)
+
+	// бд, созданная до миграций: без новых колонок, ошибка хранится в result
+	const legacy = `
+	CREATE TABLE users(id INTEGER PRIMARY KEY AUTOINCREMENT, login TEXT UNIQUE NOT NULL, password TEXT NOT NULL);
+	CREATE TABLE expressions(
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		expression TEXT NOT NULL,
+		user_id INTEGER NOT NULL,
+		status TEXT NOT NULL,
+		result NUMERIC,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+	INSERT INTO expressions (expression, user_id, status, result) VALUES ('1/0', 1, 'completed with error', 'division by zero');`
+	if _, err := database.db.Exec(legacy); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := database.MigrateUp(ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	expr, err := database.GetExpressionByID(ctx, 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expr.Result != nil || expr.ErrorMessage == nil || *expr.ErrorMessage != "division by zero" ||
+		expr.ErrorCode == nil || *expr.ErrorCode != entities.ErrorCodeUnknown {
+		t.Errorf("expected error to be moved out of result, got %+v", expr)
+	}
+	if !database.tableExists(t, "webhook_outbox") {
+		t.Error("expected missing tables to be created")
+	}
+	if _, err := database.CreateExpression(ctx, 1, entities.Accepted, entities.NewExpression{Expression: "1+2", Priority: 1}); err != nil {
+		t.Errorf("expected new columns to be added: %v", err)
+	}
+}
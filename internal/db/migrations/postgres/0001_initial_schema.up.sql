@@ -0,0 +1,90 @@
+-- Та же схема, что у SQLite, в типах PostgreSQL
+
+CREATE TABLE IF NOT EXISTS users(
+	id BIGSERIAL PRIMARY KEY,
+	login TEXT UNIQUE NOT NULL,
+	password TEXT NOT NULL,
+	max_priority INTEGER -- NULL - значение из конфига
+);
+
+CREATE TABLE IF NOT EXISTS expressions(
+	id BIGSERIAL PRIMARY KEY,
+	expression TEXT NOT NULL,
+	user_id BIGINT NOT NULL,
+	status TEXT NOT NULL,
+	result DOUBLE PRECISION,
+	created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+	scale INTEGER,
+	rounding TEXT,
+	exact_result TEXT,
+	priority INTEGER NOT NULL DEFAULT 0,
+	callback_url TEXT,
+	callback_secret TEXT,
+	error_code TEXT,
+	error_message TEXT,
+	started_at TIMESTAMPTZ,
+	finished_at TIMESTAMPTZ,
+	task_count INTEGER NOT NULL DEFAULT 0,
+	compute_ms BIGINT NOT NULL DEFAULT 0,
+	FOREIGN KEY (user_id) REFERENCES users (id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_expressions_user_created_at ON expressions (user_id, created_at);
+CREATE INDEX IF NOT EXISTS idx_expressions_user_priority ON expressions (user_id, priority);
+
+-- Состояние вычисления выражений, чтобы после перезапуска оркестратора продолжить работу
+CREATE TABLE IF NOT EXISTS tasks(
+	id TEXT PRIMARY KEY,
+	expression_id BIGINT NOT NULL,
+	idx INTEGER NOT NULL,
+	operation TEXT NOT NULL,
+	args TEXT NOT NULL,
+	status TEXT NOT NULL,
+	parent INTEGER NOT NULL,
+	parent_arg INTEGER NOT NULL,
+	pending INTEGER NOT NULL,
+	result NUMERIC,
+	attempts INTEGER NOT NULL DEFAULT 0,
+	FOREIGN KEY (expression_id) REFERENCES expressions (id)
+);
+
+-- История попыток вычисления тасок, чтобы находить нестабильных агентов
+CREATE TABLE IF NOT EXISTS task_attempts(
+	id BIGSERIAL PRIMARY KEY,
+	task_id TEXT NOT NULL,
+	expression_id BIGINT NOT NULL,
+	attempt INTEGER NOT NULL,
+	agent_id TEXT NOT NULL,
+	operation TEXT NOT NULL,
+	started_at TIMESTAMPTZ NOT NULL,
+	finished_at TIMESTAMPTZ,
+	outcome TEXT,
+	error TEXT,
+	FOREIGN KEY (expression_id) REFERENCES expressions (id)
+);
+
+-- Вебхуки о завершении выражений: строка добавляется в одной транзакции с результатом и живет до доставки
+CREATE TABLE IF NOT EXISTS webhook_outbox(
+	id BIGSERIAL PRIMARY KEY,
+	expression_id BIGINT NOT NULL UNIQUE,
+	status TEXT NOT NULL,
+	attempts INTEGER NOT NULL DEFAULT 0,
+	next_attempt_at TIMESTAMPTZ NOT NULL,
+	last_error TEXT,
+	created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+	FOREIGN KEY (expression_id) REFERENCES expressions (id)
+);
+
+-- Ответы на запросы с Idempotency-Key, чтобы повтор запроса не создавал выражение еще раз
+CREATE TABLE IF NOT EXISTS idempotency_keys(
+	user_id BIGINT NOT NULL,
+	key TEXT NOT NULL,
+	request_hash TEXT NOT NULL,
+	status_code INTEGER,
+	response BYTEA,
+	created_at TIMESTAMPTZ NOT NULL,
+	PRIMARY KEY (user_id, key),
+	FOREIGN KEY (user_id) REFERENCES users (id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_idempotency_keys_created_at ON idempotency_keys (created_at);
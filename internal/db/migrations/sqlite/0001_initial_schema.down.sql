@@ -0,0 +1,6 @@
+DROP TABLE IF EXISTS idempotency_keys;
+DROP TABLE IF EXISTS webhook_outbox;
+DROP TABLE IF EXISTS task_attempts;
+DROP TABLE IF EXISTS tasks;
+DROP TABLE IF EXISTS expressions;
+DROP TABLE IF EXISTS users;
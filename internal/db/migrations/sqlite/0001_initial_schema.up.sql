@@ -0,0 +1,91 @@
+-- Схема на момент перехода на миграции. IF NOT EXISTS - чтобы применить поверх бд,
+-- созданной до миграций (недостающие колонки таким бд добавляет adoptLegacySchema)
+
+CREATE TABLE IF NOT EXISTS users(
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	login TEXT UNIQUE NOT NULL,
+	password TEXT NOT NULL,
+	max_priority INTEGER -- NULL - значение из конфига
+);
+
+CREATE TABLE IF NOT EXISTS expressions(
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	expression TEXT NOT NULL,
+	user_id INTEGER NOT NULL,
+	status TEXT NOT NULL,
+	result NUMERIC,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	scale INTEGER,
+	rounding TEXT,
+	exact_result TEXT,
+	priority INTEGER NOT NULL DEFAULT 0,
+	callback_url TEXT,
+	callback_secret TEXT,
+	error_code TEXT,
+	error_message TEXT,
+	started_at DATETIME,
+	finished_at DATETIME,
+	task_count INTEGER NOT NULL DEFAULT 0,
+	compute_ms INTEGER NOT NULL DEFAULT 0,
+	FOREIGN KEY (user_id) REFERENCES users (id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_expressions_user_created_at ON expressions (user_id, created_at);
+CREATE INDEX IF NOT EXISTS idx_expressions_user_priority ON expressions (user_id, priority);
+
+-- Состояние вычисления выражений, чтобы после перезапуска оркестратора продолжить работу
+CREATE TABLE IF NOT EXISTS tasks(
+	id TEXT PRIMARY KEY,
+	expression_id INTEGER NOT NULL,
+	idx INTEGER NOT NULL,
+	operation TEXT NOT NULL,
+	args TEXT NOT NULL,
+	status TEXT NOT NULL,
+	parent INTEGER NOT NULL,
+	parent_arg INTEGER NOT NULL,
+	pending INTEGER NOT NULL,
+	result NUMERIC,
+	attempts INTEGER NOT NULL DEFAULT 0,
+	FOREIGN KEY (expression_id) REFERENCES expressions (id)
+);
+
+-- История попыток вычисления тасок, чтобы находить нестабильных агентов
+CREATE TABLE IF NOT EXISTS task_attempts(
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	task_id TEXT NOT NULL,
+	expression_id INTEGER NOT NULL,
+	attempt INTEGER NOT NULL,
+	agent_id TEXT NOT NULL,
+	operation TEXT NOT NULL,
+	started_at DATETIME NOT NULL,
+	finished_at DATETIME,
+	outcome TEXT,
+	error TEXT,
+	FOREIGN KEY (expression_id) REFERENCES expressions (id)
+);
+
+-- Вебхуки о завершении выражений: строка добавляется в одной транзакции с результатом и живет до доставки
+CREATE TABLE IF NOT EXISTS webhook_outbox(
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	expression_id INTEGER NOT NULL UNIQUE,
+	status TEXT NOT NULL,
+	attempts INTEGER NOT NULL DEFAULT 0,
+	next_attempt_at DATETIME NOT NULL,
+	last_error TEXT,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	FOREIGN KEY (expression_id) REFERENCES expressions (id)
+);
+
+-- Ответы на запросы с Idempotency-Key, чтобы повтор запроса не создавал выражение еще раз
+CREATE TABLE IF NOT EXISTS idempotency_keys(
+	user_id INTEGER NOT NULL,
+	key TEXT NOT NULL,
+	request_hash TEXT NOT NULL,
+	status_code INTEGER,
+	response BLOB,
+	created_at DATETIME NOT NULL,
+	PRIMARY KEY (user_id, key),
+	FOREIGN KEY (user_id) REFERENCES users (id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_idempotency_keys_created_at ON idempotency_keys (created_at);
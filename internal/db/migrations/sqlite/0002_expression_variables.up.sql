@@ -0,0 +1,2 @@
+-- Значения переменных выражения (JSON), чтобы после перезапуска разобрать выражение заново
+ALTER TABLE expressions ADD COLUMN variables TEXT;
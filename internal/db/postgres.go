@@ -0,0 +1,63 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	_ "github.com/lib/pq"
+	"go.uber.org/zap"
+)
+
+type postgresDialect struct{}
+
+func (postgresDialect) driver() string        { return "postgres" }
+func (postgresDialect) migrationsDir() string { return "migrations/postgres" }
+
+// Заменяет ? на $1, $2... Знаки вопроса внутри строковых литералов не трогает
+func (postgresDialect) rebind(query string) string {
+	if !strings.Contains(query, "?") {
+		return query
+	}
+
+	var b strings.Builder
+	b.Grow(len(query) + 8)
+	n, quoted := 0, false
+	for _, r := range query {
+		switch {
+		case r == '\'':
+			quoted = !quoted
+		case r == '?' && !quoted:
+			n++
+			b.WriteByte('$')
+			b.WriteString(strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+func (postgresDialect) createdAt(t time.Time) any {
+	return t.UTC()
+}
+
+func (postgresDialect) contains(column string) string {
+	return fmt.Sprintf("strpos(%s, ?) > 0", column)
+}
+
+func (postgresDialect) tableExists(ctx context.Context, db *dbConn, name string) (bool, error) {
+	var count int
+	const query = `SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = current_schema() AND table_name = ?`
+	if err := db.QueryRowContext(ctx, query, name).Scan(&count); err != nil {
+		return false, fmt.Errorf("failed to check table %s: %w", name, err)
+	}
+	return count > 0, nil
+}
+
+// В PostgreSQL бд создаются сразу миграциями, старых схем не бывает
+func (postgresDialect) adoptLegacySchema(ctx context.Context, db *dbConn, logger *zap.Logger) error {
+	return nil
+}
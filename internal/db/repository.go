@@ -0,0 +1,72 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"github.com/YattaDeSune/calc-project/internal/entities"
+)
+
+// Хранилище оркестратора. Реализация - Database поверх SQLite или PostgreSQL, см. New
+type Repository interface {
+	UserRepository
+	ExpressionRepository
+	TaskRepository
+	WebhookRepository
+	IdempotencyRepository
+	Migrator
+	Close() error
+}
+
+type UserRepository interface {
+	// errors.ErrUserExists - логин занят
+	CreateUser(ctx context.Context, login, password string) (int, error)
+	// errors.ErrWrongLogin - пользователя нет
+	GetUserByLogin(ctx context.Context, login string) (*entities.User, error)
+	GetUserMaxPriority(ctx context.Context, userID int) (*int, error)
+}
+
+type ExpressionRepository interface {
+	CreateExpression(ctx context.Context, userID int, status string, expr entities.NewExpression) (int, error)
+	CreateExpressions(ctx context.Context, userID int, status string, exprs []entities.NewExpression) ([]int, error)
+	// nil - выражения нет или оно чужое
+	GetExpressionByID(ctx context.Context, id int, userID int) (*entities.ExpressionDB, error)
+	ListExpressions(ctx context.Context, userID int, filter entities.ExpressionFilter) ([]entities.ExpressionDB, error)
+	GetExpressionsByIDs(ctx context.Context, ids []int, userID int) ([]entities.ExpressionDB, error)
+	UpdateExpressionStatus(ctx context.Context, id int, status string) error
+	StartExpression(ctx context.Context, id int) error
+	UpdateExpressionResult(ctx context.Context, id int, result float64) error
+	UpdateExpressionExactResult(ctx context.Context, id int, exact string, approx float64) error
+	UpdateExpressionError(ctx context.Context, id int, code, message string) error
+	CancelExpression(ctx context.Context, id int) (bool, error)
+	GetUnfinishedExpressions(ctx context.Context) ([]*entities.Expression, error)
+}
+
+// Таски выражений и попытки их вычисления
+type TaskRepository interface {
+	CreateTasks(ctx context.Context, exprID int, tasks []*entities.Task) error
+	UpdateTaskStatus(ctx context.Context, id string, status string) error
+	CompleteTask(ctx context.Context, task *entities.Task, parent *entities.Task) error
+	StartTaskAttempt(ctx context.Context, exprID int, task *entities.Task) error
+	FinishTaskAttempt(ctx context.Context, taskID string, attempt int, outcome string, errMsg string) error
+	FinishOpenTaskAttempts(ctx context.Context, outcome string) error
+	GetTaskAttempts(ctx context.Context, exprID int) ([]entities.TaskAttempt, error)
+}
+
+type WebhookRepository interface {
+	GetDueWebhooks(ctx context.Context, now time.Time, limit int) ([]entities.Webhook, error)
+	FinishWebhook(ctx context.Context, id int, status string, attempts int, errMsg string) error
+	RetryWebhook(ctx context.Context, id int, attempts int, next time.Time, errMsg string) error
+}
+
+type IdempotencyRepository interface {
+	ReserveIdempotencyKey(ctx context.Context, userID int, key, requestHash string, expiredBefore, staleBefore time.Time) (*entities.IdempotencyKey, error)
+	SaveIdempotencyResponse(ctx context.Context, userID int, key string, statusCode int, response []byte) error
+	DeleteIdempotencyKey(ctx context.Context, userID int, key string) error
+}
+
+type Migrator interface {
+	MigrationStatus(ctx context.Context) ([]MigrationStatus, error)
+	MigrateUp(ctx context.Context, steps int) ([]Migration, error)
+	MigrateDown(ctx context.Context, steps int) ([]Migration, error)
+}
@@ -3,7 +3,12 @@ package db
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"fmt"
+	"io/fs"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/YattaDeSune/calc-project/internal/entities"
 	"github.com/YattaDeSune/calc-project/internal/errors"
@@ -12,64 +17,62 @@ import (
 	"go.uber.org/zap"
 )
 
+// Хранилище поверх database/sql. Запросы общие для всех бд, различия - в dialect
 type Database struct {
-	db     *sql.DB
-	logger *zap.Logger
+	db         *dbConn
+	dialect    dialect
+	logger     *zap.Logger
+	migrations []Migration
 }
 
-func New(ctx context.Context) (*Database, error) {
+var _ Repository = (*Database)(nil)
+
+// Открывает бд без миграций (для calc-server migrate)
+func Open(ctx context.Context, dsn string) (*Database, error) {
 	logger := logger.FromContext(ctx)
 
-	db, err := sql.Open("sqlite3", "calculator.db")
+	dialect, source := dialectFromDSN(dsn)
+	migrationsDir, err := fs.Sub(migrationsFS, dialect.migrationsDir())
 	if err != nil {
-		return nil, fmt.Errorf("failed to open database: %w", err)
+		return nil, fmt.Errorf("failed to open migrations: %w", err)
 	}
-
-	if err := db.Ping(); err != nil {
-		return nil, fmt.Errorf("failed to ping database: %w", err)
+	migrations, err := LoadMigrations(migrationsDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load migrations: %w", err)
 	}
 
-	database := &Database{
-		db:     db,
-		logger: logger,
+	db, err := sql.Open(dialect.driver(), source)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
 	}
 
-	if err := database.createTables(); err != nil {
-		return nil, fmt.Errorf("failed to create tables: %w", err)
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to ping database: %w", err)
 	}
 
-	return database, nil
+	return &Database{
+		db:         &dbConn{DB: db, dialect: dialect},
+		dialect:    dialect,
+		logger:     logger,
+		migrations: migrations,
+	}, nil
 }
 
-func (d *Database) createTables() error {
-	usersTable := `
-	CREATE TABLE IF NOT EXISTS users(
-		id INTEGER PRIMARY KEY AUTOINCREMENT, 
-		login TEXT UNIQUE NOT NULL,
-		password TEXT NOT NULL
-	);`
-
-	expressionsTable := `
-	CREATE TABLE IF NOT EXISTS expressions(
-		id INTEGER PRIMARY KEY AUTOINCREMENT, 
-		expression TEXT NOT NULL,
-		user_id INTEGER NOT NULL,
-		status TEXT NOT NULL,
-		result NUMERIC,
-		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
-		FOREIGN KEY (user_id) REFERENCES users (id)
-	);`
-
-	if _, err := d.db.Exec(usersTable); err != nil {
-		return fmt.Errorf("failed to create users table: %w", err)
+// Открывает бд и применяет все новые миграции
+func New(ctx context.Context, dsn string) (*Database, error) {
+	database, err := Open(ctx, dsn)
+	if err != nil {
+		return nil, err
 	}
 
-	if _, err := d.db.Exec(expressionsTable); err != nil {
-		return fmt.Errorf("failed to create expressions table: %w", err)
+	if _, err := database.MigrateUp(ctx, 0); err != nil {
+		database.Close()
+		return nil, fmt.Errorf("failed to migrate database: %w", err)
 	}
 
-	d.logger.Info("Database tables created successfully")
-	return nil
+	database.logger.Info("Database schema is up to date", zap.String("driver", database.dialect.driver()))
+	return database, nil
 }
 
 func (d *Database) Close() error {
@@ -86,18 +89,13 @@ func (d *Database) CreateUser(ctx context.Context, login, password string) (int,
 		return 0, errors.ErrUserExists
 	}
 
-	const query = `INSERT INTO users (login, password) VALUES (?, ?)`
-	result, err := d.db.ExecContext(ctx, query, login, password)
-	if err != nil {
+	const query = `INSERT INTO users (login, password) VALUES (?, ?) RETURNING id`
+	var id int
+	if err := d.db.QueryRowContext(ctx, query, login, password).Scan(&id); err != nil {
 		return 0, fmt.Errorf("failed to create user: %w", err)
 	}
 
-	id, err := result.LastInsertId()
-	if err != nil {
-		return 0, fmt.Errorf("failed to get last insert ID: %w", err)
-	}
-
-	return int(id), nil
+	return id, nil
 }
 
 func (d *Database) GetUserByLogin(ctx context.Context, login string) (*entities.User, error) {
@@ -115,55 +113,178 @@ func (d *Database) GetUserByLogin(ctx context.Context, login string) (*entities.
 	return &user, nil
 }
 
-func (d *Database) CreateExpression(ctx context.Context, expr string, userID int, status string) (int, error) {
-	const query = `INSERT INTO expressions (expression, user_id, status) VALUES (?, ?, ?)`
-	result, err := d.db.ExecContext(ctx, query, expr, userID, status)
+// Максимальный приоритет выражений пользователя, nil - не задан
+func (d *Database) GetUserMaxPriority(ctx context.Context, userID int) (*int, error) {
+	const query = `SELECT max_priority FROM users WHERE id = ?`
+
+	var maxPriority sql.NullInt64
+	if err := d.db.QueryRowContext(ctx, query, userID).Scan(&maxPriority); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get user max priority: %w", err)
+	}
+
+	if !maxPriority.Valid {
+		return nil, nil
+	}
+	value := int(maxPriority.Int64)
+	return &value, nil
+}
+
+func (d *Database) CreateExpression(ctx context.Context, userID int, status string, expr entities.NewExpression) (int, error) {
+	return insertExpression(ctx, d.db, userID, status, expr)
+}
+
+// Записывает выражения пользователя одной транзакцией, возвращает их id в том же порядке
+func (d *Database) CreateExpressions(ctx context.Context, userID int, status string, exprs []entities.NewExpression) ([]int, error) {
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	ids := make([]int, len(exprs))
+	for i, expr := range exprs {
+		if ids[i], err = insertExpression(ctx, tx, userID, status, expr); err != nil {
+			return nil, err
+		}
+	}
+
+	return ids, tx.Commit()
+}
+
+type queryRower interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+func insertExpression(ctx context.Context, db queryRower, userID int, status string, expr entities.NewExpression) (int, error) {
+	var scale, rounding any
+	if expr.Precision != nil {
+		scale, rounding = expr.Precision.Scale, expr.Precision.Rounding
+	}
+	var callbackURL, callbackSecret any
+	if expr.Callback != nil {
+		callbackURL, callbackSecret = expr.Callback.URL, expr.Callback.Secret
+	}
+	variables, err := marshalVariables(expr.Variables)
 	if err != nil {
+		return 0, err
+	}
+
+	const query = `
+	INSERT INTO expressions (expression, user_id, status, scale, rounding, variables, priority, callback_url, callback_secret)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+	RETURNING id
+	`
+	var id int
+	if err := db.QueryRowContext(ctx, query, expr.Expression, userID, status, scale, rounding, variables, expr.Priority, callbackURL, callbackSecret).Scan(&id); err != nil {
 		return 0, fmt.Errorf("failed to create expression: %w", err)
 	}
 
-	id, err := result.LastInsertId()
+	return id, nil
+}
+
+// Переменные хранятся JSON-объектом, выражение без переменных - NULL
+func marshalVariables(variables map[string]float64) (any, error) {
+	if len(variables) == 0 {
+		return nil, nil
+	}
+	data, err := json.Marshal(variables)
 	if err != nil {
-		return 0, fmt.Errorf("failed to get last insert ID: %w", err)
+		return nil, fmt.Errorf("failed to marshal variables: %w", err)
 	}
+	return string(data), nil
+}
 
-	return int(id), nil
+func unmarshalVariables(data sql.NullString) (map[string]float64, error) {
+	if !data.Valid {
+		return nil, nil
+	}
+	var variables map[string]float64
+	if err := json.Unmarshal([]byte(data.String), &variables); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal variables: %w", err)
+	}
+	return variables, nil
+}
+
+const expressionColumns = `id, expression, user_id, status, result, scale, rounding, variables, exact_result, error_code, error_message,
+	priority, task_count, compute_ms, created_at, started_at, finished_at`
+
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+func scanExpression(row scanner) (*entities.ExpressionDB, error) {
+	var expr entities.ExpressionDB
+	var result sql.NullFloat64
+	var scale sql.NullInt64
+	var rounding, variables, exactResult sql.NullString
+	var createdAt, startedAt, finishedAt sql.NullTime
+	if err := row.Scan(&expr.ID, &expr.Expression, &expr.UserID, &expr.Status, &result, &scale, &rounding, &variables, &exactResult,
+		&expr.ErrorCode, &expr.ErrorMessage, &expr.Priority, &expr.TaskCount, &expr.ComputeMs, &createdAt, &startedAt, &finishedAt); err != nil {
+		return nil, err
+	}
+
+	var err error
+	if expr.Variables, err = unmarshalVariables(variables); err != nil {
+		return nil, err
+	}
+
+	// в UTC, чтобы время не зависело от часового пояса сессии бд
+	if createdAt.Valid {
+		expr.CreatedAt = createdAt.Time.UTC().Format(time.RFC3339Nano)
+	}
+
+	if result.Valid {
+		expr.Result = &result.Float64
+	}
+	if startedAt.Valid {
+		expr.StartedAt = &startedAt.Time
+	}
+	if finishedAt.Valid {
+		expr.FinishedAt = &finishedAt.Time
+	}
+	if scale.Valid {
+		expr.Precision = &entities.Precision{Scale: int(scale.Int64), Rounding: rounding.String}
+	}
+	if exactResult.Valid {
+		expr.ExactResult = &exactResult.String
+	}
+	return &expr, nil
 }
 
 func (d *Database) GetExpressionByID(ctx context.Context, id int, userID int) (*entities.ExpressionDB, error) {
 	const query = `
-	SELECT id, expression, user_id, status, result, created_at FROM expressions 
+	SELECT ` + expressionColumns + ` FROM expressions 
 	WHERE id = ?
 	AND user_id = ?
 	`
 	row := d.db.QueryRowContext(ctx, query, id, userID)
 
-	var expr entities.ExpressionDB
-	if err := row.Scan(&expr.ID, &expr.Expression, &expr.UserID, &expr.Status, &expr.Result, &expr.CreatedAt); err != nil {
+	expr, err := scanExpression(row)
+	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, nil
 		}
 		return nil, fmt.Errorf("failed to scan expression: %w", err)
 	}
 
-	return &expr, nil
+	return expr, nil
 }
 
-func (d *Database) GetExpressionsByUser(ctx context.Context, userID int) ([]entities.ExpressionDB, error) {
-	const query = `SELECT id, expression, user_id, status, result, created_at FROM expressions WHERE user_id = ? ORDER BY created_at DESC`
-	rows, err := d.db.QueryContext(ctx, query, userID)
-	if err != nil {
-		return nil, fmt.Errorf("failed to query expressions: %w", err)
-	}
-	defer rows.Close()
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
 
+func scanExpressions(rows *sql.Rows) ([]entities.ExpressionDB, error) {
 	var expressions []entities.ExpressionDB
 	for rows.Next() {
-		var expr entities.ExpressionDB
-		if err := rows.Scan(&expr.ID, &expr.Expression, &expr.UserID, &expr.Status, &expr.Result, &expr.CreatedAt); err != nil {
+		expr, err := scanExpression(rows)
+		if err != nil {
 			return nil, fmt.Errorf("failed to scan expression: %w", err)
 		}
-		expressions = append(expressions, expr)
+		expressions = append(expressions, *expr)
 	}
 
 	if err := rows.Err(); err != nil {
@@ -173,6 +294,83 @@ func (d *Database) GetExpressionsByUser(ctx context.Context, userID int) ([]enti
 	return expressions, nil
 }
 
+// Страница выражений пользователя. При равных значениях колонки сортировки порядок задает id,
+// поэтому курсор (значение, id) однозначно указывает, с какого места продолжать
+func (d *Database) ListExpressions(ctx context.Context, userID int, filter entities.ExpressionFilter) ([]entities.ExpressionDB, error) {
+	where := []string{"user_id = ?"}
+	args := []any{userID}
+
+	if len(filter.Statuses) > 0 {
+		where = append(where, "status IN ("+placeholders(len(filter.Statuses))+")")
+		for _, status := range filter.Statuses {
+			args = append(args, status)
+		}
+	}
+	if filter.CreatedFrom != nil {
+		where = append(where, "created_at >= ?")
+		args = append(args, d.dialect.createdAt(*filter.CreatedFrom))
+	}
+	if filter.CreatedTo != nil {
+		where = append(where, "created_at < ?")
+		args = append(args, d.dialect.createdAt(*filter.CreatedTo))
+	}
+	if filter.Search != "" {
+		where = append(where, d.dialect.contains("expression"))
+		args = append(args, filter.Search)
+	}
+
+	column := "created_at"
+	if filter.Sort == entities.ExpressionSortPriority {
+		column = "priority"
+	}
+	order, cmp := "ASC", ">"
+	if filter.Desc {
+		order, cmp = "DESC", "<"
+	}
+	if filter.After != nil {
+		value := d.dialect.createdAt(filter.After.CreatedAt)
+		if column == "priority" {
+			value = filter.After.Priority
+		}
+		where = append(where, fmt.Sprintf("(%s, id) %s (?, ?)", column, cmp))
+		args = append(args, value, filter.After.ID)
+	}
+
+	query := `SELECT ` + expressionColumns + ` FROM expressions WHERE ` + strings.Join(where, " AND ") +
+		fmt.Sprintf(` ORDER BY %s %s, id %s LIMIT ?`, column, order, order)
+	args = append(args, filter.Limit)
+
+	rows, err := d.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query expressions: %w", err)
+	}
+	defer rows.Close()
+
+	return scanExpressions(rows)
+}
+
+// Выражения пользователя с заданными id, чужие и несуществующие пропускаются
+func (d *Database) GetExpressionsByIDs(ctx context.Context, ids []int, userID int) ([]entities.ExpressionDB, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	args := make([]any, 0, len(ids)+1)
+	args = append(args, userID)
+	for _, id := range ids {
+		args = append(args, id)
+	}
+
+	query := `SELECT ` + expressionColumns + ` FROM expressions WHERE user_id = ? AND id IN (` + placeholders(len(ids)) + `) ORDER BY id`
+	rows, err := d.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query expressions: %w", err)
+	}
+	defer rows.Close()
+
+	return scanExpressions(rows)
+}
+
 func (d *Database) UpdateExpressionStatus(ctx context.Context, id int, status string) error {
 	const query = `UPDATE expressions SET status = ? WHERE id = ?`
 	_, err := d.db.ExecContext(ctx, query, status, id)
@@ -182,11 +380,537 @@ func (d *Database) UpdateExpressionStatus(ctx context.Context, id int, status st
 	return nil
 }
 
-func (d *Database) UpdateExpressionResult(ctx context.Context, id int, result any, status string) error {
-	const query = `UPDATE expressions SET result = ?, status = ? WHERE id = ?`
-	_, err := d.db.ExecContext(ctx, query, result, status, id)
+// Выражение взято в работу: первая таска выдана агенту
+func (d *Database) StartExpression(ctx context.Context, id int) error {
+	// досчитанное или отмененное выражение не трогаем
+	const query = `UPDATE expressions SET status = ?, started_at = COALESCE(started_at, ?) WHERE id = ? AND status IN (?, ?)`
+	if _, err := d.db.ExecContext(ctx, query, entities.InProgress, time.Now().UTC(), id, entities.Accepted, entities.InProgress); err != nil {
+		return fmt.Errorf("failed to start expression: %w", err)
+	}
+	return nil
+}
+
+// Записывает результат выражения и удаляет его таски - они больше не нужны
+func (d *Database) UpdateExpressionResult(ctx context.Context, id int, result float64) error {
+	return d.finishExpression(ctx, id, entities.Completed, result, nil, nil, nil)
+}
+
+// Записывает результат точного вычисления: десятичная строка хранится как есть, в result - приближенное значение
+func (d *Database) UpdateExpressionExactResult(ctx context.Context, id int, exact string, approx float64) error {
+	return d.finishExpression(ctx, id, entities.Completed, approx, exact, nil, nil)
+}
+
+// Завершает выражение с ошибкой, code - один из entities.ErrorCode*
+func (d *Database) UpdateExpressionError(ctx context.Context, id int, code, message string) error {
+	return d.finishExpression(ctx, id, entities.CompletedWithError, nil, nil, code, message)
+}
+
+// Отменяет выражение, если оно еще вычисляется. false - выражение уже завершено
+func (d *Database) CancelExpression(ctx context.Context, id int) (bool, error) {
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	const query = `UPDATE expressions SET status = ?, finished_at = ? WHERE id = ? AND status IN (?, ?)`
+	result, err := tx.ExecContext(ctx, query, entities.Cancelled, time.Now().UTC(), id, entities.Accepted, entities.InProgress)
+	if err != nil {
+		return false, fmt.Errorf("failed to cancel expression: %w", err)
+	}
+	affected, err := result.RowsAffected()
 	if err != nil {
+		return false, fmt.Errorf("failed to get affected rows: %w", err)
+	}
+	if affected == 0 {
+		return false, nil
+	}
+
+	const deleteTasks = `DELETE FROM tasks WHERE expression_id = ?`
+	if _, err := tx.ExecContext(ctx, deleteTasks, id); err != nil {
+		return false, fmt.Errorf("failed to delete expression tasks: %w", err)
+	}
+
+	if err := abandonAttempts(ctx, tx, id); err != nil {
+		return false, err
+	}
+
+	if err := updateComputeTime(ctx, tx, id); err != nil {
+		return false, err
+	}
+
+	if err := enqueueWebhook(ctx, tx, id); err != nil {
+		return false, err
+	}
+
+	return true, tx.Commit()
+}
+
+func (d *Database) finishExpression(ctx context.Context, id int, status string, result, exact, errCode, errMsg any) error {
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	const query = `
+	UPDATE expressions SET status = ?, result = ?, exact_result = ?, error_code = ?, error_message = ?, finished_at = ?
+	WHERE id = ?
+	`
+	if _, err := tx.ExecContext(ctx, query, status, result, exact, errCode, errMsg, time.Now().UTC(), id); err != nil {
 		return fmt.Errorf("failed to update expression result: %w", err)
 	}
+
+	const deleteTasks = `DELETE FROM tasks WHERE expression_id = ?`
+	if _, err := tx.ExecContext(ctx, deleteTasks, id); err != nil {
+		return fmt.Errorf("failed to delete expression tasks: %w", err)
+	}
+
+	if err := abandonAttempts(ctx, tx, id); err != nil {
+		return err
+	}
+
+	if err := updateComputeTime(ctx, tx, id); err != nil {
+		return err
+	}
+
+	if err := enqueueWebhook(ctx, tx, id); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// TASKS
+
+func (d *Database) CreateTasks(ctx context.Context, exprID int, tasks []*entities.Task) error {
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	const query = `
+	INSERT INTO tasks (id, expression_id, idx, operation, args, status, parent, parent_arg, pending)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`
+	const updateCount = `UPDATE expressions SET task_count = ? WHERE id = ?`
+	if _, err := tx.ExecContext(ctx, updateCount, len(tasks), exprID); err != nil {
+		return fmt.Errorf("failed to update expression task count: %w", err)
+	}
+
+	for i, task := range tasks {
+		args, err := json.Marshal(task.Args)
+		if err != nil {
+			return fmt.Errorf("failed to marshal task args: %w", err)
+		}
+		if _, err := tx.ExecContext(ctx, query, task.ID, exprID, i, task.Operation, string(args), task.Status, task.Parent, task.ParentArg, task.Pending); err != nil {
+			return fmt.Errorf("failed to create task: %w", err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (d *Database) UpdateTaskStatus(ctx context.Context, id string, status string) error {
+	const query = `UPDATE tasks SET status = ? WHERE id = ?`
+	_, err := d.db.ExecContext(ctx, query, status, id)
+	if err != nil {
+		return fmt.Errorf("failed to update task status: %w", err)
+	}
+	return nil
+}
+
+// Сохраняет результат таски и передает его ожидающей таске (parent может быть nil для последней таски)
+func (d *Database) CompleteTask(ctx context.Context, task *entities.Task, parent *entities.Task) error {
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	const query = `UPDATE tasks SET status = ?, result = ? WHERE id = ?`
+	if _, err := tx.ExecContext(ctx, query, task.Status, task.Result, task.ID); err != nil {
+		return fmt.Errorf("failed to complete task: %w", err)
+	}
+
+	if parent != nil {
+		args, err := json.Marshal(parent.Args)
+		if err != nil {
+			return fmt.Errorf("failed to marshal task args: %w", err)
+		}
+		const parentQuery = `UPDATE tasks SET args = ?, pending = ?, status = ? WHERE id = ?`
+		if _, err := tx.ExecContext(ctx, parentQuery, string(args), parent.Pending, parent.Status, parent.ID); err != nil {
+			return fmt.Errorf("failed to update parent task: %w", err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Выражения, которые не успели досчитаться, вместе с их тасками (таски в порядке индексов)
+func (d *Database) GetUnfinishedExpressions(ctx context.Context) ([]*entities.Expression, error) {
+	const query = `SELECT id, expression, user_id, priority, status, scale, rounding, variables FROM expressions WHERE status IN (?, ?) ORDER BY id`
+	rows, err := d.db.QueryContext(ctx, query, entities.Accepted, entities.InProgress)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query expressions: %w", err)
+	}
+	defer rows.Close()
+
+	var expressions []*entities.Expression
+	for rows.Next() {
+		var expr entities.Expression
+		var scale sql.NullInt64
+		var rounding, variables sql.NullString
+		if err := rows.Scan(&expr.ID, &expr.Expression, &expr.UserID, &expr.Priority, &expr.Status, &scale, &rounding, &variables); err != nil {
+			return nil, fmt.Errorf("failed to scan expression: %w", err)
+		}
+		if scale.Valid {
+			expr.Precision = &entities.Precision{Scale: int(scale.Int64), Rounding: rounding.String}
+		}
+		if expr.Variables, err = unmarshalVariables(variables); err != nil {
+			return nil, err
+		}
+		expressions = append(expressions, &expr)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows error: %w", err)
+	}
+
+	for _, expr := range expressions {
+		tasks, err := d.getTasks(ctx, expr.ID)
+		if err != nil {
+			return nil, err
+		}
+		for _, task := range tasks {
+			task.Precision = expr.Precision
+		}
+		expr.Tasks = tasks
+	}
+
+	return expressions, nil
+}
+
+func (d *Database) getTasks(ctx context.Context, exprID int) ([]*entities.Task, error) {
+	const query = `
+	SELECT id, operation, args, status, parent, parent_arg, pending, result, attempts FROM tasks
+	WHERE expression_id = ?
+	ORDER BY idx
+	`
+	rows, err := d.db.QueryContext(ctx, query, exprID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query tasks: %w", err)
+	}
+	defer rows.Close()
+
+	var tasks []*entities.Task
+	for rows.Next() {
+		var task entities.Task
+		var args string
+		var result sql.NullString
+		if err := rows.Scan(&task.ID, &task.Operation, &args, &task.Status, &task.Parent, &task.ParentArg, &task.Pending, &result, &task.Attempts); err != nil {
+			return nil, fmt.Errorf("failed to scan task: %w", err)
+		}
+		// result - NUMERIC, драйверы отдают его по-разному, приводим к float64
+		if result.Valid {
+			value, err := strconv.ParseFloat(result.String, 64)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse task result: %w", err)
+			}
+			task.Result = value
+		}
+		if err := json.Unmarshal([]byte(args), &task.Args); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal task args: %w", err)
+		}
+		tasks = append(tasks, &task)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows error: %w", err)
+	}
+
+	return tasks, nil
+}
+
+// ATTEMPTS
+
+// Выдача таски агенту: новая попытка и статус "в прогрессе"
+func (d *Database) StartTaskAttempt(ctx context.Context, exprID int, task *entities.Task) error {
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	const query = `UPDATE tasks SET status = ?, attempts = ? WHERE id = ?`
+	result, err := tx.ExecContext(ctx, query, task.Status, task.Attempts, task.ID)
+	if err != nil {
+		return fmt.Errorf("failed to update task status: %w", err)
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get affected rows: %w", err)
+	}
+	// таски уже удалены вместе с досчитанным или отмененным выражением
+	if affected == 0 {
+		return nil
+	}
+
+	const insertAttempt = `
+	INSERT INTO task_attempts (task_id, expression_id, attempt, agent_id, operation, started_at)
+	VALUES (?, ?, ?, ?, ?, ?)
+	`
+	if _, err := tx.ExecContext(ctx, insertAttempt, task.ID, exprID, task.Attempts, task.AgentID, task.Operation, time.Now().UTC()); err != nil {
+		return fmt.Errorf("failed to create task attempt: %w", err)
+	}
+
+	return tx.Commit()
+}
+
+// Завершает попытку с исходом outcome, errMsg - ошибка вычисления (может быть пустой)
+func (d *Database) FinishTaskAttempt(ctx context.Context, taskID string, attempt int, outcome string, errMsg string) error {
+	const query = `
+	UPDATE task_attempts SET finished_at = ?, outcome = ?, error = NULLIF(?, '')
+	WHERE task_id = ? AND attempt = ? AND finished_at IS NULL
+	`
+	if _, err := d.db.ExecContext(ctx, query, time.Now().UTC(), outcome, errMsg, taskID, attempt); err != nil {
+		return fmt.Errorf("failed to finish task attempt: %w", err)
+	}
+	return nil
+}
+
+// Завершает все незаконченные попытки, например после перезапуска оркестратора
+func (d *Database) FinishOpenTaskAttempts(ctx context.Context, outcome string) error {
+	const query = `UPDATE task_attempts SET finished_at = ?, outcome = ? WHERE finished_at IS NULL`
+	if _, err := d.db.ExecContext(ctx, query, time.Now().UTC(), outcome); err != nil {
+		return fmt.Errorf("failed to finish task attempts: %w", err)
+	}
+	return nil
+}
+
+// Считает, сколько агенты потратили на таски выражения: попытки, на которые агент прислал ответ
+func updateComputeTime(ctx context.Context, tx *dbTx, exprID int) error {
+	const query = `
+	SELECT started_at, finished_at FROM task_attempts
+	WHERE expression_id = ? AND outcome IN (?, ?)
+	`
+	rows, err := tx.QueryContext(ctx, query, exprID, entities.AttemptCompleted, entities.AttemptFailed)
+	if err != nil {
+		return fmt.Errorf("failed to query task attempts: %w", err)
+	}
+	defer rows.Close()
+
+	var total time.Duration
+	for rows.Next() {
+		var startedAt, finishedAt time.Time
+		if err := rows.Scan(&startedAt, &finishedAt); err != nil {
+			return fmt.Errorf("failed to scan task attempt: %w", err)
+		}
+		total += finishedAt.Sub(startedAt)
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("rows error: %w", err)
+	}
+
+	const update = `UPDATE expressions SET compute_ms = ? WHERE id = ?`
+	if _, err := tx.ExecContext(ctx, update, total.Milliseconds(), exprID); err != nil {
+		return fmt.Errorf("failed to update expression compute time: %w", err)
+	}
+	return nil
+}
+
+// Попытки, которые еще идут, когда выражение уже завершилось
+func abandonAttempts(ctx context.Context, tx *dbTx, exprID int) error {
+	const query = `
+	UPDATE task_attempts SET finished_at = ?, outcome = ?
+	WHERE expression_id = ? AND finished_at IS NULL
+	`
+	if _, err := tx.ExecContext(ctx, query, time.Now().UTC(), entities.AttemptAbandoned, exprID); err != nil {
+		return fmt.Errorf("failed to abandon task attempts: %w", err)
+	}
+	return nil
+}
+
+func (d *Database) GetTaskAttempts(ctx context.Context, exprID int) ([]entities.TaskAttempt, error) {
+	const query = `
+	SELECT task_id, expression_id, attempt, agent_id, operation, started_at, finished_at, outcome, error
+	FROM task_attempts
+	WHERE expression_id = ?
+	ORDER BY id
+	`
+	rows, err := d.db.QueryContext(ctx, query, exprID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query task attempts: %w", err)
+	}
+	defer rows.Close()
+
+	var attempts []entities.TaskAttempt
+	for rows.Next() {
+		var attempt entities.TaskAttempt
+		var finishedAt sql.NullTime
+		if err := rows.Scan(&attempt.TaskID, &attempt.ExpressionID, &attempt.Attempt, &attempt.AgentID, &attempt.Operation,
+			&attempt.StartedAt, &finishedAt, &attempt.Outcome, &attempt.Error); err != nil {
+			return nil, fmt.Errorf("failed to scan task attempt: %w", err)
+		}
+		if finishedAt.Valid {
+			attempt.FinishedAt = &finishedAt.Time
+		}
+		attempts = append(attempts, attempt)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows error: %w", err)
+	}
+
+	return attempts, nil
+}
+
+// WEBHOOKS
+
+// Ставит в outbox вебхук о завершении выражения, если у выражения есть callback_url
+func enqueueWebhook(ctx context.Context, tx *dbTx, exprID int) error {
+	var hasCallback bool
+	const callbackQuery = `SELECT callback_url IS NOT NULL FROM expressions WHERE id = ?`
+	if err := tx.QueryRowContext(ctx, callbackQuery, exprID).Scan(&hasCallback); err != nil && err != sql.ErrNoRows {
+		return fmt.Errorf("failed to check expression callback: %w", err)
+	}
+	if !hasCallback {
+		return nil
+	}
+
+	const query = `
+	INSERT INTO webhook_outbox (expression_id, status, next_attempt_at)
+	VALUES (?, ?, ?)
+	ON CONFLICT DO NOTHING
+	`
+	if _, err := tx.ExecContext(ctx, query, exprID, entities.WebhookPending, time.Now().UTC()); err != nil {
+		return fmt.Errorf("failed to enqueue webhook: %w", err)
+	}
+	return nil
+}
+
+// Вебхуки, которые пора доставить, не больше limit
+func (d *Database) GetDueWebhooks(ctx context.Context, now time.Time, limit int) ([]entities.Webhook, error) {
+	const query = `
+	SELECT w.id, w.expression_id, e.callback_url, e.callback_secret, w.attempts, e.expression, e.status,
+		e.result, e.exact_result, e.error_code, e.error_message
+	FROM webhook_outbox w
+	JOIN expressions e ON e.id = w.expression_id
+	WHERE w.status = ? AND w.next_attempt_at <= ?
+	ORDER BY w.next_attempt_at
+	LIMIT ?
+	`
+	rows, err := d.db.QueryContext(ctx, query, entities.WebhookPending, now.UTC(), limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query webhooks: %w", err)
+	}
+	defer rows.Close()
+
+	var webhooks []entities.Webhook
+	for rows.Next() {
+		var webhook entities.Webhook
+		var result sql.NullFloat64
+		var exactResult sql.NullString
+		if err := rows.Scan(&webhook.ID, &webhook.ExpressionID, &webhook.URL, &webhook.Secret, &webhook.Attempts,
+			&webhook.Expression, &webhook.Status, &result, &exactResult, &webhook.ErrorCode, &webhook.ErrorMessage); err != nil {
+			return nil, fmt.Errorf("failed to scan webhook: %w", err)
+		}
+		if result.Valid {
+			webhook.Result = &result.Float64
+		}
+		if exactResult.Valid {
+			webhook.ExactResult = &exactResult.String
+		}
+		webhooks = append(webhooks, webhook)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows error: %w", err)
+	}
+
+	return webhooks, nil
+}
+
+// Завершает доставку вебхука: status - entities.WebhookDelivered или entities.WebhookFailed
+func (d *Database) FinishWebhook(ctx context.Context, id int, status string, attempts int, errMsg string) error {
+	const query = `UPDATE webhook_outbox SET status = ?, attempts = ?, last_error = NULLIF(?, '') WHERE id = ?`
+	if _, err := d.db.ExecContext(ctx, query, status, attempts, errMsg, id); err != nil {
+		return fmt.Errorf("failed to finish webhook: %w", err)
+	}
+	return nil
+}
+
+// Откладывает доставку вебхука после неудачной попытки
+func (d *Database) RetryWebhook(ctx context.Context, id int, attempts int, next time.Time, errMsg string) error {
+	const query = `UPDATE webhook_outbox SET attempts = ?, next_attempt_at = ?, last_error = ? WHERE id = ?`
+	if _, err := d.db.ExecContext(ctx, query, attempts, next.UTC(), errMsg, id); err != nil {
+		return fmt.Errorf("failed to reschedule webhook: %w", err)
+	}
+	return nil
+}
+
+// IDEMPOTENCY
+
+// Занимает ключ за запросом. Возвращает nil, если ключ свободен и теперь занят этим запросом,
+// иначе - сохраненную запись. Записи старше expiredBefore и брошенные незавершенные (старше staleBefore) не учитываются
+func (d *Database) ReserveIdempotencyKey(ctx context.Context, userID int, key, requestHash string, expiredBefore, staleBefore time.Time) (*entities.IdempotencyKey, error) {
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	const purge = `
+	DELETE FROM idempotency_keys
+	WHERE created_at < ?
+	OR (user_id = ? AND key = ? AND status_code IS NULL AND created_at < ?)
+	`
+	if _, err := tx.ExecContext(ctx, purge, expiredBefore.UTC(), userID, key, staleBefore.UTC()); err != nil {
+		return nil, fmt.Errorf("failed to purge idempotency keys: %w", err)
+	}
+
+	const insert = `
+	INSERT INTO idempotency_keys (user_id, key, request_hash, created_at)
+	VALUES (?, ?, ?, ?)
+	ON CONFLICT DO NOTHING
+	`
+	result, err := tx.ExecContext(ctx, insert, userID, key, requestHash, time.Now().UTC())
+	if err != nil {
+		return nil, fmt.Errorf("failed to reserve idempotency key: %w", err)
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get affected rows: %w", err)
+	}
+	if affected == 1 {
+		return nil, tx.Commit()
+	}
+
+	const query = `SELECT request_hash, status_code, response, created_at FROM idempotency_keys WHERE user_id = ? AND key = ?`
+	var record entities.IdempotencyKey
+	var statusCode sql.NullInt64
+	if err := tx.QueryRowContext(ctx, query, userID, key).Scan(&record.RequestHash, &statusCode, &record.Response, &record.CreatedAt); err != nil {
+		return nil, fmt.Errorf("failed to get idempotency key: %w", err)
+	}
+	record.StatusCode = int(statusCode.Int64)
+
+	return &record, tx.Commit()
+}
+
+// Сохраняет ответ на запрос, занявший ключ
+func (d *Database) SaveIdempotencyResponse(ctx context.Context, userID int, key string, statusCode int, response []byte) error {
+	const query = `UPDATE idempotency_keys SET status_code = ?, response = ? WHERE user_id = ? AND key = ?`
+	if _, err := d.db.ExecContext(ctx, query, statusCode, response, userID, key); err != nil {
+		return fmt.Errorf("failed to save idempotency response: %w", err)
+	}
+	return nil
+}
+
+// Освобождает ключ: запрос не удался, и его можно повторить с тем же ключом
+func (d *Database) DeleteIdempotencyKey(ctx context.Context, userID int, key string) error {
+	const query = `DELETE FROM idempotency_keys WHERE user_id = ? AND key = ?`
+	if _, err := d.db.ExecContext(ctx, query, userID, key); err != nil {
+		return fmt.Errorf("failed to delete idempotency key: %w", err)
+	}
 	return nil
 }
@@ -9,38 +9,165 @@ type User struct {
 }
 
 type Task struct {
-	ID          string `json:"id"`
-	Arg1        string `json:"arg1"`
-	Arg2        string `json:"arg2"`
-	Operation   string `json:"operation"`
-	Status      string `json:"status"` // 1.accepted | 2.in progress | 3.completed/error
-	Result      any    `json:"result"`
-	LastUpdated time.Time
+	ID            string     `json:"id"`
+	Args          []string   `json:"args"` // аргументы, пустая строка - результат зависимой таски еще не готов
+	Operation     string     `json:"operation"`
+	Status        string     `json:"status"` // 0.waiting | 1.accepted | 2.in progress | 3.completed/error
+	Result        any        `json:"result"`
+	Parent        int        `json:"-"` // индекс таски, которая ждет результат этой (-1 для последней таски)
+	ParentArg     int        `json:"-"` // позиция результата в аргументах родительской таски
+	Pending       int        `json:"-"` // сколько аргументов еще ждем
+	Precision     *Precision `json:"-"` // точность выражения, nil - вычисления во float64
+	AgentID       string     `json:"-"` // агент, который считает таску, пусто - незарегистрированный агент
+	LeaseDeadline time.Time  `json:"-"` // до какого момента таска закреплена за агентом
+	Attempts      int        `json:"-"` // сколько раз таску выдавали агентам
+	LastUpdated   time.Time
+}
+
+// Точный режим вычислений: десятичные числа с заданным количеством знаков после запятой
+type Precision struct {
+	Scale    int    `json:"scale"`
+	Rounding string `json:"rounding"`
 }
 
 type Expression struct {
-	ID         int    `json:"id"`
-	Expression string `json:"expression"`
-	Status     string `json:"status"` // 1.accepted | 2.in progress | 3.completed/error
-	Result     any    `json:"result"`
-	RPN        []string
-	Stack      []string
+	ID         int                `json:"id"`
+	Expression string             `json:"expression"`
+	UserID     int                `json:"user_id"`
+	Priority   int                `json:"priority"` // порядок тасок среди выражений одного пользователя, больше - раньше
+	Status     string             `json:"status"`   // 1.accepted | 2.in progress | 3.completed/error
+	Result     any                `json:"result"`
+	Precision  *Precision         `json:"precision"`
+	Variables  map[string]float64 `json:"variables"` // значения переменных, подставляются при разборе
 	Tasks      []*Task
 }
 
+// Новое выражение для записи в бд
+type NewExpression struct {
+	Expression string
+	Precision  *Precision // nil - обычные вычисления во float64
+	Variables  map[string]float64
+	Priority   int
+	Callback   *Callback // nil - без вебхука
+}
+
 type ExpressionDB struct {
-	ID         int    `json:"id"`
-	Expression string `json:"expression"`
-	UserID     int    `json:"user_id"`
-	Status     string `json:"status"`
-	Result     any    `json:"result"`
-	CreatedAt  string `json:"created_at"`
+	ID           int                `json:"id"`
+	Expression   string             `json:"expression"`
+	UserID       int                `json:"user_id"`
+	Status       string             `json:"status"`
+	Result       *float64           `json:"result"` // nil - выражение не досчитано
+	Precision    *Precision         `json:"precision"`
+	Variables    map[string]float64 `json:"variables"`
+	ExactResult  *string            `json:"exact_result"` // результат точного режима без потери знаков
+	ErrorCode    *string            `json:"error_code"`   // для CompletedWithError, см. ErrorCode*
+	ErrorMessage *string            `json:"error_message"`
+	Priority     int                `json:"priority"`
+	TaskCount    int                `json:"task_count"`
+	ComputeMs    int64              `json:"compute_ms"` // сколько агенты считали таски, от выдачи до результата
+	CreatedAt    string             `json:"created_at"`
+	StartedAt    *time.Time         `json:"started_at"`  // первая таска выдана агенту
+	FinishedAt   *time.Time         `json:"finished_at"` // досчитано, завершено с ошибкой или отменено
+}
+
+// Попытка вычисления таски агентом
+type TaskAttempt struct {
+	TaskID       string     `json:"task_id"`
+	ExpressionID int        `json:"expression_id"`
+	Attempt      int        `json:"attempt"`
+	AgentID      string     `json:"agent_id"` // пусто - незарегистрированный агент
+	Operation    string     `json:"operation"`
+	StartedAt    time.Time  `json:"started_at"`
+	FinishedAt   *time.Time `json:"finished_at"` // nil - попытка еще идет
+	Outcome      *string    `json:"outcome"`
+	Error        *string    `json:"error"`
+}
+
+// Куда сообщить о завершении выражения. Тело запроса подписывается HMAC-SHA256 с ключом Secret
+type Callback struct {
+	URL    string
+	Secret string
+}
+
+// Доставка вебхука о завершении выражения (строка outbox вместе с данными выражения)
+type Webhook struct {
+	ID           int
+	ExpressionID int
+	URL          string
+	Secret       string
+	Attempts     int // неудачных попыток доставки
+	Expression   string
+	Status       string
+	Result       *float64
+	ExactResult  *string
+	ErrorCode    *string
+	ErrorMessage *string
+}
+
+// Сохраненный ответ на запрос с Idempotency-Key
+type IdempotencyKey struct {
+	RequestHash string // sha256 тела запроса
+	StatusCode  int    // 0 - запрос еще обрабатывается
+	Response    []byte
+	CreatedAt   time.Time
+}
+
+// Выборка выражений пользователя для постраничного списка
+type ExpressionFilter struct {
+	Statuses    []string   // пусто - любые
+	CreatedFrom *time.Time // включительно
+	CreatedTo   *time.Time // не включительно
+	Search      string     // подстрока выражения
+	Sort        string     // ExpressionSortCreatedAt или ExpressionSortPriority
+	Desc        bool
+	Limit       int
+	After       *ExpressionCursor // nil - первая страница
 }
 
+// Последнее выражение предыдущей страницы: значение колонки сортировки и id при равных значениях
+type ExpressionCursor struct {
+	CreatedAt time.Time
+	Priority  int
+	ID        int
+}
+
+// сортировки списка выражений
+var (
+	ExpressionSortCreatedAt = "created_at"
+	ExpressionSortPriority  = "priority"
+)
+
+// коды ошибок выражений
+var (
+	ErrorCodeInvalidExpression = "invalid_expression" // выражение не удалось разобрать
+	ErrorCodeComputation       = "computation_error"  // агент вернул ошибку, например деление на ноль
+	ErrorCodeAttemptsExhausted = "attempts_exhausted" // таску так и не удалось посчитать за MAX_TASK_ATTEMPTS попыток
+	ErrorCodeUnknown           = "unknown"            // ошибка из старой бд, где она хранилась в result
+)
+
+// статусы доставки вебхуков
+var (
+	WebhookPending   = "pending"
+	WebhookDelivered = "delivered"
+	WebhookFailed    = "failed" // попытки кончились
+)
+
+// исходы попыток
+var (
+	AttemptCompleted    = "completed"
+	AttemptFailed       = "failed"        // агент вернул ошибку вычисления
+	AttemptLeaseExpired = "lease expired" // агент не успел и не продлил аренду
+	AttemptAgentDead    = "agent dead"    // агент перестал слать heartbeat
+	AttemptRestarted    = "restarted"     // оркестратор перезапустился
+	AttemptAbandoned    = "abandoned"     // выражение завершилось или отменено раньше
+)
+
 // statuses
 var (
+	Waiting            = "waiting"              // 0, только для тасок
 	Accepted           = "accepted"             // 1
 	InProgress         = "in progress"          // 2
 	Completed          = "completed"            // 3
 	CompletedWithError = "completed with error" // 3
+	Cancelled          = "cancelled"            // 3, отменено пользователем
 )
@@ -6,4 +6,7 @@ var (
 	ErrUserExists    = errors.New("user already exists")
 	ErrWrongLogin    = errors.New("invalid login")
 	ErrWrongPassword = errors.New("invalid password")
+	ErrUserQuota     = errors.New("too many pending expressions")
+	ErrServerQuota   = errors.New("server is overloaded")
+	ErrTaskNotLeased = errors.New("task is leased by another agent")
 )
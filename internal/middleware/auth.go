@@ -22,6 +22,10 @@ func AuthMiddleware(ctx context.Context, jwtManager auth.JWTManager, next http.H
 		}
 
 		authHeader := r.Header.Get("Authorization")
+		// EventSource и WebSocket в браузере не умеют слать заголовки - для потоков событий токен можно передать в ?token=
+		if authHeader == "" && isEventsStream(r) && r.URL.Query().Get("token") != "" {
+			authHeader = "Bearer " + r.URL.Query().Get("token")
+		}
 		if authHeader == "" {
 			http.Error(w, "empty Authorization header", http.StatusUnauthorized)
 			logger.Error("empty Authorization header")
@@ -51,3 +55,7 @@ func AuthMiddleware(ctx context.Context, jwtManager auth.JWTManager, next http.H
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
+
+func isEventsStream(r *http.Request) bool {
+	return r.Method == http.MethodGet && (strings.HasSuffix(r.URL.Path, "/events") || strings.HasSuffix(r.URL.Path, "/ws"))
+}
@@ -23,6 +23,7 @@ const (
 
 type GetTaskRequest struct {
 	state         protoimpl.MessageState `protogen:"open.v1"`
+	AgentId       string                 `protobuf:"bytes,1,opt,name=agent_id,json=agentId,proto3" json:"agent_id,omitempty"` // пусто - незарегистрированный агент
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
@@ -57,12 +58,25 @@ func (*GetTaskRequest) Descriptor() ([]byte, []int) {
 	return file_internal_proto_task_proto_rawDescGZIP(), []int{0}
 }
 
+func (x *GetTaskRequest) GetAgentId() string {
+	if x != nil {
+		return x.AgentId
+	}
+	return ""
+}
+
 type GetTaskResponse struct {
-	state         protoimpl.MessageState `protogen:"open.v1"`
-	Id            string                 `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
-	Arg1          string                 `protobuf:"bytes,2,opt,name=arg1,proto3" json:"arg1,omitempty"`
-	Arg2          string                 `protobuf:"bytes,3,opt,name=arg2,proto3" json:"arg2,omitempty"`
-	Operation     string                 `protobuf:"bytes,4,opt,name=operation,proto3" json:"operation,omitempty"`
+	state     protoimpl.MessageState `protogen:"open.v1"`
+	Id        string                 `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	Arg1      string                 `protobuf:"bytes,2,opt,name=arg1,proto3" json:"arg1,omitempty"`
+	Arg2      string                 `protobuf:"bytes,3,opt,name=arg2,proto3" json:"arg2,omitempty"`
+	Operation string                 `protobuf:"bytes,4,opt,name=operation,proto3" json:"operation,omitempty"`
+	// все аргументы таски (у функций их может быть сколько угодно), arg1 и arg2 - для старых агентов
+	Args []string `protobuf:"bytes,5,rep,name=args,proto3" json:"args,omitempty"`
+	// если задано - точное вычисление: аргументы и результат - десятичные строки
+	Precision *Precision `protobuf:"bytes,6,opt,name=precision,proto3" json:"precision,omitempty"`
+	// сколько действует аренда таски, после этого она вернется в очередь (0 - без аренды)
+	LeaseMs       int64 `protobuf:"varint,7,opt,name=lease_ms,json=leaseMs,proto3" json:"lease_ms,omitempty"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
@@ -125,18 +139,95 @@ func (x *GetTaskResponse) GetOperation() string {
 	return ""
 }
 
-type SubmitResultRequest struct {
+func (x *GetTaskResponse) GetArgs() []string {
+	if x != nil {
+		return x.Args
+	}
+	return nil
+}
+
+func (x *GetTaskResponse) GetPrecision() *Precision {
+	if x != nil {
+		return x.Precision
+	}
+	return nil
+}
+
+func (x *GetTaskResponse) GetLeaseMs() int64 {
+	if x != nil {
+		return x.LeaseMs
+	}
+	return 0
+}
+
+type Precision struct {
 	state         protoimpl.MessageState `protogen:"open.v1"`
-	Id            string                 `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
-	Result        float64                `protobuf:"fixed64,2,opt,name=result,proto3" json:"result,omitempty"`
-	Error         string                 `protobuf:"bytes,3,opt,name=error,proto3" json:"error,omitempty"`
+	Scale         int32                  `protobuf:"varint,1,opt,name=scale,proto3" json:"scale,omitempty"`      // знаков после запятой
+	Rounding      string                 `protobuf:"bytes,2,opt,name=rounding,proto3" json:"rounding,omitempty"` // режим округления (half_up, half_even, ...)
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Precision) Reset() {
+	*x = Precision{}
+	mi := &file_internal_proto_task_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Precision) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Precision) ProtoMessage() {}
+
+func (x *Precision) ProtoReflect() protoreflect.Message {
+	mi := &file_internal_proto_task_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Precision.ProtoReflect.Descriptor instead.
+func (*Precision) Descriptor() ([]byte, []int) {
+	return file_internal_proto_task_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *Precision) GetScale() int32 {
+	if x != nil {
+		return x.Scale
+	}
+	return 0
+}
+
+func (x *Precision) GetRounding() string {
+	if x != nil {
+		return x.Rounding
+	}
+	return ""
+}
+
+type SubmitResultRequest struct {
+	state  protoimpl.MessageState `protogen:"open.v1"`
+	Id     string                 `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	Result float64                `protobuf:"fixed64,2,opt,name=result,proto3" json:"result,omitempty"`
+	Error  string                 `protobuf:"bytes,3,opt,name=error,proto3" json:"error,omitempty"`
+	// результат точного вычисления, десятичная строка
+	ExactResult string `protobuf:"bytes,4,opt,name=exact_result,json=exactResult,proto3" json:"exact_result,omitempty"`
+	// агент, которому выдана таска (id из RegisterAgent), пусто - незарегистрированный агент
+	AgentId       string `protobuf:"bytes,5,opt,name=agent_id,json=agentId,proto3" json:"agent_id,omitempty"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
 
 func (x *SubmitResultRequest) Reset() {
 	*x = SubmitResultRequest{}
-	mi := &file_internal_proto_task_proto_msgTypes[2]
+	mi := &file_internal_proto_task_proto_msgTypes[3]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
@@ -148,7 +239,7 @@ func (x *SubmitResultRequest) String() string {
 func (*SubmitResultRequest) ProtoMessage() {}
 
 func (x *SubmitResultRequest) ProtoReflect() protoreflect.Message {
-	mi := &file_internal_proto_task_proto_msgTypes[2]
+	mi := &file_internal_proto_task_proto_msgTypes[3]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -161,7 +252,7 @@ func (x *SubmitResultRequest) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use SubmitResultRequest.ProtoReflect.Descriptor instead.
 func (*SubmitResultRequest) Descriptor() ([]byte, []int) {
-	return file_internal_proto_task_proto_rawDescGZIP(), []int{2}
+	return file_internal_proto_task_proto_rawDescGZIP(), []int{3}
 }
 
 func (x *SubmitResultRequest) GetId() string {
@@ -185,6 +276,20 @@ func (x *SubmitResultRequest) GetError() string {
 	return ""
 }
 
+func (x *SubmitResultRequest) GetExactResult() string {
+	if x != nil {
+		return x.ExactResult
+	}
+	return ""
+}
+
+func (x *SubmitResultRequest) GetAgentId() string {
+	if x != nil {
+		return x.AgentId
+	}
+	return ""
+}
+
 type SubmitResultResponse struct {
 	state         protoimpl.MessageState `protogen:"open.v1"`
 	unknownFields protoimpl.UnknownFields
@@ -193,7 +298,7 @@ type SubmitResultResponse struct {
 
 func (x *SubmitResultResponse) Reset() {
 	*x = SubmitResultResponse{}
-	mi := &file_internal_proto_task_proto_msgTypes[3]
+	mi := &file_internal_proto_task_proto_msgTypes[4]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
@@ -205,7 +310,7 @@ func (x *SubmitResultResponse) String() string {
 func (*SubmitResultResponse) ProtoMessage() {}
 
 func (x *SubmitResultResponse) ProtoReflect() protoreflect.Message {
-	mi := &file_internal_proto_task_proto_msgTypes[3]
+	mi := &file_internal_proto_task_proto_msgTypes[4]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -218,28 +323,557 @@ func (x *SubmitResultResponse) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use SubmitResultResponse.ProtoReflect.Descriptor instead.
 func (*SubmitResultResponse) Descriptor() ([]byte, []int) {
-	return file_internal_proto_task_proto_rawDescGZIP(), []int{3}
+	return file_internal_proto_task_proto_rawDescGZIP(), []int{4}
+}
+
+type AgentMessage struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Types that are valid to be assigned to Payload:
+	//
+	//	*AgentMessage_Ready
+	//	*AgentMessage_Result
+	Payload       isAgentMessage_Payload `protobuf_oneof:"payload"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *AgentMessage) Reset() {
+	*x = AgentMessage{}
+	mi := &file_internal_proto_task_proto_msgTypes[5]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *AgentMessage) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*AgentMessage) ProtoMessage() {}
+
+func (x *AgentMessage) ProtoReflect() protoreflect.Message {
+	mi := &file_internal_proto_task_proto_msgTypes[5]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use AgentMessage.ProtoReflect.Descriptor instead.
+func (*AgentMessage) Descriptor() ([]byte, []int) {
+	return file_internal_proto_task_proto_rawDescGZIP(), []int{5}
+}
+
+func (x *AgentMessage) GetPayload() isAgentMessage_Payload {
+	if x != nil {
+		return x.Payload
+	}
+	return nil
+}
+
+func (x *AgentMessage) GetReady() *Ready {
+	if x != nil {
+		if x, ok := x.Payload.(*AgentMessage_Ready); ok {
+			return x.Ready
+		}
+	}
+	return nil
+}
+
+func (x *AgentMessage) GetResult() *SubmitResultRequest {
+	if x != nil {
+		if x, ok := x.Payload.(*AgentMessage_Result); ok {
+			return x.Result
+		}
+	}
+	return nil
+}
+
+type isAgentMessage_Payload interface {
+	isAgentMessage_Payload()
+}
+
+type AgentMessage_Ready struct {
+	Ready *Ready `protobuf:"bytes,1,opt,name=ready,proto3,oneof"`
+}
+
+type AgentMessage_Result struct {
+	Result *SubmitResultRequest `protobuf:"bytes,2,opt,name=result,proto3,oneof"`
+}
+
+func (*AgentMessage_Ready) isAgentMessage_Payload() {}
+
+func (*AgentMessage_Result) isAgentMessage_Payload() {}
+
+// Агент готов принять еще slots тасок
+type Ready struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Slots         int32                  `protobuf:"varint,1,opt,name=slots,proto3" json:"slots,omitempty"`
+	AgentId       string                 `protobuf:"bytes,2,opt,name=agent_id,json=agentId,proto3" json:"agent_id,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Ready) Reset() {
+	*x = Ready{}
+	mi := &file_internal_proto_task_proto_msgTypes[6]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Ready) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Ready) ProtoMessage() {}
+
+func (x *Ready) ProtoReflect() protoreflect.Message {
+	mi := &file_internal_proto_task_proto_msgTypes[6]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Ready.ProtoReflect.Descriptor instead.
+func (*Ready) Descriptor() ([]byte, []int) {
+	return file_internal_proto_task_proto_rawDescGZIP(), []int{6}
+}
+
+func (x *Ready) GetSlots() int32 {
+	if x != nil {
+		return x.Slots
+	}
+	return 0
+}
+
+func (x *Ready) GetAgentId() string {
+	if x != nil {
+		return x.AgentId
+	}
+	return ""
+}
+
+type ServerMessage struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Types that are valid to be assigned to Payload:
+	//
+	//	*ServerMessage_Task
+	Payload       isServerMessage_Payload `protobuf_oneof:"payload"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ServerMessage) Reset() {
+	*x = ServerMessage{}
+	mi := &file_internal_proto_task_proto_msgTypes[7]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ServerMessage) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ServerMessage) ProtoMessage() {}
+
+func (x *ServerMessage) ProtoReflect() protoreflect.Message {
+	mi := &file_internal_proto_task_proto_msgTypes[7]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ServerMessage.ProtoReflect.Descriptor instead.
+func (*ServerMessage) Descriptor() ([]byte, []int) {
+	return file_internal_proto_task_proto_rawDescGZIP(), []int{7}
+}
+
+func (x *ServerMessage) GetPayload() isServerMessage_Payload {
+	if x != nil {
+		return x.Payload
+	}
+	return nil
+}
+
+func (x *ServerMessage) GetTask() *GetTaskResponse {
+	if x != nil {
+		if x, ok := x.Payload.(*ServerMessage_Task); ok {
+			return x.Task
+		}
+	}
+	return nil
+}
+
+type isServerMessage_Payload interface {
+	isServerMessage_Payload()
+}
+
+type ServerMessage_Task struct {
+	Task *GetTaskResponse `protobuf:"bytes,1,opt,name=task,proto3,oneof"`
+}
+
+func (*ServerMessage_Task) isServerMessage_Payload() {}
+
+type RegisterAgentRequest struct {
+	state          protoimpl.MessageState `protogen:"open.v1"`
+	Hostname       string                 `protobuf:"bytes,2,opt,name=hostname,proto3" json:"hostname,omitempty"`
+	Version        string                 `protobuf:"bytes,3,opt,name=version,proto3" json:"version,omitempty"`
+	ComputingPower int32                  `protobuf:"varint,4,opt,name=computing_power,json=computingPower,proto3" json:"computing_power,omitempty"`
+	unknownFields  protoimpl.UnknownFields
+	sizeCache      protoimpl.SizeCache
+}
+
+func (x *RegisterAgentRequest) Reset() {
+	*x = RegisterAgentRequest{}
+	mi := &file_internal_proto_task_proto_msgTypes[8]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *RegisterAgentRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*RegisterAgentRequest) ProtoMessage() {}
+
+func (x *RegisterAgentRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_internal_proto_task_proto_msgTypes[8]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use RegisterAgentRequest.ProtoReflect.Descriptor instead.
+func (*RegisterAgentRequest) Descriptor() ([]byte, []int) {
+	return file_internal_proto_task_proto_rawDescGZIP(), []int{8}
+}
+
+func (x *RegisterAgentRequest) GetHostname() string {
+	if x != nil {
+		return x.Hostname
+	}
+	return ""
+}
+
+func (x *RegisterAgentRequest) GetVersion() string {
+	if x != nil {
+		return x.Version
+	}
+	return ""
+}
+
+func (x *RegisterAgentRequest) GetComputingPower() int32 {
+	if x != nil {
+		return x.ComputingPower
+	}
+	return 0
+}
+
+type RegisterAgentResponse struct {
+	state               protoimpl.MessageState `protogen:"open.v1"`
+	AgentId             string                 `protobuf:"bytes,1,opt,name=agent_id,json=agentId,proto3" json:"agent_id,omitempty"`                                        // новый id агента, с ним агент получает, продлевает и сдает таски
+	HeartbeatIntervalMs int64                  `protobuf:"varint,2,opt,name=heartbeat_interval_ms,json=heartbeatIntervalMs,proto3" json:"heartbeat_interval_ms,omitempty"` // как часто слать Heartbeat
+	unknownFields       protoimpl.UnknownFields
+	sizeCache           protoimpl.SizeCache
+}
+
+func (x *RegisterAgentResponse) Reset() {
+	*x = RegisterAgentResponse{}
+	mi := &file_internal_proto_task_proto_msgTypes[9]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *RegisterAgentResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*RegisterAgentResponse) ProtoMessage() {}
+
+func (x *RegisterAgentResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_internal_proto_task_proto_msgTypes[9]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use RegisterAgentResponse.ProtoReflect.Descriptor instead.
+func (*RegisterAgentResponse) Descriptor() ([]byte, []int) {
+	return file_internal_proto_task_proto_rawDescGZIP(), []int{9}
+}
+
+func (x *RegisterAgentResponse) GetAgentId() string {
+	if x != nil {
+		return x.AgentId
+	}
+	return ""
+}
+
+func (x *RegisterAgentResponse) GetHeartbeatIntervalMs() int64 {
+	if x != nil {
+		return x.HeartbeatIntervalMs
+	}
+	return 0
+}
+
+type HeartbeatRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	AgentId       string                 `protobuf:"bytes,1,opt,name=agent_id,json=agentId,proto3" json:"agent_id,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *HeartbeatRequest) Reset() {
+	*x = HeartbeatRequest{}
+	mi := &file_internal_proto_task_proto_msgTypes[10]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *HeartbeatRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*HeartbeatRequest) ProtoMessage() {}
+
+func (x *HeartbeatRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_internal_proto_task_proto_msgTypes[10]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use HeartbeatRequest.ProtoReflect.Descriptor instead.
+func (*HeartbeatRequest) Descriptor() ([]byte, []int) {
+	return file_internal_proto_task_proto_rawDescGZIP(), []int{10}
+}
+
+func (x *HeartbeatRequest) GetAgentId() string {
+	if x != nil {
+		return x.AgentId
+	}
+	return ""
+}
+
+type HeartbeatResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *HeartbeatResponse) Reset() {
+	*x = HeartbeatResponse{}
+	mi := &file_internal_proto_task_proto_msgTypes[11]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *HeartbeatResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*HeartbeatResponse) ProtoMessage() {}
+
+func (x *HeartbeatResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_internal_proto_task_proto_msgTypes[11]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use HeartbeatResponse.ProtoReflect.Descriptor instead.
+func (*HeartbeatResponse) Descriptor() ([]byte, []int) {
+	return file_internal_proto_task_proto_rawDescGZIP(), []int{11}
+}
+
+type RenewLeaseRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	TaskId        string                 `protobuf:"bytes,1,opt,name=task_id,json=taskId,proto3" json:"task_id,omitempty"`
+	AgentId       string                 `protobuf:"bytes,2,opt,name=agent_id,json=agentId,proto3" json:"agent_id,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *RenewLeaseRequest) Reset() {
+	*x = RenewLeaseRequest{}
+	mi := &file_internal_proto_task_proto_msgTypes[12]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *RenewLeaseRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*RenewLeaseRequest) ProtoMessage() {}
+
+func (x *RenewLeaseRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_internal_proto_task_proto_msgTypes[12]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use RenewLeaseRequest.ProtoReflect.Descriptor instead.
+func (*RenewLeaseRequest) Descriptor() ([]byte, []int) {
+	return file_internal_proto_task_proto_rawDescGZIP(), []int{12}
+}
+
+func (x *RenewLeaseRequest) GetTaskId() string {
+	if x != nil {
+		return x.TaskId
+	}
+	return ""
+}
+
+func (x *RenewLeaseRequest) GetAgentId() string {
+	if x != nil {
+		return x.AgentId
+	}
+	return ""
+}
+
+type RenewLeaseResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	LeaseMs       int64                  `protobuf:"varint,1,opt,name=lease_ms,json=leaseMs,proto3" json:"lease_ms,omitempty"` // новый срок аренды от текущего момента
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *RenewLeaseResponse) Reset() {
+	*x = RenewLeaseResponse{}
+	mi := &file_internal_proto_task_proto_msgTypes[13]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *RenewLeaseResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*RenewLeaseResponse) ProtoMessage() {}
+
+func (x *RenewLeaseResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_internal_proto_task_proto_msgTypes[13]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use RenewLeaseResponse.ProtoReflect.Descriptor instead.
+func (*RenewLeaseResponse) Descriptor() ([]byte, []int) {
+	return file_internal_proto_task_proto_rawDescGZIP(), []int{13}
+}
+
+func (x *RenewLeaseResponse) GetLeaseMs() int64 {
+	if x != nil {
+		return x.LeaseMs
+	}
+	return 0
 }
 
 var File_internal_proto_task_proto protoreflect.FileDescriptor
 
 const file_internal_proto_task_proto_rawDesc = "" +
 	"\n" +
-	"\x19internal/proto/task.proto\x12\x05proto\"\x10\n" +
-	"\x0eGetTaskRequest\"g\n" +
+	"\x19internal/proto/task.proto\x12\x05proto\"+\n" +
+	"\x0eGetTaskRequest\x12\x19\n" +
+	"\bagent_id\x18\x01 \x01(\tR\aagentId\"\xc6\x01\n" +
 	"\x0fGetTaskResponse\x12\x0e\n" +
 	"\x02id\x18\x01 \x01(\tR\x02id\x12\x12\n" +
 	"\x04arg1\x18\x02 \x01(\tR\x04arg1\x12\x12\n" +
 	"\x04arg2\x18\x03 \x01(\tR\x04arg2\x12\x1c\n" +
-	"\toperation\x18\x04 \x01(\tR\toperation\"S\n" +
+	"\toperation\x18\x04 \x01(\tR\toperation\x12\x12\n" +
+	"\x04args\x18\x05 \x03(\tR\x04args\x12.\n" +
+	"\tprecision\x18\x06 \x01(\v2\x10.proto.PrecisionR\tprecision\x12\x19\n" +
+	"\blease_ms\x18\a \x01(\x03R\aleaseMs\"=\n" +
+	"\tPrecision\x12\x14\n" +
+	"\x05scale\x18\x01 \x01(\x05R\x05scale\x12\x1a\n" +
+	"\brounding\x18\x02 \x01(\tR\brounding\"\x91\x01\n" +
 	"\x13SubmitResultRequest\x12\x0e\n" +
 	"\x02id\x18\x01 \x01(\tR\x02id\x12\x16\n" +
 	"\x06result\x18\x02 \x01(\x01R\x06result\x12\x14\n" +
-	"\x05error\x18\x03 \x01(\tR\x05error\"\x16\n" +
-	"\x14SubmitResultResponse2\x94\x01\n" +
+	"\x05error\x18\x03 \x01(\tR\x05error\x12!\n" +
+	"\fexact_result\x18\x04 \x01(\tR\vexactResult\x12\x19\n" +
+	"\bagent_id\x18\x05 \x01(\tR\aagentId\"\x16\n" +
+	"\x14SubmitResultResponse\"u\n" +
+	"\fAgentMessage\x12$\n" +
+	"\x05ready\x18\x01 \x01(\v2\f.proto.ReadyH\x00R\x05ready\x124\n" +
+	"\x06result\x18\x02 \x01(\v2\x1a.proto.SubmitResultRequestH\x00R\x06resultB\t\n" +
+	"\apayload\"8\n" +
+	"\x05Ready\x12\x14\n" +
+	"\x05slots\x18\x01 \x01(\x05R\x05slots\x12\x19\n" +
+	"\bagent_id\x18\x02 \x01(\tR\aagentId\"H\n" +
+	"\rServerMessage\x12,\n" +
+	"\x04task\x18\x01 \x01(\v2\x16.proto.GetTaskResponseH\x00R\x04taskB\t\n" +
+	"\apayload\"{\n" +
+	"\x14RegisterAgentRequest\x12\x1a\n" +
+	"\bhostname\x18\x02 \x01(\tR\bhostname\x12\x18\n" +
+	"\aversion\x18\x03 \x01(\tR\aversion\x12'\n" +
+	"\x0fcomputing_power\x18\x04 \x01(\x05R\x0ecomputingPowerJ\x04\b\x01\x10\x02\"f\n" +
+	"\x15RegisterAgentResponse\x12\x19\n" +
+	"\bagent_id\x18\x01 \x01(\tR\aagentId\x122\n" +
+	"\x15heartbeat_interval_ms\x18\x02 \x01(\x03R\x13heartbeatIntervalMs\"3\n" +
+	"\x10HeartbeatRequest\x12\x19\n" +
+	"\bagent_id\x18\x01 \x01(\tR\aagentIdJ\x04\b\x02\x10\x03\"\x13\n" +
+	"\x11HeartbeatResponse\"G\n" +
+	"\x11RenewLeaseRequest\x12\x17\n" +
+	"\atask_id\x18\x01 \x01(\tR\x06taskId\x12\x19\n" +
+	"\bagent_id\x18\x02 \x01(\tR\aagentId\"/\n" +
+	"\x12RenewLeaseResponse\x12\x19\n" +
+	"\blease_ms\x18\x01 \x01(\x03R\aleaseMs2\xa8\x03\n" +
 	"\vTaskService\x12:\n" +
 	"\aGetTask\x12\x15.proto.GetTaskRequest\x1a\x16.proto.GetTaskResponse\"\x00\x12I\n" +
-	"\fSubmitResult\x12\x1a.proto.SubmitResultRequest\x1a\x1b.proto.SubmitResultResponse\"\x00B4Z2github.com/YattaDeSune/calc-project/internal/protob\x06proto3"
+	"\fSubmitResult\x12\x1a.proto.SubmitResultRequest\x1a\x1b.proto.SubmitResultResponse\"\x00\x12=\n" +
+	"\n" +
+	"TaskStream\x12\x13.proto.AgentMessage\x1a\x14.proto.ServerMessage\"\x00(\x010\x01\x12L\n" +
+	"\rRegisterAgent\x12\x1b.proto.RegisterAgentRequest\x1a\x1c.proto.RegisterAgentResponse\"\x00\x12@\n" +
+	"\tHeartbeat\x12\x17.proto.HeartbeatRequest\x1a\x18.proto.HeartbeatResponse\"\x00\x12C\n" +
+	"\n" +
+	"RenewLease\x12\x18.proto.RenewLeaseRequest\x1a\x19.proto.RenewLeaseResponse\"\x00B4Z2github.com/YattaDeSune/calc-project/internal/protob\x06proto3"
 
 var (
 	file_internal_proto_task_proto_rawDescOnce sync.Once
@@ -253,23 +887,45 @@ func file_internal_proto_task_proto_rawDescGZIP() []byte {
 	return file_internal_proto_task_proto_rawDescData
 }
 
-var file_internal_proto_task_proto_msgTypes = make([]protoimpl.MessageInfo, 4)
+var file_internal_proto_task_proto_msgTypes = make([]protoimpl.MessageInfo, 14)
 var file_internal_proto_task_proto_goTypes = []any{
-	(*GetTaskRequest)(nil),       // 0: proto.GetTaskRequest
-	(*GetTaskResponse)(nil),      // 1: proto.GetTaskResponse
-	(*SubmitResultRequest)(nil),  // 2: proto.SubmitResultRequest
-	(*SubmitResultResponse)(nil), // 3: proto.SubmitResultResponse
+	(*GetTaskRequest)(nil),        // 0: proto.GetTaskRequest
+	(*GetTaskResponse)(nil),       // 1: proto.GetTaskResponse
+	(*Precision)(nil),             // 2: proto.Precision
+	(*SubmitResultRequest)(nil),   // 3: proto.SubmitResultRequest
+	(*SubmitResultResponse)(nil),  // 4: proto.SubmitResultResponse
+	(*AgentMessage)(nil),          // 5: proto.AgentMessage
+	(*Ready)(nil),                 // 6: proto.Ready
+	(*ServerMessage)(nil),         // 7: proto.ServerMessage
+	(*RegisterAgentRequest)(nil),  // 8: proto.RegisterAgentRequest
+	(*RegisterAgentResponse)(nil), // 9: proto.RegisterAgentResponse
+	(*HeartbeatRequest)(nil),      // 10: proto.HeartbeatRequest
+	(*HeartbeatResponse)(nil),     // 11: proto.HeartbeatResponse
+	(*RenewLeaseRequest)(nil),     // 12: proto.RenewLeaseRequest
+	(*RenewLeaseResponse)(nil),    // 13: proto.RenewLeaseResponse
 }
 var file_internal_proto_task_proto_depIdxs = []int32{
-	0, // 0: proto.TaskService.GetTask:input_type -> proto.GetTaskRequest
-	2, // 1: proto.TaskService.SubmitResult:input_type -> proto.SubmitResultRequest
-	1, // 2: proto.TaskService.GetTask:output_type -> proto.GetTaskResponse
-	3, // 3: proto.TaskService.SubmitResult:output_type -> proto.SubmitResultResponse
-	2, // [2:4] is the sub-list for method output_type
-	0, // [0:2] is the sub-list for method input_type
-	0, // [0:0] is the sub-list for extension type_name
-	0, // [0:0] is the sub-list for extension extendee
-	0, // [0:0] is the sub-list for field type_name
+	2,  // 0: proto.GetTaskResponse.precision:type_name -> proto.Precision
+	6,  // 1: proto.AgentMessage.ready:type_name -> proto.Ready
+	3,  // 2: proto.AgentMessage.result:type_name -> proto.SubmitResultRequest
+	1,  // 3: proto.ServerMessage.task:type_name -> proto.GetTaskResponse
+	0,  // 4: proto.TaskService.GetTask:input_type -> proto.GetTaskRequest
+	3,  // 5: proto.TaskService.SubmitResult:input_type -> proto.SubmitResultRequest
+	5,  // 6: proto.TaskService.TaskStream:input_type -> proto.AgentMessage
+	8,  // 7: proto.TaskService.RegisterAgent:input_type -> proto.RegisterAgentRequest
+	10, // 8: proto.TaskService.Heartbeat:input_type -> proto.HeartbeatRequest
+	12, // 9: proto.TaskService.RenewLease:input_type -> proto.RenewLeaseRequest
+	1,  // 10: proto.TaskService.GetTask:output_type -> proto.GetTaskResponse
+	4,  // 11: proto.TaskService.SubmitResult:output_type -> proto.SubmitResultResponse
+	7,  // 12: proto.TaskService.TaskStream:output_type -> proto.ServerMessage
+	9,  // 13: proto.TaskService.RegisterAgent:output_type -> proto.RegisterAgentResponse
+	11, // 14: proto.TaskService.Heartbeat:output_type -> proto.HeartbeatResponse
+	13, // 15: proto.TaskService.RenewLease:output_type -> proto.RenewLeaseResponse
+	10, // [10:16] is the sub-list for method output_type
+	4,  // [4:10] is the sub-list for method input_type
+	4,  // [4:4] is the sub-list for extension type_name
+	4,  // [4:4] is the sub-list for extension extendee
+	0,  // [0:4] is the sub-list for field type_name
 }
 
 func init() { file_internal_proto_task_proto_init() }
@@ -277,13 +933,20 @@ func file_internal_proto_task_proto_init() {
 	if File_internal_proto_task_proto != nil {
 		return
 	}
+	file_internal_proto_task_proto_msgTypes[5].OneofWrappers = []any{
+		(*AgentMessage_Ready)(nil),
+		(*AgentMessage_Result)(nil),
+	}
+	file_internal_proto_task_proto_msgTypes[7].OneofWrappers = []any{
+		(*ServerMessage_Task)(nil),
+	}
 	type x struct{}
 	out := protoimpl.TypeBuilder{
 		File: protoimpl.DescBuilder{
 			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
 			RawDescriptor: unsafe.Slice(unsafe.StringData(file_internal_proto_task_proto_rawDesc), len(file_internal_proto_task_proto_rawDesc)),
 			NumEnums:      0,
-			NumMessages:   4,
+			NumMessages:   14,
 			NumExtensions: 0,
 			NumServices:   1,
 		},
@@ -0,0 +1,126 @@
+package server
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/YattaDeSune/calc-project/internal/logger"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+// Агент, подключенный к оркестратору
+type Agent struct {
+	ID             string
+	Hostname       string
+	Version        string
+	ComputingPower int
+	LastSeen       time.Time
+}
+
+// Реестр агентов: кто жив и что считает
+type Agents struct {
+	mu     *sync.Mutex
+	agents map[string]*Agent
+	ctx    context.Context
+}
+
+func NewAgents(ctx context.Context) *Agents {
+	return &Agents{
+		mu:     &sync.Mutex{},
+		agents: make(map[string]*Agent),
+		ctx:    ctx,
+	}
+}
+
+// Регистрирует агента под новым id. Id выдаем сами, чтобы агент не мог назваться чужим
+// и продлевать или сдавать его таски
+func (a *Agents) Register(agent Agent) string {
+	logger := logger.FromContext(a.ctx)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	agent.ID = uuid.New().String()
+	agent.LastSeen = time.Now()
+	a.agents[agent.ID] = &agent
+
+	logger.Info("Agent registered",
+		zap.String("agent id", agent.ID),
+		zap.String("hostname", agent.Hostname),
+		zap.String("version", agent.Version),
+		zap.Int("computing power", agent.ComputingPower),
+	)
+	return agent.ID
+}
+
+// Отмечает, что агент жив. false - агент не зарегистрирован (или уже признан мертвым)
+func (a *Agents) Heartbeat(id string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	agent, ok := a.agents[id]
+	if !ok {
+		return false
+	}
+	agent.LastSeen = time.Now()
+	return true
+}
+
+// Проверяет id агента, с которым пришел запрос: пустой - незарегистрированный (старый) агент
+func (a *Agents) Known(id string) bool {
+	if id == "" {
+		return true
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	_, ok := a.agents[id]
+	return ok
+}
+
+// Убирает из реестра агентов, от которых не было Heartbeat дольше timeout, и возвращает их
+func (a *Agents) Expired(timeout time.Duration) []Agent {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var expired []Agent
+	for id, agent := range a.agents {
+		if time.Since(agent.LastSeen) > timeout {
+			expired = append(expired, *agent)
+			delete(a.agents, id)
+		}
+	}
+	return expired
+}
+
+// Следит за агентами: таски умершего агента сразу возвращаются в очередь
+func (s *Server) StartAgentsWatcher() {
+	ctx := s.ctx
+	logger := logger.FromContext(ctx)
+
+	interval := time.Duration(s.cfg.HeartbeatIntervalMs) * time.Millisecond
+	timeout := time.Duration(s.cfg.AgentTimeoutMs) * time.Millisecond
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for _, agent := range s.agents.Expired(timeout) {
+				requeued := s.storage.RequeueAgentTasks(s.db, agent.ID)
+				logger.Warn("Agent is dead, tasks requeued",
+					zap.String("agent id", agent.ID),
+					zap.String("hostname", agent.Hostname),
+					zap.Time("last seen", agent.LastSeen),
+					zap.Int("tasks", requeued),
+				)
+			}
+		}
+	}
+}
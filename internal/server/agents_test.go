@@ -0,0 +1,30 @@
+package server
+
+import (
+	"context"
+	"testing"
+
+	"github.com/YattaDeSune/calc-project/internal/logger"
+	"go.uber.org/zap"
+)
+
+func TestAgents_Register(t *testing.T) {
+	agents := NewAgents(logger.WithLogger(context.Background(), zap.NewNop()))
+
+	// id выдает оркестратор, повторная регистрация получает новый
+	first := agents.Register(Agent{ID: "chosen", Hostname: "host"})
+	second := agents.Register(Agent{Hostname: "host"})
+	if first == "" || first == "chosen" || first == second {
+		t.Fatalf("expected distinct issued ids, got %q and %q", first, second)
+	}
+
+	if !agents.Known(first) || !agents.Known("") {
+		t.Error("expected registered and anonymous agents to be known")
+	}
+	if agents.Known("chosen") || agents.Heartbeat("chosen") {
+		t.Error("expected self-chosen id to be unknown")
+	}
+	if !agents.Heartbeat(second) {
+		t.Error("expected heartbeat of registered agent")
+	}
+}
@@ -0,0 +1,212 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/YattaDeSune/calc-project/internal/entities"
+	"github.com/YattaDeSune/calc-project/internal/logger"
+	"go.uber.org/zap"
+)
+
+type AddBatchRequest struct {
+	Expressions []AddExpressionRequest `json:"expressions"`
+}
+
+// Результат одного выражения пакета: id или ошибка с тем же кодом, что вернул бы /calculate
+type batchResult struct {
+	Index    int    `json:"index"`
+	Code     int    `json:"code"`
+	ID       int    `json:"id,omitempty"`
+	Priority int    `json:"priority,omitempty"`
+	Error    string `json:"error,omitempty"`
+	Details  any    `json:"details,omitempty"` // подробности ошибки разбора
+}
+
+type AddBatchResponce struct {
+	Results []batchResult `json:"results"`
+}
+
+// /calculate/batch POST
+func (s *Server) AddExpressionsBatch(w http.ResponseWriter, r *http.Request) {
+	ctx := s.ctx
+	logger := logger.FromContext(ctx)
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Failed to read expressions", http.StatusBadRequest) // 400
+		return
+	}
+	defer r.Body.Close()
+
+	var req AddBatchRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		http.Error(w, "Invalid JSON format", http.StatusUnprocessableEntity) // 422
+		return
+	}
+	if len(req.Expressions) == 0 {
+		http.Error(w, "Expressions cannot be empty", http.StatusUnprocessableEntity) // 422
+		return
+	}
+	if len(req.Expressions) > s.cfg.MaxBatchSize {
+		http.Error(w, "Too many expressions, max: "+strconv.Itoa(s.cfg.MaxBatchSize), http.StatusRequestEntityTooLarge) // 413
+		return
+	}
+
+	userID, ok := r.Context().Value(entities.UserIDKey).(int)
+	if !ok {
+		http.Error(w, "Failed to get user id", http.StatusInternalServerError)
+		return
+	}
+
+	maxPriority, err := s.maxPriority(userID)
+	if err != nil {
+		logger.Error("Failed to get user max priority", zap.Int("user id", userID), zap.Error(err))
+		http.Error(w, "Failed to create expressions", http.StatusInternalServerError) // 500
+		return
+	}
+
+	// проверяем каждое выражение отдельно, ошибки одних не мешают остальным
+	resp := AddBatchResponce{Results: make([]batchResult, len(req.Expressions))}
+	var accepted []int // индексы выражений, которые пойдут в бд
+	var prepared []*preparedExpression
+	var newExprs []entities.NewExpression
+	limited := false
+	for i, item := range req.Expressions {
+		resp.Results[i].Index = i
+
+		expr, reqErr := s.prepareExpression(item)
+		if reqErr != nil {
+			resp.Results[i].Code = reqErr.status
+			resp.Results[i].Error = reqErr.message
+			resp.Results[i].Details = reqErr.details
+			continue
+		}
+		if err := s.storage.Reserve(userID); err != nil {
+			resp.Results[i].Code = http.StatusTooManyRequests // 429
+			resp.Results[i].Error = err.Error()
+			limited = true
+			continue
+		}
+
+		priority := min(item.Priority, maxPriority)
+		resp.Results[i].Priority = priority
+		accepted = append(accepted, i)
+		prepared = append(prepared, expr)
+		newExprs = append(newExprs, entities.NewExpression{
+			Expression: item.Expression,
+			Precision:  item.Precision,
+			Variables:  item.Variables,
+			Priority:   priority,
+			Callback:   expr.callback,
+		})
+	}
+
+	if len(newExprs) > 0 {
+		ids, err := s.db.CreateExpressions(ctx, userID, entities.Accepted, newExprs)
+		if err != nil {
+			logger.Error("Failed to create expressions", zap.Int("user id", userID), zap.Error(err))
+			for range newExprs {
+				s.storage.Release(userID)
+			}
+			http.Error(w, "Failed to create expressions", http.StatusInternalServerError) // 500
+			return
+		}
+
+		for j, i := range accepted {
+			resp.Results[i].Code = http.StatusCreated // 201
+			resp.Results[i].ID = ids[j]
+			s.startExpression(ids[j], userID, resp.Results[i].Priority, prepared[j])
+		}
+	}
+	logger.Info("Add expressions batch", zap.Int("user id", userID), zap.Int("total", len(req.Expressions)), zap.Int("created", len(newExprs)))
+
+	if limited {
+		w.Header().Set("Retry-After", strconv.Itoa(s.cfg.RetryAfterS))
+	}
+	w.Header().Set("Content-type", "application/json")
+	w.WriteHeader(http.StatusOK) // 200
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		http.Error(w, "Failed to encode response (AddExpressionsBatch)", http.StatusInternalServerError) // 500
+		return
+	}
+}
+
+type QueryExpressionsRequest struct {
+	IDs []int `json:"ids"`
+}
+
+type QueryExpressionsResponce struct {
+	Expressions []localExpression `json:"expressions"` // в порядке запроса
+	NotFound    []int             `json:"not_found"`   // нет таких выражений у пользователя
+}
+
+// /expressions/query POST
+func (s *Server) QueryExpressions(w http.ResponseWriter, r *http.Request) {
+	ctx := s.ctx
+	logger := logger.FromContext(ctx)
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Failed to read request", http.StatusBadRequest) // 400
+		return
+	}
+	defer r.Body.Close()
+
+	var req QueryExpressionsRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		http.Error(w, "Invalid JSON format", http.StatusUnprocessableEntity) // 422
+		return
+	}
+	if len(req.IDs) > s.cfg.MaxBatchSize {
+		http.Error(w, "Too many ids, max: "+strconv.Itoa(s.cfg.MaxBatchSize), http.StatusRequestEntityTooLarge) // 413
+		return
+	}
+
+	userID, ok := r.Context().Value(entities.UserIDKey).(int)
+	if !ok {
+		http.Error(w, "Failed to get user id", http.StatusInternalServerError)
+		return
+	}
+
+	exprs, err := s.db.GetExpressionsByIDs(ctx, req.IDs, userID)
+	if err != nil {
+		logger.Error("Failed to query expressions", zap.Int("user id", userID), zap.Error(err))
+		http.Error(w, "Failed to query expressions", http.StatusInternalServerError) // 500
+		return
+	}
+	found := make(map[int]entities.ExpressionDB, len(exprs))
+	for _, expr := range exprs {
+		found[expr.ID] = expr
+	}
+
+	resp := QueryExpressionsResponce{
+		Expressions: []localExpression{},
+		NotFound:    []int{},
+	}
+	seen := make(map[int]bool, len(req.IDs))
+	for _, id := range req.IDs {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+
+		expr, ok := found[id]
+		if !ok {
+			resp.NotFound = append(resp.NotFound, id)
+			continue
+		}
+		resp.Expressions = append(resp.Expressions, newLocalExpression(&expr))
+	}
+
+	w.Header().Set("Content-type", "application/json")
+	w.WriteHeader(http.StatusOK) // 200
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		http.Error(w, "Failed to encode response (QueryExpressions)", http.StatusInternalServerError) // 500
+		return
+	}
+
+	logger.Info("Query expressions", zap.Int("user id", userID), zap.Int("requested", len(req.IDs)), zap.Int("found", len(exprs)))
+}
@@ -0,0 +1,97 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/YattaDeSune/calc-project/internal/entities"
+)
+
+// Запрос пользователя userID, как после AuthMiddleware
+func serve(handler http.HandlerFunc, userID int, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+	req = req.WithContext(context.WithValue(req.Context(), entities.UserIDKey, userID))
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+	return rec
+}
+
+func TestAddExpressionsBatch(t *testing.T) {
+	storage, database := newTestStorage(t)
+	storage.cfg.MaxBatchSize = 10
+	storage.cfg.MaxPendingPerUser = 2
+	s := &Server{ctx: storage.ctx, cfg: storage.cfg, storage: storage, db: database}
+
+	rec := serve(s.AddExpressionsBatch, 1, `{"expressions": [
+		{"expression": "1+2"},
+		{"expression": "2*"},
+		{"expression": "x+1"},
+		{"expression": "3+4"},
+		{"expression": "5+6"}
+	]}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d %q", rec.Code, rec.Body.String())
+	}
+	var resp AddBatchResponce
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+
+	// ошибки разбора и квоты - по каждому выражению отдельно
+	wantCodes := []int{201, 422, 422, 201, 429}
+	if len(resp.Results) != len(wantCodes) {
+		t.Fatalf("expected %d results, got %+v", len(wantCodes), resp.Results)
+	}
+	for i, code := range wantCodes {
+		if resp.Results[i].Index != i || resp.Results[i].Code != code {
+			t.Errorf("result %d: expected code %d, got %+v", i, code, resp.Results[i])
+		}
+	}
+	if resp.Results[1].Details == nil {
+		t.Error("expected parse error details")
+	}
+	if rec.Header().Get("Retry-After") == "" {
+		t.Error("expected Retry-After for rejected expressions")
+	}
+
+	first, second := resp.Results[0].ID, resp.Results[3].ID
+	if first == 0 || second == 0 || first == second {
+		t.Fatalf("expected two new ids, got %d and %d", first, second)
+	}
+	if tasks := storage.GetTasks(second); len(tasks) != 1 {
+		t.Errorf("expected expression to be computing, got %d tasks", len(tasks))
+	}
+
+	if rec := serve(s.AddExpressionsBatch, 1, `{"expressions": []}`); rec.Code != http.StatusUnprocessableEntity {
+		t.Errorf("expected 422 for empty batch, got %d", rec.Code)
+	}
+	big := `{"expressions": [` + strings.Repeat(`{"expression": "1+1"},`, 10) + `{"expression": "1+1"}]}`
+	if rec := serve(s.AddExpressionsBatch, 1, big); rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected 413 for too big batch, got %d", rec.Code)
+	}
+
+	// QueryExpressions: порядок запроса, чужие и несуществующие - в not_found
+	other, err := database.CreateExpression(s.ctx, 2, entities.Accepted, entities.NewExpression{Expression: "7+8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := json.Marshal(QueryExpressionsRequest{IDs: []int{second, first, other, 999, first}})
+	rec = serve(s.QueryExpressions, 1, string(body))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d %q", rec.Code, rec.Body.String())
+	}
+	var query QueryExpressionsResponce
+	if err := json.Unmarshal(rec.Body.Bytes(), &query); err != nil {
+		t.Fatal(err)
+	}
+	if len(query.Expressions) != 2 || query.Expressions[0].ID != second || query.Expressions[1].ID != first {
+		t.Errorf("expected expressions %d and %d, got %+v", second, first, query.Expressions)
+	}
+	if len(query.NotFound) != 2 || query.NotFound[0] != other || query.NotFound[1] != 999 {
+		t.Errorf("expected not found %d and 999, got %v", other, query.NotFound)
+	}
+}
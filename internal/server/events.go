@@ -0,0 +1,335 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/YattaDeSune/calc-project/internal/entities"
+	"github.com/YattaDeSune/calc-project/internal/logger"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	"go.uber.org/zap"
+)
+
+// Типы событий выражения
+const (
+	EventStatus = "status" // сменился статус выражения
+	EventTask   = "task"   // сменился статус таски
+	EventResult = "result" // выражение завершено (досчитано, с ошибкой или отменено), событие последнее
+)
+
+const (
+	eventsBuffer = 64               // столько событий ждет медленного клиента, дальше он отключается
+	eventsPing   = 15 * time.Second // keep-alive, чтобы прокси не рвали тихое соединение
+)
+
+// Событие выражения для подписчиков
+type Event struct {
+	Type         string  `json:"type"`
+	ExpressionID int     `json:"expression_id"`
+	Status       string  `json:"status"` // статус выражения, для EventTask - статус таски
+	TaskID       string  `json:"task_id,omitempty"`
+	Operation    string  `json:"operation,omitempty"`
+	Completed    int     `json:"completed"` // посчитано тасок из Total
+	Total        int     `json:"total"`
+	Result       any     `json:"result,omitempty"` // результат таски или выражения
+	ExactResult  *string `json:"exact_result,omitempty"`
+	ErrorCode    string  `json:"error_code,omitempty"` // выражение завершено с ошибкой
+	ErrorMessage string  `json:"error_message,omitempty"`
+}
+
+// Подписки на события выражений
+type Hub struct {
+	mu   *sync.Mutex
+	subs map[int]map[chan Event]struct{} // id выражения -> каналы подписчиков
+}
+
+func NewHub() *Hub {
+	return &Hub{
+		mu:   &sync.Mutex{},
+		subs: make(map[int]map[chan Event]struct{}),
+	}
+}
+
+// Подписывается на события выражения. Канал закрывается, если подписчик не успевает читать события
+func (h *Hub) Subscribe(exprID int) chan Event {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	ch := make(chan Event, eventsBuffer)
+	if h.subs[exprID] == nil {
+		h.subs[exprID] = make(map[chan Event]struct{})
+	}
+	h.subs[exprID][ch] = struct{}{}
+	return ch
+}
+
+func (h *Hub) Unsubscribe(exprID int, ch chan Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, ok := h.subs[exprID][ch]; ok {
+		h.remove(exprID, ch)
+	}
+}
+
+// Вызывать под h.mu
+func (h *Hub) remove(exprID int, ch chan Event) {
+	delete(h.subs[exprID], ch)
+	if len(h.subs[exprID]) == 0 {
+		delete(h.subs, exprID)
+	}
+	close(ch)
+}
+
+// Есть ли подписчики у выражения: без них событие можно не собирать
+func (h *Hub) Subscribed(exprID int) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return len(h.subs[exprID]) > 0
+}
+
+// Рассылает событие, не блокируясь: отстающий подписчик отключается и переподключится сам
+func (h *Hub) Publish(event Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for ch := range h.subs[event.ExpressionID] {
+		select {
+		case ch <- event:
+		default:
+			h.remove(event.ExpressionID, ch)
+		}
+	}
+}
+
+// Отправляет событие выражения с текущим прогрессом. Вызывать под e.mu
+func (s *Storage) publish(e *expression, event Event) {
+	if !s.events.Subscribed(e.ID) {
+		return
+	}
+
+	event.ExpressionID = e.ID
+	event.Total = len(e.Tasks)
+	for _, task := range e.Tasks {
+		if task.Status == entities.Completed {
+			event.Completed++
+		}
+	}
+	s.events.Publish(event)
+}
+
+// Событие о таске выражения. Вызывать под e.mu
+func (s *Storage) publishTask(e *expression, task *entities.Task) {
+	s.publish(e, Event{
+		Type:      EventTask,
+		Status:    task.Status,
+		TaskID:    task.ID,
+		Operation: task.Operation,
+		Result:    task.Result,
+	})
+}
+
+// Поток событий выражения: сначала текущее состояние, затем изменения до завершения выражения.
+// send возвращает ошибку, если клиент отключился
+func (s *Server) streamEvents(r *http.Request, id int, send func(Event) error, ping func() error) {
+	ctx := s.ctx
+	logger := logger.FromContext(ctx)
+
+	// подписываемся до чтения состояния, чтобы не пропустить изменения между ними
+	events := s.storage.events.Subscribe(id)
+	defer s.storage.events.Unsubscribe(id, events)
+
+	snapshot, err := s.eventsSnapshot(r, id)
+	if err != nil {
+		logger.Error("Failed to get expression", zap.Int("id", id), zap.Error(err))
+		return
+	}
+	if err := send(snapshot); err != nil || snapshot.Type == EventResult {
+		return
+	}
+
+	ticker := time.NewTicker(eventsPing)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+			if err := ping(); err != nil {
+				return
+			}
+		case event, ok := <-events:
+			if !ok {
+				logger.Info("Slow events subscriber disconnected", zap.Int("id", id))
+				return
+			}
+			if err := send(event); err != nil || event.Type == EventResult {
+				return
+			}
+		}
+	}
+}
+
+// Текущее состояние выражения: EventResult для завершенного, иначе EventStatus с прогрессом
+func (s *Server) eventsSnapshot(r *http.Request, id int) (Event, error) {
+	userID, _ := r.Context().Value(entities.UserIDKey).(int)
+	expr, err := s.db.GetExpressionByID(s.ctx, id, userID)
+	if err != nil {
+		return Event{}, err
+	}
+	if expr == nil {
+		return Event{}, fmt.Errorf("expression %d not found", id)
+	}
+
+	event := Event{
+		Type:         EventStatus,
+		ExpressionID: expr.ID,
+		Status:       expr.Status,
+	}
+	switch expr.Status {
+	case entities.Completed, entities.CompletedWithError, entities.Cancelled:
+		event.Type = EventResult
+		if expr.Result != nil {
+			event.Result = *expr.Result
+		}
+		event.ExactResult = expr.ExactResult
+		if expr.ErrorCode != nil {
+			event.ErrorCode = *expr.ErrorCode
+		}
+		if expr.ErrorMessage != nil {
+			event.ErrorMessage = *expr.ErrorMessage
+		}
+		return event, nil
+	}
+
+	tasks := s.storage.GetTasks(id)
+	event.Total = len(tasks)
+	for _, task := range tasks {
+		if task.Status == entities.Completed {
+			event.Completed++
+		}
+	}
+	return event, nil
+}
+
+// Проверяет до начала потока, что выражение есть и принадлежит пользователю, возвращает его id
+func (s *Server) checkEventsAccess(w http.ResponseWriter, r *http.Request) (int, bool) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusNotFound) // 404
+		return 0, false
+	}
+
+	userID, ok := r.Context().Value(entities.UserIDKey).(int)
+	if !ok {
+		http.Error(w, "Failed to get user id", http.StatusInternalServerError)
+		return 0, false
+	}
+
+	expr, err := s.db.GetExpressionByID(s.ctx, id, userID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return 0, false
+	}
+	if expr == nil {
+		http.Error(w, "Expression not found", http.StatusNotFound) // 404
+		return 0, false
+	}
+	return id, true
+}
+
+// /expressions/{id}/events GET (Server-Sent Events)
+func (s *Server) ExpressionEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming is not supported", http.StatusInternalServerError) // 500
+		return
+	}
+	id, ok := s.checkEventsAccess(w, r)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK) // 200
+	flusher.Flush()
+
+	send := func(event Event) error {
+		data, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data); err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	}
+	ping := func() error {
+		if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	}
+	s.streamEvents(r, id, send, ping)
+}
+
+var upgrader = websocket.Upgrader{
+	// доступ проверяется по JWT, как и у остального API (CORS тоже открыт для всех)
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// /expressions/{id}/ws GET (WebSocket)
+func (s *Server) ExpressionWebSocket(w http.ResponseWriter, r *http.Request) {
+	logger := logger.FromContext(s.ctx)
+
+	id, ok := s.checkEventsAccess(w, r)
+	if !ok {
+		return
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// ответ клиенту уже отправлен Upgrade
+		logger.Info("Failed to upgrade to websocket", zap.Error(err))
+		return
+	}
+	defer conn.Close()
+
+	// клиент ничего не шлет, читаем только чтобы заметить закрытие соединения
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	go func() {
+		defer cancel()
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	send := func(event Event) error {
+		conn.SetWriteDeadline(time.Now().Add(eventsPing))
+		return conn.WriteJSON(event)
+	}
+	ping := func() error {
+		return conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(eventsPing))
+	}
+	s.streamEvents(r.WithContext(ctx), id, send, ping)
+
+	conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+}
@@ -0,0 +1,191 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/YattaDeSune/calc-project/internal/auth"
+	"github.com/YattaDeSune/calc-project/internal/entities"
+	"github.com/YattaDeSune/calc-project/internal/middleware"
+	"github.com/YattaDeSune/calc-project/pkg/calculation"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+)
+
+func TestHub_DropsSlowSubscriber(t *testing.T) {
+	hub := NewHub()
+	slow := hub.Subscribe(1)
+	other := hub.Subscribe(2)
+
+	for i := 0; i <= eventsBuffer; i++ {
+		hub.Publish(Event{Type: EventTask, ExpressionID: 1})
+	}
+
+	// буфер дочитывается, после него канал закрыт
+	for i := 0; i < eventsBuffer; i++ {
+		if _, ok := <-slow; !ok {
+			t.Fatalf("channel closed after %d events", i)
+		}
+	}
+	if _, ok := <-slow; ok {
+		t.Fatal("expected slow subscriber to be disconnected")
+	}
+	if hub.Subscribed(1) || !hub.Subscribed(2) {
+		t.Error("expected only subscriber of expression 2 to remain")
+	}
+
+	// повторная отписка уже отключенного подписчика безопасна
+	hub.Unsubscribe(1, slow)
+	hub.Unsubscribe(2, other)
+}
+
+func TestServer_ExpressionEvents(t *testing.T) {
+	storage, database := newTestStorage(t)
+	ctx := storage.ctx
+
+	const expr = "1+2"
+	id, err := database.CreateExpression(ctx, 1, entities.Accepted, entities.NewExpression{Expression: expr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	RPN, err := calculation.Parse(expr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Reserve(1); err != nil {
+		t.Fatal(err)
+	}
+	storage.AddExpression(database, &entities.Expression{ID: id, Expression: expr, UserID: 1}, RPN)
+
+	s := &Server{ctx: ctx, cfg: storage.cfg, storage: storage, db: database}
+	r := mux.NewRouter()
+	r.HandleFunc("/api/v1/expressions/{id}/events", s.ExpressionEvents)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		// пользователь, которого кладет AuthMiddleware
+		r.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), entities.UserIDKey, 1)))
+	}))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/api/v1/expressions/" + strconv.Itoa(id) + "/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("expected event stream, got %q", ct)
+	}
+
+	// агент берет и считает таску, когда клиент уже подписан
+	go func() {
+		for !storage.events.Subscribed(id) {
+			time.Sleep(time.Millisecond)
+		}
+		task := storage.GetTaskForAgent(database, "")
+		storage.SubmitTaskResult(database, compute(task))
+	}()
+
+	var events []Event
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+		if !ok {
+			continue
+		}
+		var event Event
+		if err := json.Unmarshal([]byte(data), &event); err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, event)
+	}
+
+	want := []struct{ kind, status string }{
+		{EventStatus, entities.Accepted},
+		{EventStatus, entities.InProgress},
+		{EventTask, entities.InProgress},
+		{EventTask, entities.Completed},
+		{EventResult, entities.Completed},
+	}
+	if len(events) != len(want) {
+		t.Fatalf("expected %d events, got %+v", len(want), events)
+	}
+	for i, w := range want {
+		if events[i].Type != w.kind || events[i].Status != w.status {
+			t.Errorf("event %d: expected %s %s, got %s %s", i, w.kind, w.status, events[i].Type, events[i].Status)
+		}
+	}
+	last := events[len(events)-1]
+	if last.Result != float64(3) || last.Completed != 1 || last.Total != 1 {
+		t.Errorf("expected result 3 with 1/1 tasks, got %+v", last)
+	}
+}
+
+// WebSocket за AuthMiddleware: браузер не шлет заголовки, поэтому токен передается в ?token=
+func TestServer_ExpressionWebSocket(t *testing.T) {
+	storage, database := newTestStorage(t)
+	ctx := storage.ctx
+
+	const expr = "1+2"
+	id, err := database.CreateExpression(ctx, 1, entities.Accepted, entities.NewExpression{Expression: expr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	RPN, err := calculation.Parse(expr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Reserve(1); err != nil {
+		t.Fatal(err)
+	}
+	storage.AddExpression(database, &entities.Expression{ID: id, Expression: expr, UserID: 1}, RPN)
+
+	key := auth.Key{ID: "test", Secret: []byte(strings.Repeat("k", auth.MinKeySize))}
+	jwt, err := auth.NewJWTManager([]auth.Key{key}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := jwt.Generate(1, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Server{ctx: ctx, cfg: storage.cfg, storage: storage, db: database}
+	r := mux.NewRouter()
+	r.HandleFunc("/api/v1/expressions/{id}/ws", s.ExpressionWebSocket)
+	srv := httptest.NewServer(middleware.AuthMiddleware(ctx, *jwt, r))
+	defer srv.Close()
+
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/api/v1/expressions/" + strconv.Itoa(id) + "/ws"
+
+	for name, query := range map[string]string{"no token": "", "invalid token": "?token=invalid"} {
+		conn, resp, err := websocket.DefaultDialer.Dial(url+query, nil)
+		if err == nil {
+			conn.Close()
+			t.Fatalf("%s: expected handshake to be rejected", name)
+		}
+		if resp == nil || resp.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("%s: expected 401, got %v", name, resp)
+		}
+	}
+
+	conn, _, err := websocket.DefaultDialer.Dial(url+"?token="+token, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var event Event
+	if err := conn.ReadJSON(&event); err != nil {
+		t.Fatal(err)
+	}
+	if event.Type != EventStatus || event.Status != entities.Accepted {
+		t.Errorf("expected status %s event, got %+v", entities.Accepted, event)
+	}
+}
@@ -3,16 +3,22 @@ package server
 import (
 	"context"
 	"encoding/json"
+	stderrors "errors"
 	"io"
 	"net/http"
 	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/YattaDeSune/calc-project/internal/auth"
 	"github.com/YattaDeSune/calc-project/internal/entities"
 	"github.com/YattaDeSune/calc-project/internal/errors"
 	"github.com/YattaDeSune/calc-project/internal/logger"
 	pb "github.com/YattaDeSune/calc-project/internal/proto"
+	"github.com/YattaDeSune/calc-project/pkg/calculation"
+	"github.com/YattaDeSune/calc-project/pkg/decimal"
+	"github.com/gorilla/mux"
 	"go.uber.org/zap"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
@@ -110,11 +116,158 @@ func (s *Server) Login(w http.ResponseWriter, r *http.Request) {
 }
 
 type AddExpressionRequest struct {
-	Expression string `json:"expression"`
+	Expression string              `json:"expression"`
+	Variables  map[string]float64  `json:"variables,omitempty"` // значения переменных выражения
+	Precision  *entities.Precision `json:"precision,omitempty"` // точный режим вычислений
+	Priority   int                 `json:"priority,omitempty"`  // чем больше, тем раньше считается среди выражений пользователя
+	// куда отправить результат, когда выражение завершится; тело подписывается секретом
+	CallbackURL    string `json:"callback_url,omitempty"`
+	CallbackSecret string `json:"callback_secret,omitempty"`
 }
 
 type AddExpressionResponce struct {
-	ID int `json:"id"`
+	ID       int `json:"id"`
+	Priority int `json:"priority"` // приоритет после ограничения максимумом
+}
+
+// Ошибка разбора выражения, pos - номер символа, на котором найдена ошибка
+type ParseErrorResponce struct {
+	Code    string `json:"code"`
+	Pos     int    `json:"pos"`
+	Token   string `json:"token,omitempty"`
+	Message string `json:"message"`
+}
+
+// Переменные выражения, значения которых не переданы в запросе
+type UndefinedVariablesResponce struct {
+	Code    string   `json:"code"`
+	Names   []string `json:"names"`
+	Message string   `json:"message"`
+}
+
+// Ошибка в выражении из запроса: код ответа, текст и подробности для ошибок разбора
+type requestError struct {
+	status  int
+	message string
+	details any // ParseErrorResponce или UndefinedVariablesResponce
+}
+
+func writeRequestError(w http.ResponseWriter, reqErr *requestError) {
+	if reqErr.details == nil {
+		http.Error(w, reqErr.message, reqErr.status)
+		return
+	}
+	w.Header().Set("Content-type", "application/json")
+	w.WriteHeader(reqErr.status)
+	json.NewEncoder(w).Encode(reqErr.details)
+}
+
+// Проверенное и разобранное выражение, готовое к записи в бд
+type preparedExpression struct {
+	req      AddExpressionRequest
+	RPN      []string
+	callback *entities.Callback
+}
+
+// Проверяет выражение из запроса и разбирает его в ОПН
+func (s *Server) prepareExpression(req AddExpressionRequest) (*preparedExpression, *requestError) {
+	logger := logger.FromContext(s.ctx)
+
+	if req.Expression == "" {
+		return nil, &requestError{status: http.StatusUnprocessableEntity, message: "Expression cannot be empty"} // 422
+	}
+
+	if req.Priority < 0 {
+		return nil, &requestError{status: http.StatusUnprocessableEntity, message: "Priority cannot be negative"} // 422
+	}
+
+	var callback *entities.Callback
+	if req.CallbackURL != "" || req.CallbackSecret != "" {
+		if err := validateCallback(s.ctx, s.callbacks, req.CallbackURL, req.CallbackSecret); err != nil {
+			return nil, &requestError{status: http.StatusUnprocessableEntity, message: err.Error()} // 422
+		}
+		callback = &entities.Callback{URL: req.CallbackURL, Secret: req.CallbackSecret}
+	}
+
+	// слишком длинное выражение отсекаем до разбора
+	if limit := s.cfg.MaxExpressionTokens; limit > 0 && len(calculation.Lex(req.Expression)) > limit {
+		return nil, &requestError{status: http.StatusRequestEntityTooLarge, message: "Expression is too long, max tokens: " + strconv.Itoa(limit)} // 413
+	}
+
+	if req.Precision != nil {
+		if req.Precision.Rounding == "" {
+			req.Precision.Rounding = decimal.HalfUp
+		}
+		if req.Precision.Scale < 0 || req.Precision.Scale > decimal.MaxScale {
+			return nil, &requestError{status: http.StatusUnprocessableEntity, message: "Precision scale must be between 0 and " + strconv.Itoa(decimal.MaxScale)} // 422
+		}
+		if !decimal.IsValidMode(req.Precision.Rounding) {
+			return nil, &requestError{status: http.StatusUnprocessableEntity, message: "Unknown rounding mode"} // 422
+		}
+	}
+
+	// Разбираем выражение до сохранения, чтобы сразу вернуть клиенту место ошибки
+	RPN, err := calculation.Parse(req.Expression)
+	if err != nil {
+		var parseErr *calculation.ParseError
+		if !stderrors.As(err, &parseErr) {
+			return nil, &requestError{status: http.StatusUnprocessableEntity, message: err.Error()} // 422
+		}
+		logger.Info("Invalid expression", zap.String("expression", req.Expression), zap.Error(err))
+
+		return nil, &requestError{status: http.StatusUnprocessableEntity, message: parseErr.Error(), details: ParseErrorResponce{ // 422
+			Code:    parseErr.Code,
+			Pos:     parseErr.Pos,
+			Token:   parseErr.Token,
+			Message: parseErr.Error(),
+		}}
+	}
+
+	// Подставляем переменные до отправки тасок агентам
+	RPN, err = calculation.Bind(RPN, req.Variables)
+	if err != nil {
+		var undefinedErr *calculation.UndefinedVariablesError
+		if !stderrors.As(err, &undefinedErr) {
+			return nil, &requestError{status: http.StatusUnprocessableEntity, message: err.Error()} // 422
+		}
+		logger.Info("Undefined variables", zap.String("expression", req.Expression), zap.Strings("names", undefinedErr.Names))
+
+		return nil, &requestError{status: http.StatusUnprocessableEntity, message: undefinedErr.Error(), details: UndefinedVariablesResponce{ // 422
+			Code:    "undefined_variables",
+			Names:   undefinedErr.Names,
+			Message: undefinedErr.Error(),
+		}}
+	}
+
+	if limit := s.cfg.MaxExpressionDepth; limit > 0 && calculation.Depth(RPN) > limit {
+		return nil, &requestError{status: http.StatusRequestEntityTooLarge, message: "Expression is too deeply nested, max depth: " + strconv.Itoa(limit)} // 413
+	}
+
+	return &preparedExpression{req: req, RPN: RPN, callback: callback}, nil
+}
+
+// Максимальный приоритет выражений пользователя: свой или общий из конфига
+func (s *Server) maxPriority(userID int) (int, error) {
+	maxPriority, err := s.db.GetUserMaxPriority(s.ctx, userID)
+	if err != nil {
+		return 0, err
+	}
+	if maxPriority != nil {
+		return *maxPriority, nil
+	}
+	return s.cfg.MaxPriority, nil
+}
+
+// Отдает записанное в бд выражение на вычисление
+func (s *Server) startExpression(id, userID, priority int, expr *preparedExpression) {
+	s.storage.AddExpression(s.db, &entities.Expression{
+		ID:         id,
+		Expression: expr.req.Expression,
+		UserID:     userID,
+		Priority:   priority,
+		Precision:  expr.req.Precision,
+		Variables:  expr.req.Variables,
+	}, expr.RPN)
 }
 
 // /calculate POST
@@ -136,8 +289,9 @@ func (s *Server) AddExpression(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if req.Expression == "" {
-		http.Error(w, "Expression cannot be empty", http.StatusUnprocessableEntity) // 422
+	expr, reqErr := s.prepareExpression(req)
+	if reqErr != nil {
+		writeRequestError(w, reqErr)
 		return
 	}
 
@@ -148,17 +302,43 @@ func (s *Server) AddExpression(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	exprID, err := s.db.CreateExpression(ctx, req.Expression, userID, entities.Accepted)
+	// место под выражение занимаем до записи в бд, чтобы параллельные запросы не превысили лимит
+	if err := s.storage.Reserve(userID); err != nil {
+		logger.Info("Expression rejected", zap.Int("user id", userID), zap.Error(err))
+		w.Header().Set("Retry-After", strconv.Itoa(s.cfg.RetryAfterS))
+		http.Error(w, err.Error(), http.StatusTooManyRequests) // 429
+		return
+	}
+
+	// приоритет ограничен сверху: своим максимумом пользователя или общим из конфига
+	maxPriority, err := s.maxPriority(userID)
 	if err != nil {
+		logger.Error("Failed to get user max priority", zap.Int("user id", userID), zap.Error(err))
+		s.storage.Release(userID)
+		http.Error(w, "Failed to create expression", http.StatusInternalServerError) // 500
+		return
+	}
+	priority := min(req.Priority, maxPriority)
+
+	exprID, err := s.db.CreateExpression(ctx, userID, entities.Accepted, entities.NewExpression{
+		Expression: req.Expression,
+		Precision:  req.Precision,
+		Variables:  req.Variables,
+		Priority:   priority,
+		Callback:   expr.callback,
+	})
+	if err != nil {
+		s.storage.Release(userID)
 		http.Error(w, "Failed to create expression", http.StatusInternalServerError)
 		return
 	}
-	logger.Info("Add expression", zap.Int("id", exprID), zap.String("expression", req.Expression))
+	logger.Info("Add expression", zap.Int("id", exprID), zap.String("expression", req.Expression), zap.Int("priority", priority))
 
-	s.storage.AddExpression(s.db, exprID, req.Expression)
+	s.startExpression(exprID, userID, priority, expr)
 
 	resp := &AddExpressionResponce{
-		ID: exprID,
+		ID:       exprID,
+		Priority: priority,
 	}
 
 	w.WriteHeader(http.StatusCreated) // 201
@@ -169,15 +349,56 @@ func (s *Server) AddExpression(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+type localTask struct {
+	ID        string   `json:"id"`
+	Operation string   `json:"operation"`
+	Args      []string `json:"args"`
+	Status    string   `json:"status"`
+	Result    any      `json:"result,omitempty"`
+}
+
 type localExpression struct {
-	ID         int    `json:"id"`
-	Expression string `json:"expression"`
-	Status     string `json:"status"`
-	Result     any    `json:"result"`
+	ID           int                 `json:"id"`
+	Expression   string              `json:"expression"`
+	Status       string              `json:"status"`
+	Result       *float64            `json:"result"` // null, пока выражение не досчитано, и при ошибке
+	Precision    *entities.Precision `json:"precision,omitempty"`
+	Variables    map[string]float64  `json:"variables,omitempty"`    // переданные значения переменных
+	ExactResult  *string             `json:"exact_result,omitempty"` // точный результат десятичной строкой
+	ErrorCode    *string             `json:"error_code,omitempty"`   // только для completed with error
+	ErrorMessage *string             `json:"error_message,omitempty"`
+	Priority     int                 `json:"priority"`
+	TaskCount    int                 `json:"task_count"`
+	ComputeMs    int64               `json:"compute_ms"` // сколько агенты считали таски выражения
+	CreatedAt    string              `json:"created_at"`
+	StartedAt    *time.Time          `json:"started_at,omitempty"`
+	FinishedAt   *time.Time          `json:"finished_at,omitempty"`
+	Tasks        []localTask         `json:"tasks,omitempty"` // только для выражений, которые еще вычисляются
+}
+
+func newLocalExpression(expr *entities.ExpressionDB) localExpression {
+	return localExpression{
+		ID:           expr.ID,
+		Expression:   expr.Expression,
+		Status:       expr.Status,
+		Result:       expr.Result,
+		Precision:    expr.Precision,
+		Variables:    expr.Variables,
+		ExactResult:  expr.ExactResult,
+		ErrorCode:    expr.ErrorCode,
+		ErrorMessage: expr.ErrorMessage,
+		Priority:     expr.Priority,
+		TaskCount:    expr.TaskCount,
+		ComputeMs:    expr.ComputeMs,
+		CreatedAt:    expr.CreatedAt,
+		StartedAt:    expr.StartedAt,
+		FinishedAt:   expr.FinishedAt,
+	}
 }
 
 type GetExpressionsResponce struct {
 	Expressions []localExpression `json:"expressions"`
+	NextCursor  string            `json:"next_cursor,omitempty"` // пусто - это последняя страница
 }
 
 // /expressions GET
@@ -192,30 +413,43 @@ func (s *Server) GetExpressions(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	exprs, err := s.db.GetExpressionsByUser(ctx, userID)
+	filter, err := parseExpressionFilter(r.URL.Query(), s.cfg)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusBadRequest) // 400
 		return
 	}
 
-	var resp GetExpressionsResponce
+	// берем на одно выражение больше, чтобы узнать, есть ли следующая страница
+	limit := filter.Limit
+	filter.Limit++
+	exprs, err := s.db.ListExpressions(ctx, userID, *filter)
+	if err != nil {
+		logger.Error("Failed to list expressions", zap.Int("user id", userID), zap.Error(err))
+		http.Error(w, "Failed to get expressions", http.StatusInternalServerError) // 500
+		return
+	}
+
+	resp := GetExpressionsResponce{Expressions: []localExpression{}}
+	if len(exprs) > limit {
+		exprs = exprs[:limit]
+		if resp.NextCursor, err = encodeCursor(filter, exprs[limit-1]); err != nil {
+			logger.Error("Failed to encode cursor", zap.Int("user id", userID), zap.Error(err))
+			http.Error(w, "Failed to get expressions", http.StatusInternalServerError) // 500
+			return
+		}
+	}
 	for _, expr := range exprs {
-		resp.Expressions = append(resp.Expressions, localExpression{
-			ID:         expr.ID,
-			Expression: expr.Expression,
-			Status:     expr.Status,
-			Result:     expr.Result,
-		})
+		resp.Expressions = append(resp.Expressions, newLocalExpression(&expr))
 	}
 
-	w.WriteHeader(http.StatusOK) // 200
 	w.Header().Set("Content-type", "application/json")
+	w.WriteHeader(http.StatusOK) // 200
 	if err := json.NewEncoder(w).Encode(resp); err != nil {
 		http.Error(w, "Failed to encode response (GetExpressions)", http.StatusInternalServerError) // 500
 		return
 	}
 
-	logger.Info("Get expressions", zap.Any("expressions", resp))
+	logger.Info("Get expressions", zap.Int("user id", userID), zap.Int("count", len(resp.Expressions)), zap.Bool("has more", resp.NextCursor != ""))
 }
 
 type GetExpressionResponce struct {
@@ -258,11 +492,15 @@ func (s *Server) GetExpressionByID(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	localExpr := localExpression{
-		ID:         expr.ID,
-		Expression: expr.Expression,
-		Status:     expr.Status,
-		Result:     expr.Result,
+	localExpr := newLocalExpression(expr)
+	for _, task := range s.storage.GetTasks(expr.ID) {
+		localExpr.Tasks = append(localExpr.Tasks, localTask{
+			ID:        task.ID,
+			Operation: task.Operation,
+			Args:      task.Args,
+			Status:    task.Status,
+			Result:    task.Result,
+		})
 	}
 	resp := GetExpressionResponce{Expression: localExpr}
 
@@ -276,23 +514,205 @@ func (s *Server) GetExpressionByID(w http.ResponseWriter, r *http.Request) {
 	logger.Info("Get expression by id", zap.Any("expression", resp))
 }
 
+// /expressions/:id DELETE, /expressions/:id/cancel POST
+func (s *Server) CancelExpression(w http.ResponseWriter, r *http.Request) {
+	ctx := s.ctx
+	logger := logger.FromContext(ctx)
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusNotFound) // 404
+		return
+	}
+
+	userID, ok := r.Context().Value(entities.UserIDKey).(int)
+	if !ok {
+		http.Error(w, "Failed to get user id", http.StatusInternalServerError)
+		return
+	}
+
+	// отменить можно только свое выражение
+	expr, err := s.db.GetExpressionByID(ctx, id, userID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if expr == nil {
+		http.Error(w, "Expression not found", http.StatusNotFound) // 404
+		return
+	}
+
+	cancelled, err := s.storage.CancelExpression(s.db, id)
+	if err != nil {
+		logger.Error("Failed to cancel expression", zap.Int("id", id), zap.Error(err))
+		http.Error(w, "Failed to cancel expression", http.StatusInternalServerError) // 500
+		return
+	}
+	if !cancelled {
+		http.Error(w, "Expression is already finished", http.StatusConflict) // 409
+		return
+	}
+
+	resp := GetExpressionResponce{Expression: localExpression{
+		ID:         expr.ID,
+		Expression: expr.Expression,
+		Status:     entities.Cancelled,
+		Precision:  expr.Precision,
+		Priority:   expr.Priority,
+	}}
+
+	w.Header().Set("Content-type", "application/json")
+	w.WriteHeader(http.StatusOK) // 200
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		http.Error(w, "Failed to encode response (CancelExpression)", http.StatusInternalServerError) // 500
+		return
+	}
+
+	logger.Info("Cancel expression", zap.Int("id", id))
+}
+
+type GetAttemptsResponce struct {
+	Attempts []entities.TaskAttempt `json:"attempts"`
+}
+
+// /expressions/:id/attempts GET - история попыток вычисления тасок выражения
+func (s *Server) GetExpressionAttempts(w http.ResponseWriter, r *http.Request) {
+	ctx := s.ctx
+	logger := logger.FromContext(ctx)
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusNotFound) // 404
+		return
+	}
+
+	userID, ok := r.Context().Value(entities.UserIDKey).(int)
+	if !ok {
+		http.Error(w, "Failed to get user id", http.StatusInternalServerError)
+		return
+	}
+
+	expr, err := s.db.GetExpressionByID(ctx, id, userID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if expr == nil {
+		http.Error(w, "Expression not found", http.StatusNotFound) // 404
+		return
+	}
+
+	attempts, err := s.db.GetTaskAttempts(ctx, id)
+	if err != nil {
+		logger.Error("Failed to get task attempts", zap.Int("id", id), zap.Error(err))
+		http.Error(w, "Failed to get task attempts", http.StatusInternalServerError) // 500
+		return
+	}
+	resp := GetAttemptsResponce{Attempts: attempts}
+	if resp.Attempts == nil {
+		resp.Attempts = []entities.TaskAttempt{}
+	}
+
+	w.Header().Set("Content-type", "application/json")
+	w.WriteHeader(http.StatusOK) // 200
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		http.Error(w, "Failed to encode response (GetExpressionAttempts)", http.StatusInternalServerError) // 500
+		return
+	}
+
+	logger.Info("Get expression attempts", zap.Int("id", id), zap.Int("attempts", len(attempts)))
+}
+
+// Использование и лимит, limit = 0 - без ограничения
+type quotaUsage struct {
+	Used  int `json:"used"`
+	Limit int `json:"limit"`
+}
+
+type GetQuotaResponce struct {
+	Pending      quotaUsage `json:"pending"`       // выражения пользователя в работе
+	TotalPending quotaUsage `json:"total_pending"` // выражения в работе на всем оркестраторе
+	MaxTokens    int        `json:"max_tokens"`
+	MaxDepth     int        `json:"max_depth"`
+	MaxPriority  int        `json:"max_priority"`
+}
+
+// /me/quota GET
+func (s *Server) GetQuota(w http.ResponseWriter, r *http.Request) {
+	ctx := s.ctx
+	logger := logger.FromContext(ctx)
+
+	userID, ok := r.Context().Value(entities.UserIDKey).(int)
+	if !ok {
+		http.Error(w, "Failed to get user id", http.StatusInternalServerError)
+		return
+	}
+
+	maxPriority, err := s.db.GetUserMaxPriority(ctx, userID)
+	if err != nil {
+		logger.Error("Failed to get user max priority", zap.Int("user id", userID), zap.Error(err))
+		http.Error(w, "Failed to get quota", http.StatusInternalServerError) // 500
+		return
+	}
+
+	pending, total := s.storage.Usage(userID)
+	resp := GetQuotaResponce{
+		Pending:      quotaUsage{Used: pending, Limit: s.cfg.MaxPendingPerUser},
+		TotalPending: quotaUsage{Used: total, Limit: s.cfg.MaxPendingTotal},
+		MaxTokens:    s.cfg.MaxExpressionTokens,
+		MaxDepth:     s.cfg.MaxExpressionDepth,
+		MaxPriority:  s.cfg.MaxPriority,
+	}
+	if maxPriority != nil {
+		resp.MaxPriority = *maxPriority
+	}
+
+	w.Header().Set("Content-type", "application/json")
+	w.WriteHeader(http.StatusOK) // 200
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		http.Error(w, "Failed to encode response (GetQuota)", http.StatusInternalServerError) // 500
+		return
+	}
+}
+
 // gRPC
 func (s *Server) GetTask(ctx context.Context, in *pb.GetTaskRequest) (*pb.GetTaskResponse, error) {
 	logCtx := s.ctx
 	logger := logger.FromContext(logCtx)
 
-	task := s.storage.GetTaskForAgent(s.db)
+	if !s.agents.Known(in.AgentId) {
+		return nil, status.Error(codes.NotFound, "agent is not registered")
+	}
+
+	task := s.storage.GetTaskForAgent(s.db, in.AgentId)
 	if task == nil {
 		return nil, status.Error(codes.NotFound, "no tasks available")
 	}
 
 	logger.Info("Get task for agent", zap.Any("id", task.ID))
-	return &pb.GetTaskResponse{
+	return taskResponse(task), nil
+}
+
+// Таска в формате для агента
+func taskResponse(task *entities.Task) *pb.GetTaskResponse {
+	resp := &pb.GetTaskResponse{
 		Id:        task.ID,
-		Arg1:      task.Arg1,
-		Arg2:      task.Arg2,
+		Arg1:      task.Args[0],
 		Operation: task.Operation,
-	}, nil
+		Args:      task.Args,
+		LeaseMs:   time.Until(task.LeaseDeadline).Milliseconds(),
+	}
+	if task.Precision != nil {
+		resp.Precision = &pb.Precision{
+			Scale:    int32(task.Precision.Scale),
+			Rounding: task.Precision.Rounding,
+		}
+	}
+	// у унарных операций второго аргумента нет
+	if len(task.Args) > 1 {
+		resp.Arg2 = task.Args[1]
+	}
+	return resp
 }
 
 // gRPC
@@ -300,8 +720,130 @@ func (s *Server) SubmitResult(ctx context.Context, in *pb.SubmitResultRequest) (
 	logCtx := s.ctx
 	logger := logger.FromContext(logCtx)
 
-	s.storage.SubmitTaskResult(s.db, in)
+	if err := s.storage.SubmitTaskResult(s.db, in); err != nil {
+		return nil, status.Error(codes.PermissionDenied, err.Error())
+	}
 	logger.Info("Recieved result from agent", zap.Any("id", in.Id), zap.Any("result", in.Result))
 
 	return &pb.SubmitResultResponse{}, nil
 }
+
+// gRPC, поток с агентом: отдаем таски, пока у агента есть свободные воркеры
+func (s *Server) TaskStream(stream pb.TaskService_TaskStreamServer) error {
+	logger := logger.FromContext(s.ctx)
+	ctx := stream.Context()
+
+	ready := make(chan *pb.Ready, 1)
+	recvErr := make(chan error, 1)
+
+	// id агента потока, пусто - незарегистрированный агент
+	var agentID atomic.Value
+	agentID.Store("")
+
+	// Читаем сообщения агента отдельно, чтобы не блокировать выдачу тасок
+	go func() {
+		for {
+			msg, err := stream.Recv()
+			if err != nil {
+				recvErr <- err
+				return
+			}
+			switch payload := msg.Payload.(type) {
+			case *pb.AgentMessage_Ready:
+				select {
+				case ready <- payload.Ready:
+				case <-ctx.Done():
+					return
+				}
+			case *pb.AgentMessage_Result:
+				// сдать можно только таски, выданные этому потоку
+				payload.Result.AgentId = agentID.Load().(string)
+				if err := s.storage.SubmitTaskResult(s.db, payload.Result); err != nil {
+					logger.Warn("Result rejected", zap.String("id", payload.Result.Id), zap.Error(err))
+					continue
+				}
+				logger.Info("Recieved result from agent", zap.Any("id", payload.Result.Id), zap.Any("result", payload.Result.Result))
+			}
+		}
+	}()
+
+	logger.Info("Agent connected to task stream")
+	free := 0
+	for {
+		// nil канал никогда не сработает - пока нет свободных воркеров, таски не ждем
+		var wake <-chan struct{}
+		if free > 0 {
+			wake = s.storage.Wake()
+			if task := s.storage.GetTaskForAgent(s.db, agentID.Load().(string)); task != nil {
+				if err := stream.Send(&pb.ServerMessage{Payload: &pb.ServerMessage_Task{Task: taskResponse(task)}}); err != nil {
+					// таска останется "в прогрессе" и вернется в очередь при проверке
+					logger.Warn("Failed to send task to agent", zap.String("id", task.ID), zap.Error(err))
+					return err
+				}
+				logger.Info("Send task to agent", zap.String("id", task.ID))
+				free--
+				continue
+			}
+		}
+
+		select {
+		case msg := <-ready:
+			free += int(msg.Slots)
+			// агент сообщает id в первом Ready и после повторной регистрации
+			if msg.AgentId != "" {
+				if !s.agents.Known(msg.AgentId) {
+					return status.Error(codes.NotFound, "agent is not registered")
+				}
+				agentID.Store(msg.AgentId)
+			}
+		case <-wake:
+		case err := <-recvErr:
+			if err == io.EOF {
+				logger.Info("Agent closed task stream")
+				return nil
+			}
+			logger.Warn("Task stream broken", zap.Error(err))
+			return err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// gRPC
+func (s *Server) RegisterAgent(ctx context.Context, in *pb.RegisterAgentRequest) (*pb.RegisterAgentResponse, error) {
+	id := s.agents.Register(Agent{
+		Hostname:       in.Hostname,
+		Version:        in.Version,
+		ComputingPower: int(in.ComputingPower),
+	})
+
+	return &pb.RegisterAgentResponse{
+		AgentId:             id,
+		HeartbeatIntervalMs: int64(s.cfg.HeartbeatIntervalMs),
+	}, nil
+}
+
+// gRPC
+func (s *Server) Heartbeat(ctx context.Context, in *pb.HeartbeatRequest) (*pb.HeartbeatResponse, error) {
+	// агента уже похоронили (или оркестратор перезапускался) - пусть регистрируется заново
+	if !s.agents.Heartbeat(in.AgentId) {
+		return nil, status.Error(codes.NotFound, "agent is not registered")
+	}
+
+	return &pb.HeartbeatResponse{}, nil
+}
+
+// gRPC
+func (s *Server) RenewLease(ctx context.Context, in *pb.RenewLeaseRequest) (*pb.RenewLeaseResponse, error) {
+	logger := logger.FromContext(s.ctx)
+
+	lease, ok := s.storage.RenewLease(in.TaskId, in.AgentId)
+	if !ok {
+		// таска уже вернулась в очередь или выражение досчитано/отменено
+		return nil, status.Error(codes.FailedPrecondition, "task is not leased by agent")
+	}
+
+	logger.Info("Task lease renewed", zap.String("task id", in.TaskId), zap.Duration("lease", lease))
+	return &pb.RenewLeaseResponse{LeaseMs: lease.Milliseconds()}, nil
+}
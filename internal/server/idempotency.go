@@ -0,0 +1,116 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/YattaDeSune/calc-project/internal/entities"
+	"github.com/YattaDeSune/calc-project/internal/logger"
+	"go.uber.org/zap"
+)
+
+const (
+	IdempotencyKeyHeader      = "Idempotency-Key"
+	IdempotentReplayedHeader  = "Idempotent-Replayed" // true - ответ взят из сохраненного
+	maxIdempotencyKey         = 255
+	idempotencyPendingTimeout = time.Minute // незавершенный запрос дольше этого считается брошенным (оркестратор упал)
+)
+
+// Ответ, который пишется клиенту и запоминается
+type recordingWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *recordingWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *recordingWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+// Обработка запросов с заголовком Idempotency-Key: повтор с тем же ключом и телом получает сохраненный ответ,
+// тот же ключ с другим телом - 422. Ключи у каждого пользователя свои и хранятся IdempotencyTTLH часов.
+// Сохраняются только успешные ответы (2xx), после ошибки запрос можно повторить с тем же ключом
+func (s *Server) Idempotent(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := s.ctx
+		logger := logger.FromContext(ctx)
+
+		key := r.Header.Get(IdempotencyKeyHeader)
+		if key == "" {
+			next(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKey {
+			http.Error(w, "Idempotency-Key is too long", http.StatusBadRequest) // 400
+			return
+		}
+
+		userID, ok := r.Context().Value(entities.UserIDKey).(int)
+		if !ok {
+			http.Error(w, "Failed to get user id", http.StatusInternalServerError)
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "Failed to read request", http.StatusBadRequest) // 400
+			return
+		}
+		r.Body.Close()
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		sum := sha256.Sum256(body)
+		hash := hex.EncodeToString(sum[:])
+
+		now := time.Now()
+		ttl := time.Duration(s.cfg.IdempotencyTTLH) * time.Hour
+		record, err := s.db.ReserveIdempotencyKey(ctx, userID, key, hash, now.Add(-ttl), now.Add(-idempotencyPendingTimeout))
+		if err != nil {
+			logger.Error("Failed to reserve idempotency key", zap.Int("user id", userID), zap.Error(err))
+			http.Error(w, "Failed to check Idempotency-Key", http.StatusInternalServerError) // 500
+			return
+		}
+
+		if record != nil {
+			switch {
+			case record.RequestHash != hash:
+				http.Error(w, "Idempotency-Key was already used with a different request", http.StatusUnprocessableEntity) // 422
+			case record.StatusCode == 0:
+				http.Error(w, "Request with this Idempotency-Key is still in progress", http.StatusConflict) // 409
+			default:
+				logger.Info("Idempotent request replayed", zap.Int("user id", userID), zap.String("key", key))
+				w.Header().Set("Content-type", "application/json")
+				w.Header().Set(IdempotentReplayedHeader, "true")
+				w.WriteHeader(record.StatusCode)
+				w.Write(record.Response)
+			}
+			return
+		}
+
+		recorder := &recordingWriter{ResponseWriter: w}
+		next(recorder, r)
+
+		if recorder.status >= 200 && recorder.status < 300 {
+			err = s.db.SaveIdempotencyResponse(ctx, userID, key, recorder.status, recorder.body.Bytes())
+		} else {
+			err = s.db.DeleteIdempotencyKey(ctx, userID, key)
+		}
+		if err != nil {
+			logger.Error("Failed to store idempotency key", zap.Int("user id", userID), zap.String("key", key), zap.Error(err))
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/YattaDeSune/calc-project/internal/entities"
+)
+
+func TestIdempotent(t *testing.T) {
+	storage, database := newTestStorage(t)
+	storage.cfg.IdempotencyTTLH = 24
+	s := &Server{ctx: storage.ctx, cfg: storage.cfg, storage: storage, db: database}
+	handler := s.Idempotent(s.AddExpression)
+
+	// запрос пользователя 1, как после AuthMiddleware
+	calculate := func(key, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/calculate", strings.NewReader(body))
+		req = req.WithContext(context.WithValue(req.Context(), entities.UserIDKey, 1))
+		if key != "" {
+			req.Header.Set(IdempotencyKeyHeader, key)
+		}
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		return rec
+	}
+	id := func(rec *httptest.ResponseRecorder) int {
+		var resp AddExpressionResponce
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("unexpected response %q: %v", rec.Body.String(), err)
+		}
+		return resp.ID
+	}
+
+	first := calculate("key-1", `{"expression": "1+2"}`)
+	if first.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d", first.Code)
+	}
+
+	// повтор возвращает тот же ответ и не создает выражение
+	retry := calculate("key-1", `{"expression": "1+2"}`)
+	if retry.Code != http.StatusCreated || id(retry) != id(first) {
+		t.Errorf("expected replay of expression %d, got %d %q", id(first), retry.Code, retry.Body.String())
+	}
+	if retry.Header().Get(IdempotentReplayedHeader) != "true" {
+		t.Error("expected replayed header")
+	}
+
+	if rec := calculate("key-1", `{"expression": "2+2"}`); rec.Code != http.StatusUnprocessableEntity {
+		t.Errorf("expected 422 for reused key, got %d", rec.Code)
+	}
+
+	// без ключа и с другим ключом - новые выражения
+	if rec := calculate("", `{"expression": "1+2"}`); rec.Code != http.StatusCreated || id(rec) == id(first) {
+		t.Errorf("expected new expression without key, got %d %q", rec.Code, rec.Body.String())
+	}
+	if rec := calculate("key-2", `{"expression": "1+2"}`); rec.Code != http.StatusCreated || id(rec) == id(first) {
+		t.Errorf("expected new expression for another key, got %d %q", rec.Code, rec.Body.String())
+	}
+
+	// ошибка не сохраняется: с тем же ключом можно отправить исправленный запрос
+	if rec := calculate("key-3", `{"expression": "1+"}`); rec.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("expected 422 for invalid expression, got %d", rec.Code)
+	}
+	if rec := calculate("key-3", `{"expression": "1+3"}`); rec.Code != http.StatusCreated {
+		t.Errorf("expected 201 after failed request, got %d %q", rec.Code, rec.Body.String())
+	}
+
+	expressions, err := database.ListExpressions(s.ctx, 1, entities.ExpressionFilter{Limit: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(expressions) != 4 {
+		t.Errorf("expected 4 expressions, got %d", len(expressions))
+	}
+}
@@ -0,0 +1,131 @@
+package server
+
+import (
+	"container/heap"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/YattaDeSune/calc-project/internal/db"
+	"github.com/YattaDeSune/calc-project/internal/entities"
+	"github.com/YattaDeSune/calc-project/internal/logger"
+	"go.uber.org/zap"
+)
+
+// Аренда таски агентом до deadline
+type lease struct {
+	deadline time.Time
+	exprID   int
+	taskID   string
+}
+
+// Куча аренд, сверху ближайшая к истечению.
+// Продление не ищет старую запись, а кладет новую - устаревшие пропускаются при истечении
+type leaseHeap []lease
+
+func (h leaseHeap) Len() int           { return len(h) }
+func (h leaseHeap) Less(i, j int) bool { return h[i].deadline.Before(h[j].deadline) }
+func (h leaseHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *leaseHeap) Push(x any)        { *h = append(*h, x.(lease)) }
+func (h *leaseHeap) Pop() any {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	*h = old[:n-1]
+	return item
+}
+
+// Выдает таске аренду по стоимости операции. Вызывать под блокировкой выражения
+func (s *Storage) lease(exprID int, task *entities.Task) time.Duration {
+	duration := s.cfg.LeaseTime(task.Operation)
+	task.LeaseDeadline = time.Now().Add(duration)
+
+	s.leaseMu.Lock()
+	defer s.leaseMu.Unlock()
+
+	heap.Push(&s.leases, lease{deadline: task.LeaseDeadline, exprID: exprID, taskID: task.ID})
+	// новая аренда истекает раньше всех - таймер надо перезавести
+	if s.leases[0].taskID == task.ID {
+		select {
+		case s.leaseWake <- struct{}{}:
+		default:
+		}
+	}
+	return duration
+}
+
+// Продлевает аренду таски. false - таска уже не считается этим агентом
+func (s *Storage) RenewLease(taskID, agentID string) (time.Duration, bool) {
+	exprID, _ := strconv.Atoi(strings.Split(taskID, "_")[0])
+	e := s.get(exprID)
+	if e == nil {
+		return 0, false
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	task := e.task(taskID)
+	if e.done || task == nil || task.Status != entities.InProgress || task.AgentID != agentID {
+		return 0, false
+	}
+	return s.lease(exprID, task), true
+}
+
+// Возвращает в очередь таски с истекшей арендой, спит до ближайшего срока
+func (s *Storage) StartLeases(db db.Repository) {
+	ctx := s.ctx
+
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+
+	for {
+		s.leaseMu.Lock()
+		wait := time.Hour
+		if len(s.leases) > 0 {
+			wait = time.Until(s.leases[0].deadline)
+		}
+		s.leaseMu.Unlock()
+		timer.Reset(wait)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.leaseWake:
+		case <-timer.C:
+			s.expireLeases(db)
+		}
+	}
+}
+
+func (s *Storage) expireLeases(db db.Repository) {
+	logger := logger.FromContext(s.ctx)
+
+	// забираем истекшие аренды, сами таски проверяем уже без s.leaseMu
+	var expired []lease
+	now := time.Now()
+	s.leaseMu.Lock()
+	for len(s.leases) > 0 && !s.leases[0].deadline.After(now) {
+		expired = append(expired, heap.Pop(&s.leases).(lease))
+	}
+	s.leaseMu.Unlock()
+
+	for _, item := range expired {
+		e := s.get(item.exprID)
+		if e == nil {
+			continue
+		}
+
+		e.mu.Lock()
+		// таска уже посчитана, вернулась в очередь или аренду продлили
+		task := e.task(item.taskID)
+		if e.done || task == nil || task.Status != entities.InProgress || !task.LeaseDeadline.Equal(item.deadline) {
+			e.mu.Unlock()
+			continue
+		}
+
+		logger.Info("Task lease expired", zap.String("task id", task.ID), zap.String("agent id", task.AgentID))
+		s.retryTask(db, e, task, entities.AttemptLeaseExpired)
+		e.mu.Unlock()
+	}
+}
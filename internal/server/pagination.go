@@ -0,0 +1,143 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/YattaDeSune/calc-project/internal/entities"
+)
+
+// Курсор списка выражений: позиция последнего выражения страницы и сортировка, для которой он выдан
+type expressionCursor struct {
+	Sort      string    `json:"s"`
+	Desc      bool      `json:"d"`
+	CreatedAt time.Time `json:"c"`
+	Priority  int       `json:"p"`
+	ID        int       `json:"id"`
+}
+
+func encodeCursor(filter *entities.ExpressionFilter, expr entities.ExpressionDB) (string, error) {
+	createdAt, err := time.Parse(time.RFC3339, expr.CreatedAt)
+	if err != nil {
+		return "", fmt.Errorf("invalid created_at %q: %w", expr.CreatedAt, err)
+	}
+
+	data, err := json.Marshal(expressionCursor{
+		Sort:      filter.Sort,
+		Desc:      filter.Desc,
+		CreatedAt: createdAt,
+		Priority:  expr.Priority,
+		ID:        expr.ID,
+	})
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+func decodeCursor(value string) (*expressionCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	var cursor expressionCursor
+	if err := json.Unmarshal(data, &cursor); err != nil {
+		return nil, err
+	}
+	return &cursor, nil
+}
+
+// статусы, по которым можно фильтровать выражения
+var expressionStatuses = []string{
+	entities.Accepted,
+	entities.InProgress,
+	entities.Completed,
+	entities.CompletedWithError,
+	entities.Cancelled,
+}
+
+// Параметры GET /expressions: limit, cursor, status (через запятую или несколько раз), from, to (RFC 3339),
+// q - подстрока выражения, sort (created_at, priority) и order (desc по умолчанию, asc)
+func parseExpressionFilter(query url.Values, cfg *Config) (*entities.ExpressionFilter, error) {
+	filter := &entities.ExpressionFilter{
+		Sort:  entities.ExpressionSortCreatedAt,
+		Desc:  true,
+		Limit: cfg.PageSize,
+	}
+
+	if value := query.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > cfg.MaxPageSize {
+			return nil, fmt.Errorf("limit must be from 1 to %d", cfg.MaxPageSize)
+		}
+		filter.Limit = limit
+	}
+
+	for _, value := range query["status"] {
+		for _, status := range strings.Split(value, ",") {
+			if !slices.Contains(expressionStatuses, status) {
+				return nil, fmt.Errorf("unknown status %q", status)
+			}
+			filter.Statuses = append(filter.Statuses, status)
+		}
+	}
+
+	for _, param := range []struct {
+		name string
+		dest **time.Time
+	}{
+		{"from", &filter.CreatedFrom},
+		{"to", &filter.CreatedTo},
+	} {
+		value := query.Get(param.name)
+		if value == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return nil, fmt.Errorf("%s must be RFC 3339 time", param.name)
+		}
+		*param.dest = &t
+	}
+
+	filter.Search = query.Get("q")
+
+	switch sort := query.Get("sort"); sort {
+	case "":
+	case entities.ExpressionSortCreatedAt, entities.ExpressionSortPriority:
+		filter.Sort = sort
+	default:
+		return nil, fmt.Errorf("unknown sort %q", sort)
+	}
+	switch order := query.Get("order"); order {
+	case "", "desc":
+	case "asc":
+		filter.Desc = false
+	default:
+		return nil, fmt.Errorf("unknown order %q", order)
+	}
+
+	if value := query.Get("cursor"); value != "" {
+		cursor, err := decodeCursor(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cursor")
+		}
+		// курсор другой сортировки указывает не на то место
+		if cursor.Sort != filter.Sort || cursor.Desc != filter.Desc {
+			return nil, fmt.Errorf("cursor was issued for another sort order")
+		}
+		filter.After = &entities.ExpressionCursor{
+			CreatedAt: cursor.CreatedAt,
+			Priority:  cursor.Priority,
+			ID:        cursor.ID,
+		}
+	}
+
+	return filter, nil
+}
@@ -0,0 +1,111 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/YattaDeSune/calc-project/internal/entities"
+)
+
+func TestGetExpressions_Pagination(t *testing.T) {
+	storage, database := newTestStorage(t)
+	storage.cfg.PageSize = 2
+	storage.cfg.MaxPageSize = 10
+	s := &Server{ctx: storage.ctx, cfg: storage.cfg, storage: storage, db: database}
+
+	// выражения пользователя 1 с приоритетами 0, 1, 2, 0, 1 и одно чужое
+	var ids []int
+	for i, expr := range []string{"1+2", "3*4", "5-6", "7+8", "9/3"} {
+		id, err := database.CreateExpression(s.ctx, 1, entities.Accepted, entities.NewExpression{Expression: expr, Priority: i % 3})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	if _, err := database.CreateExpression(s.ctx, 2, entities.Accepted, entities.NewExpression{Expression: "1+2"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := database.UpdateExpressionStatus(s.ctx, ids[1], entities.Cancelled); err != nil {
+		t.Fatal(err)
+	}
+
+	list := func(query url.Values) (int, GetExpressionsResponce) {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/expressions?"+query.Encode(), nil)
+		req = req.WithContext(context.WithValue(req.Context(), entities.UserIDKey, 1))
+		rec := httptest.NewRecorder()
+		s.GetExpressions(rec, req)
+
+		var resp GetExpressionsResponce
+		if rec.Code == http.StatusOK {
+			if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return rec.Code, resp
+	}
+	// все страницы подряд
+	listAll := func(query url.Values) []int {
+		var got []int
+		for page := 0; page < 10; page++ {
+			code, resp := list(query)
+			if code != http.StatusOK {
+				t.Fatalf("expected 200, got %d", code)
+			}
+			for _, expr := range resp.Expressions {
+				got = append(got, expr.ID)
+			}
+			if resp.NextCursor == "" {
+				return got
+			}
+			query.Set("cursor", resp.NextCursor)
+		}
+		t.Fatal("too many pages")
+		return nil
+	}
+
+	reversed := slices.Clone(ids)
+	slices.Reverse(reversed)
+	testCases := []struct {
+		name  string
+		query url.Values
+		want  []int
+	}{
+		{name: "newest first", query: url.Values{}, want: reversed},
+		{name: "oldest first", query: url.Values{"order": {"asc"}, "limit": {"3"}}, want: ids},
+		{name: "by priority", query: url.Values{"sort": {"priority"}}, want: []int{ids[2], ids[4], ids[1], ids[3], ids[0]}},
+		{name: "status", query: url.Values{"status": {"cancelled,completed"}}, want: []int{ids[1]}},
+		{name: "substring", query: url.Values{"q": {"+"}}, want: []int{ids[3], ids[0]}},
+		{name: "time range", query: url.Values{"from": {time.Now().Add(-time.Hour).Format(time.RFC3339)}, "to": {time.Now().Add(time.Hour).Format(time.RFC3339)}}, want: reversed},
+		{name: "future", query: url.Values{"from": {time.Now().Add(time.Hour).Format(time.RFC3339)}}, want: nil},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := listAll(tc.query); !slices.Equal(got, tc.want) {
+				t.Errorf("expected %v, got %v", tc.want, got)
+			}
+		})
+	}
+
+	_, first := list(url.Values{})
+	invalid := []url.Values{
+		{"limit": {"0"}},
+		{"limit": {"11"}},
+		{"status": {"done"}},
+		{"from": {"yesterday"}},
+		{"sort": {"result"}},
+		{"order": {"up"}},
+		{"cursor": {"???"}},
+		{"cursor": {first.NextCursor}, "order": {"asc"}},
+	}
+	for _, query := range invalid {
+		if code, _ := list(query); code != http.StatusBadRequest {
+			t.Errorf("%v: expected 400, got %d", query, code)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"sync"
+
+	"github.com/YattaDeSune/calc-project/internal/entities"
+)
+
+// Выражение в хранилище со своей блокировкой: агенты, работающие с разными выражениями, не мешают друг другу.
+// Под mu же идут записи в бд по этому выражению, чтобы они не обгоняли друг друга
+type expression struct {
+	mu sync.Mutex
+	*entities.Expression
+	index map[string]int // id таски -> индекс в Tasks
+	done  bool           // выражение досчитано или отменено, его таски в очереди пропускаются
+	// таски выражения в очереди готовых, под Storage.mu
+	queued int
+}
+
+func newExpression(expr *entities.Expression) *expression {
+	e := &expression{
+		Expression: expr,
+		index:      make(map[string]int, len(expr.Tasks)),
+	}
+	for i, task := range expr.Tasks {
+		e.index[task.ID] = i
+	}
+	return e
+}
+
+// Таска по id, nil - такой таски у выражения нет. Вызывать под e.mu
+func (e *expression) task(id string) *entities.Task {
+	i, ok := e.index[id]
+	if !ok {
+		return nil
+	}
+	return e.Tasks[i]
+}
+
+// Таска, готовая к выдаче агенту
+type readyTask struct {
+	expr  *expression
+	index int
+}
+
+// FIFO очередь, push и pop за O(1) (амортизированно)
+type queue[T any] struct {
+	items []T
+	head  int
+}
+
+func (q *queue[T]) push(item T) {
+	q.items = append(q.items, item)
+}
+
+func (q *queue[T]) pop() (T, bool) {
+	var zero T
+	if q.head == len(q.items) {
+		return zero, false
+	}
+
+	item := q.items[q.head]
+	q.items[q.head] = zero // не держим ссылку на прочитанное
+	q.head++
+
+	switch {
+	case q.head == len(q.items):
+		q.items = q.items[:0]
+		q.head = 0
+	case q.head > len(q.items)/2:
+		// прочитанная часть больше половины - сдвигаем, память не растет бесконечно
+		n := copy(q.items, q.items[q.head:])
+		clear(q.items[n:])
+		q.items = q.items[:n]
+		q.head = 0
+	}
+	return item, true
+}
+
+func (q *queue[T]) len() int {
+	return len(q.items) - q.head
+}
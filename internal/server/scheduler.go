@@ -0,0 +1,102 @@
+package server
+
+import "container/heap"
+
+// Планировщик готовых тасок: пользователи обслуживаются по кругу, а таски каждого пользователя -
+// по приоритету, при равном приоритете в порядке поступления.
+// Тысячи выражений одного пользователя не задерживают остальных
+type scheduler struct {
+	users map[int]*userTasks // готовые таски пользователей
+	turn  queue[int]         // пользователи с готовыми тасками в порядке очереди
+	size  int
+}
+
+func newScheduler() *scheduler {
+	return &scheduler{users: make(map[int]*userTasks)}
+}
+
+func (s *scheduler) push(userID, priority int, task readyTask) {
+	tasks, ok := s.users[userID]
+	if !ok {
+		tasks = &userTasks{queues: make(map[int]*queue[readyTask])}
+		s.users[userID] = tasks
+		// пользователь встает в конец круга
+		s.turn.push(userID)
+	}
+
+	tasks.push(priority, task)
+	s.size++
+}
+
+// Таска пользователя, чья сейчас очередь
+func (s *scheduler) pop() (readyTask, bool) {
+	userID, ok := s.turn.pop()
+	if !ok {
+		return readyTask{}, false
+	}
+
+	tasks := s.users[userID]
+	task := tasks.pop()
+	if tasks.len() > 0 {
+		s.turn.push(userID)
+	} else {
+		delete(s.users, userID)
+	}
+	s.size--
+	return task, true
+}
+
+func (s *scheduler) len() int {
+	return s.size
+}
+
+// Готовые таски пользователя: своя FIFO очередь на каждый приоритет.
+// Разных приоритетов немного (не больше MaxPriority+1), поэтому push и pop не зависят от количества тасок
+type userTasks struct {
+	queues     map[int]*queue[readyTask]
+	priorities priorityHeap // приоритеты с непустыми очередями
+	size       int
+}
+
+func (u *userTasks) push(priority int, task readyTask) {
+	q, ok := u.queues[priority]
+	if !ok {
+		q = &queue[readyTask]{}
+		u.queues[priority] = q
+		heap.Push(&u.priorities, priority)
+	}
+	q.push(task)
+	u.size++
+}
+
+// Первая таска с наибольшим приоритетом. Вызывать только при len() > 0
+func (u *userTasks) pop() readyTask {
+	priority := u.priorities[0]
+	q := u.queues[priority]
+	task, _ := q.pop()
+	if q.len() == 0 {
+		heap.Pop(&u.priorities)
+		delete(u.queues, priority)
+	}
+	u.size--
+	return task
+}
+
+func (u *userTasks) len() int {
+	return u.size
+}
+
+// Куча приоритетов, сверху - наибольший
+type priorityHeap []int
+
+func (h priorityHeap) Len() int           { return len(h) }
+func (h priorityHeap) Less(i, j int) bool { return h[i] > h[j] }
+func (h priorityHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *priorityHeap) Push(x any)        { *h = append(*h, x.(int)) }
+func (h *priorityHeap) Pop() any {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	*h = old[:n-1]
+	return item
+}
@@ -0,0 +1,84 @@
+package server
+
+import (
+	"slices"
+	"testing"
+)
+
+// Выбирает все таски, возвращает индексы в порядке выдачи
+func drain(s *scheduler) []int {
+	var order []int
+	for {
+		task, ok := s.pop()
+		if !ok {
+			return order
+		}
+		order = append(order, task.index)
+	}
+}
+
+func TestScheduler_RoundRobin(t *testing.T) {
+	s := newScheduler()
+	// у первого пользователя много тасок, у второго и третьего - по одной-две
+	for i := 0; i < 5; i++ {
+		s.push(1, 0, readyTask{index: 100 + i})
+	}
+	s.push(2, 0, readyTask{index: 200})
+	s.push(2, 0, readyTask{index: 201})
+	s.push(3, 0, readyTask{index: 300})
+
+	want := []int{100, 200, 300, 101, 201, 102, 103, 104}
+	if got := drain(s); !slices.Equal(got, want) {
+		t.Errorf("expected %v, but got %v", want, got)
+	}
+	if s.len() != 0 {
+		t.Errorf("expected empty scheduler, got %d", s.len())
+	}
+}
+
+func TestScheduler_Priority(t *testing.T) {
+	s := newScheduler()
+	s.push(1, 0, readyTask{index: 1})
+	s.push(1, 5, readyTask{index: 2})
+	s.push(1, 0, readyTask{index: 3})
+	s.push(1, 5, readyTask{index: 4})
+	s.push(1, 10, readyTask{index: 5})
+
+	// больший приоритет раньше, при равном - в порядке поступления
+	want := []int{5, 2, 4, 1, 3}
+	if got := drain(s); !slices.Equal(got, want) {
+		t.Errorf("expected %v, but got %v", want, got)
+	}
+}
+
+// Приоритет действует только внутри пользователя и не дает обогнать других
+func TestScheduler_PriorityDoesNotStarveOthers(t *testing.T) {
+	s := newScheduler()
+	s.push(1, 0, readyTask{index: 10})
+	s.push(2, 100, readyTask{index: 20})
+	s.push(2, 100, readyTask{index: 21})
+	s.push(1, 0, readyTask{index: 11})
+
+	want := []int{10, 20, 11, 21}
+	if got := drain(s); !slices.Equal(got, want) {
+		t.Errorf("expected %v, but got %v", want, got)
+	}
+}
+
+// Пользователь, у которого кончились таски, встает в конец круга при следующей таске
+func TestScheduler_UserRejoins(t *testing.T) {
+	s := newScheduler()
+	s.push(1, 0, readyTask{index: 10})
+	s.push(2, 0, readyTask{index: 20})
+	s.push(2, 0, readyTask{index: 21})
+
+	if task, _ := s.pop(); task.index != 10 {
+		t.Fatalf("expected 10, got %d", task.index)
+	}
+	s.push(1, 0, readyTask{index: 11})
+
+	want := []int{20, 11, 21}
+	if got := drain(s); !slices.Equal(got, want) {
+		t.Errorf("expected %v, but got %v", want, got)
+	}
+}
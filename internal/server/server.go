@@ -12,108 +12,98 @@ import (
 	"github.com/YattaDeSune/calc-project/internal/middleware"
 	pb "github.com/YattaDeSune/calc-project/internal/proto"
 	"github.com/gorilla/mux"
-	"github.com/ilyakaznacheev/cleanenv"
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
 )
 
-type Config struct {
-	HTTPPort string `env:"HTTP_SERVER_PORT"`
-	GRPCPort string `env:"GRPC_SERVER_PORT"`
+type Server struct {
+	pb.TaskServiceServer
+	cfg       *Config
+	storage   *Storage
+	agents    *Agents
+	db        db.Repository
+	ctx       context.Context
+	jwt       *auth.JWTManager
+	callbacks *callbackPolicy // куда можно слать вебхуки
 }
 
-func GetCfgFromEnv(ctx context.Context) *Config {
+func New(ctx context.Context) *Server {
 	logger := logger.FromContext(ctx)
 
-	var cfg Config
-
-	err := cleanenv.ReadConfig(".env", &cfg)
+	cfg := GetCfgFromEnv(ctx)
 
-	httpPort := "8081"
-	grpcPort := "9090"
+	db, err := db.New(ctx, cfg.DatabaseDSN)
 	if err != nil {
-		logger.Error("Error loading config, loaded default values",
-			zap.Error(err),
-			zap.String("httpPort", httpPort),
-			zap.String("grpcPort", grpcPort),
-		)
-		return &Config{
-			HTTPPort: httpPort,
-			GRPCPort: grpcPort,
-		}
+		logger.Fatal("Failed to create db", zap.Error(err))
 	}
 
-	if cfg.HTTPPort == "" || cfg.GRPCPort == "" {
-		logger.Error("Empty ports, using default config values",
-			zap.Error(err),
-			zap.String("httpPort", httpPort),
-			zap.String("grpcPort", grpcPort),
-		)
-		return &Config{
-			HTTPPort: "8081",
-			GRPCPort: "9090",
+	keys, err := cfg.jwtKeys()
+	if err != nil {
+		logger.Fatal("Failed to load JWT keys", zap.Error(err))
+	}
+	if len(keys) == 0 {
+		key, err := auth.GenerateKey()
+		if err != nil {
+			logger.Fatal("Failed to generate JWT key", zap.Error(err))
 		}
+		logger.Warn("JWT keys are not configured, tokens will become invalid after restart")
+		keys = []auth.Key{key}
 	}
-
-	logger.Info("Config loaded", zap.String("httpPort", cfg.HTTPPort), zap.String("grpcPort", cfg.GRPCPort))
-	return &cfg
-}
-
-type Server struct {
-	pb.TaskServiceServer
-	cfg     *Config
-	storage *Storage
-	db      *db.Database
-	ctx     context.Context
-	jwt     *auth.JWTManager
-}
-
-func New(ctx context.Context) *Server {
-	logger := logger.FromContext(ctx)
-
-	db, err := db.New(ctx)
+	jwt, err := auth.NewJWTManager(keys, time.Duration(cfg.JWTTTLH)*time.Hour)
 	if err != nil {
-		logger.Fatal("Failed to create db", zap.Error(err))
+		logger.Fatal("Failed to create JWT manager", zap.Error(err))
 	}
+	logger.Info("JWT keys loaded", zap.String("signingKey", keys[0].ID), zap.Int("keys", len(keys)))
 
-	return &Server{
-		cfg:     GetCfgFromEnv(ctx),
-		storage: NewStorage(ctx),
-		ctx:     ctx,
-		db:      db,
+	callbacks, err := newCallbackPolicy(cfg.WebhookAllowedHosts)
+	if err != nil {
+		logger.Fatal("Failed to parse webhook allowed hosts", zap.Error(err))
+	}
 
-		// безопасность придумают завтра)
-		jwt: auth.NewJWTManager("smeshariki2005", 24*time.Hour),
+	// Продолжаем вычисления, прерванные перезапуском
+	storage := NewStorage(ctx, cfg)
+	if err := storage.Restore(db); err != nil {
+		logger.Fatal("Failed to restore storage", zap.Error(err))
 	}
-}
 
-// Проверка тасок на "живучесть", костыльная защита от падения агента
-func (s *Server) StartRecover() {
-	ctx := s.ctx
-	func() {
-		for {
-			// Каждую минуту проверяем таски
-			time.Sleep(time.Minute)
-			s.storage.CheckAndRecoverTasks(ctx)
-		}
-	}()
+	return &Server{
+		cfg:       cfg,
+		storage:   storage,
+		agents:    NewAgents(ctx),
+		ctx:       ctx,
+		db:        db,
+		jwt:       jwt,
+		callbacks: callbacks,
+	}
 }
 
 func (s *Server) RunServer() error {
 	ctx := s.ctx
 	logger := logger.FromContext(ctx)
 
-	// Фоновая проверка раз в минуту
-	go s.StartRecover()
+	// Таски с истекшей арендой возвращаем в очередь
+	go s.storage.StartLeases(s.db)
+	// Таски умерших агентов возвращаем сразу
+	go s.StartAgentsWatcher()
+	// Вебхуки о завершенных выражениях
+	go s.StartWebhooks()
 
 	r := mux.NewRouter()
 
 	r.HandleFunc("/api/v1/register", s.Register).Methods("POST")
 	r.HandleFunc("/api/v1/login", s.Login).Methods("POST")
 
-	r.HandleFunc("/api/v1/calculate", s.AddExpression).Methods("POST")
+	r.HandleFunc("/api/v1/calculate", s.Idempotent(s.AddExpression)).Methods("POST")
+	r.HandleFunc("/api/v1/calculate/batch", s.Idempotent(s.AddExpressionsBatch)).Methods("POST")
 	r.HandleFunc("/api/v1/expressions", s.GetExpressions).Methods("GET")
+	r.HandleFunc("/api/v1/expressions/query", s.QueryExpressions).Methods("POST")
 	r.HandleFunc("/api/v1/expressions/{id}", s.GetExpressionByID).Methods("GET")
+	r.HandleFunc("/api/v1/expressions/{id}", s.CancelExpression).Methods("DELETE")
+	r.HandleFunc("/api/v1/expressions/{id}/cancel", s.CancelExpression).Methods("POST")
+	r.HandleFunc("/api/v1/expressions/{id}/attempts", s.GetExpressionAttempts).Methods("GET")
+	r.HandleFunc("/api/v1/expressions/{id}/events", s.ExpressionEvents).Methods("GET")
+	r.HandleFunc("/api/v1/expressions/{id}/ws", s.ExpressionWebSocket).Methods("GET")
+	r.HandleFunc("/api/v1/me/quota", s.GetQuota).Methods("GET")
 
 	mux := middleware.AccessLog(ctx, r)
 	mux = middleware.AuthMiddleware(ctx, *s.jwt, mux)
@@ -10,6 +10,7 @@ import (
 
 	"github.com/YattaDeSune/calc-project/internal/db"
 	"github.com/YattaDeSune/calc-project/internal/entities"
+	"github.com/YattaDeSune/calc-project/internal/errors"
 	"github.com/YattaDeSune/calc-project/internal/logger"
 	pb "github.com/YattaDeSune/calc-project/internal/proto"
 	"github.com/YattaDeSune/calc-project/pkg/calculation"
@@ -17,202 +18,586 @@ import (
 	"go.uber.org/zap"
 )
 
-// Содержит в себе выражения для вычислений
+// Содержит в себе выражения для вычислений.
+// Порядок блокировок: expression.mu -> s.mu / s.leaseMu, под s.mu и s.leaseMu в бд не ходим
 type Storage struct {
-	mu   *sync.Mutex
-	data map[int]*entities.Expression
-	ctx  context.Context
+	mu    *sync.Mutex // data, ready, wake и счетчики квот
+	data  map[int]*expression
+	ready *scheduler
+	// таски снятых выражений, которые еще лежат в ready и будут пропущены при выдаче
+	stale int
+	// выражения в работе по пользователям и всего, вместе с зарезервированными (см. Reserve)
+	pending map[int]int
+	total   int
+	// подписчики на события выражений, см. events.go
+	events *Hub
+	ctx    context.Context
+	cfg    *Config
+	// закрывается, когда появляются новые таски для агентов
+	wake chan struct{}
+
+	// аренды выданных тасок, см. StartLeases
+	leaseMu   *sync.Mutex
+	leases    leaseHeap
+	leaseWake chan struct{}
 }
 
-func NewStorage(ctx context.Context) *Storage {
+func NewStorage(ctx context.Context, cfg *Config) *Storage {
 	return &Storage{
-		mu:   &sync.Mutex{},
-		data: make(map[int]*entities.Expression),
-		ctx:  ctx,
+		mu:        &sync.Mutex{},
+		data:      make(map[int]*expression),
+		ready:     newScheduler(),
+		pending:   make(map[int]int),
+		events:    NewHub(),
+		ctx:       ctx,
+		cfg:       cfg,
+		wake:      make(chan struct{}),
+		leaseMu:   &sync.Mutex{},
+		leaseWake: make(chan struct{}, 1),
 	}
 }
 
-// EXPRESSIONS
-func (s *Storage) AddExpression(db *db.Database, id int, expr string) {
-	ctx := s.ctx
-	logger := logger.FromContext(ctx)
+// Канал, который закроется при появлении новых тасок.
+// Брать до GetTaskForAgent, чтобы не пропустить таску между проверкой и ожиданием
+func (s *Storage) Wake() <-chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.wake
+}
+
+// Будит всех, кто ждет тасок. Вызывать под s.mu
+func (s *Storage) notify() {
+	close(s.wake)
+	s.wake = make(chan struct{})
+}
+
+// Ставит таску в очередь готовых
+func (s *Storage) push(e *expression, index int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.enqueue(e, index)
+	s.notify()
+}
+
+// Вызывать под s.mu
+func (s *Storage) enqueue(e *expression, index int) {
+	s.ready.push(e.UserID, e.Priority, readyTask{expr: e, index: index})
+	e.queued++
+	if s.data[e.ID] != e {
+		s.stale++
+	}
+}
+
+// Следующая таска из очереди, в том числе снятого выражения. Вызывать под s.mu
+func (s *Storage) dequeue() (readyTask, bool) {
+	ready, ok := s.ready.pop()
+	if !ok {
+		return ready, false
+	}
+	ready.expr.queued--
+	if s.data[ready.expr.ID] != ready.expr {
+		s.stale--
+	}
+	return ready, true
+}
+
+func (s *Storage) get(id int) *expression {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.data[id]
+}
+
+// Добавляет выражение и ставит в очередь его готовые таски
+func (s *Storage) add(e *expression) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.data[e.ID] = e
+	for i, task := range e.Tasks {
+		if task.Status == entities.Accepted {
+			s.enqueue(e, i)
+		}
+	}
+	s.notify()
+}
+
+// Снимает выражение с вычисления. Вызывать под e.mu.
+// Его таски остаются в очереди и пропускаются при выдаче, чтобы не перебирать очередь
+func (s *Storage) finish(e *expression) {
+	e.done = true
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.data, e.ID)
+	s.stale += e.queued
+	s.count(e.UserID, -1)
+}
+
+// Меняет счетчики выражений в работе. Вызывать под s.mu
+func (s *Storage) count(userID, delta int) {
+	s.pending[userID] += delta
+	if s.pending[userID] <= 0 {
+		delete(s.pending, userID)
+	}
+	s.total += delta
+}
+
+// Резервирует место под новое выражение пользователя.
+// Возвращает errors.ErrUserQuota или errors.ErrServerQuota, если лимит выражений в работе исчерпан (0 - без лимита)
+func (s *Storage) Reserve(userID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
+	if s.cfg.MaxPendingPerUser > 0 && s.pending[userID] >= s.cfg.MaxPendingPerUser {
+		return errors.ErrUserQuota
+	}
+	if s.cfg.MaxPendingTotal > 0 && s.total >= s.cfg.MaxPendingTotal {
+		return errors.ErrServerQuota
+	}
+	s.count(userID, 1)
+	return nil
+}
+
+// Освобождает место, зарезервированное под выражение, которое так и не попало в хранилище
+func (s *Storage) Release(userID int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.count(userID, -1)
+}
+
+// Выражения пользователя в работе и всего на оркестраторе
+func (s *Storage) Usage(userID int) (pending, total int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.pending[userID], s.total
+}
+
+// Количество тасок в очереди, без тасок снятых выражений
+func (s *Storage) ReadyLen() int {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	// Вычисление ОПН для выражения
-	RPN, err := calculation.ToRPN(calculation.Tokenize(expr))
-	// Если при создании ОПН найдена ошибка - не проводим вычисления и ставим результатом ошибку
+	return s.ready.len() - s.stale
+}
+
+// EXPRESSIONS
+
+// Добавляет выражение, RPN - уже разобранное выражение (calculation.Parse).
+// У expression должны быть заполнены ID, Expression, UserID и Priority,
+// Precision != nil - точные вычисления с заданным округлением.
+// Место под выражение должно быть зарезервировано (Reserve), при ошибке оно освобождается
+func (s *Storage) AddExpression(db db.Repository, expression *entities.Expression, RPN []string) {
+	ctx := s.ctx
+	logger := logger.FromContext(ctx)
+	id := expression.ID
+
+	// Разбиваем ОПН на граф тасок, независимые таски сразу готовы к вычислению
+	nodes, err := calculation.BuildTasks(RPN)
 	if err != nil {
 		// меняем результат в бд
-		if errdb := db.UpdateExpressionResult(ctx, id, err.Error(), entities.CompletedWithError); errdb != nil {
+		if errdb := db.UpdateExpressionError(ctx, id, entities.ErrorCodeInvalidExpression, err.Error()); errdb != nil {
 			logger.Error("Failed to update expression result", zap.Error(errdb), zap.Int("id", id))
-			return
 		}
+		s.Release(expression.UserID)
 		logger.Info("End with RPN error", zap.Error(err))
 		return
 	}
 
-	// Создание стека для хранения состояния вычислений
-	stack := make([]string, 0)
-	// Вычисление первой таски, и сохранение состояния (новая ОПН и новый стек ДО вычисление самой таски)
-	arg1, arg2, operation, newRPN, newStack, err := calculation.NextTask(RPN, stack)
+	expression.Status = entities.Accepted // Выражение принято
+	expression.Tasks = newTasks(id, nodes, expression.Precision)
+	// сохраняем состояние в бд, чтобы пережить перезапуск. Выражение еще никому не видно, блокировка не нужна
+	if errdb := db.CreateTasks(ctx, id, expression.Tasks); errdb != nil {
+		logger.Error("Failed to save expression tasks", zap.Error(errdb), zap.Int("id", id))
+	}
+	s.add(newExpression(expression))
+	logger.Info("Add expression tasks", zap.Int("id", id), zap.Int("tasks", len(expression.Tasks)))
+}
+
+// Восстанавливает из бд выражения, которые не успели досчитаться до перезапуска
+func (s *Storage) Restore(db db.Repository) error {
+	ctx := s.ctx
+	logger := logger.FromContext(ctx)
+
+	// агенты, которые считали таски до перезапуска, уже не считаются живыми
+	if err := db.FinishOpenTaskAttempts(ctx, entities.AttemptRestarted); err != nil {
+		return err
+	}
+
+	expressions, err := db.GetUnfinishedExpressions(ctx)
 	if err != nil {
-		// меняем результат в бд
-		if errdb := db.UpdateExpressionResult(ctx, id, err.Error(), entities.CompletedWithError); errdb != nil {
-			logger.Error("Failed to update expression result", zap.Error(errdb), zap.Int("id", id))
-			return
+		return err
+	}
+
+	for _, expr := range expressions {
+		// восстановленные выражения занимают квоты без проверки лимитов: они уже были приняты
+		s.mu.Lock()
+		s.count(expr.UserID, 1)
+		s.mu.Unlock()
+
+		// Оркестратор упал до сохранения тасок - считаем выражение заново с теми же переменными
+		if len(expr.Tasks) == 0 {
+			RPN, err := calculation.Parse(expr.Expression)
+			if err == nil {
+				RPN, err = calculation.Bind(RPN, expr.Variables)
+			}
+			// Если при создании ОПН найдена ошибка - не проводим вычисления и ставим результатом ошибку
+			if err != nil {
+				if errdb := db.UpdateExpressionError(ctx, expr.ID, entities.ErrorCodeInvalidExpression, err.Error()); errdb != nil {
+					logger.Error("Failed to update expression result", zap.Error(errdb), zap.Int("id", expr.ID))
+				}
+				s.Release(expr.UserID)
+				continue
+			}
+			s.AddExpression(db, expr, RPN)
+			continue
 		}
-		logger.Info("End with RPN error", zap.Error(err))
-		return
+
+		// Результаты тасок "в прогрессе" потеряны вместе с агентами, отдаем их заново
+		for _, task := range expr.Tasks {
+			if task.Status == entities.InProgress {
+				task.Status = entities.Accepted
+			}
+		}
+
+		s.add(newExpression(expr))
+		logger.Info("Expression restored", zap.Int("id", expr.ID), zap.Int("tasks", len(expr.Tasks)))
 	}
 
-	// Добавление в хранилище выражения с первой таской
-	tasks := make([]*entities.Task, 0)
-	taskID := fmt.Sprintf("%d_%s", id, uuid.New().String())
-	task := &entities.Expression{
-		ID:         id,
-		Expression: expr,
-		Status:     entities.Accepted, // Выражение принято
-		RPN:        newRPN,
-		Stack:      newStack,
-		Tasks: append(tasks, &entities.Task{
-			ID:        taskID,
-			Arg1:      arg1,
-			Arg2:      arg2,
-			Operation: operation,
+	return nil
+}
+
+// Создает таски выражения по графу: таски без зависимостей принимаются сразу, остальные ждут операнды
+func newTasks(exprID int, nodes []calculation.TaskNode, precision *entities.Precision) []*entities.Task {
+	tasks := make([]*entities.Task, len(nodes))
+	for i, node := range nodes {
+		task := &entities.Task{
+			ID:        fmt.Sprintf("%d_%s", exprID, uuid.New().String()),
+			Args:      make([]string, len(node.Args)),
+			Operation: node.Operation,
 			Status:    entities.Accepted, // Таска принята
-		}),
+			Parent:    -1,
+			Precision: precision,
+		}
+		for j, arg := range node.Args {
+			if arg.Task < 0 {
+				task.Args[j] = arg.Value
+				continue
+			}
+			// Операнд - результат другой таски, ждем его
+			tasks[arg.Task].Parent = i
+			tasks[arg.Task].ParentArg = j
+			task.Pending++
+		}
+		if task.Pending > 0 {
+			task.Status = entities.Waiting
+		}
+		tasks[i] = task
+	}
+
+	return tasks
+}
+
+// Отменяет выражение: убирает его из хранилища и помечает в бд.
+// false - выражение уже завершено
+func (s *Storage) CancelExpression(db db.Repository, id int) (bool, error) {
+	ctx := s.ctx
+	logger := logger.FromContext(ctx)
+
+	// выражения может не быть в хранилище, а в бд оно еще висит - отменяем в любом случае
+	e := s.get(id)
+	if e != nil {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+	}
+
+	cancelled, err := db.CancelExpression(ctx, id)
+	if err != nil {
+		return false, err
+	}
+	// таски, которые сейчас считают агенты, досчитаются, но результат будет проигнорирован
+	if e != nil && !e.done {
+		s.finish(e)
 	}
-	s.data[id] = task
-	logger.Info("Add first task", zap.Any("task", task))
+	if cancelled {
+		s.events.Publish(Event{Type: EventResult, ExpressionID: id, Status: entities.Cancelled})
+	}
+
+	logger.Info("Expression cancelled", zap.Int("id", id), zap.Bool("was computing", cancelled))
+	return cancelled, nil
+}
+
+// Копия тасок выражения, nil если выражение уже не вычисляется
+func (s *Storage) GetTasks(id int) []entities.Task {
+	e := s.get(id)
+	if e == nil {
+		return nil
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.done {
+		return nil
+	}
+	tasks := make([]entities.Task, 0, len(e.Tasks))
+	for _, task := range e.Tasks {
+		tasks = append(tasks, *task)
+	}
+	return tasks
 }
 
 // TASKS
 
-// Меняем результат таски и запускаем следующую таску, либо добавляем результат выражения
-func (s *Storage) SubmitTaskResult(db *db.Database, result *pb.SubmitResultRequest) {
+// Меняем результат таски и запускаем следующую таску, либо добавляем результат выражения.
+// errors.ErrTaskNotLeased - таска выдана другому агенту. Опоздавший результат просто пропускается
+func (s *Storage) SubmitTaskResult(db db.Repository, result *pb.SubmitResultRequest) error {
 	ctx := s.ctx
 	logger := logger.FromContext(ctx)
 
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
 	exprIDstr := strings.Split(result.Id, "_")[0]
 	exprID, _ := strconv.Atoi(exprIDstr)
-	expression, ok := s.data[exprID]
-	if !ok {
-		logger.Error("Invalid expression id")
-		return
+	expression := s.get(exprID)
+	if expression == nil {
+		// выражение уже досчитано или отменено - результат опоздал
+		logger.Info("Expression is not computing, ignoring result", zap.String("id", result.Id))
+		return nil
+	}
+
+	expression.mu.Lock()
+	defer expression.mu.Unlock()
+
+	if expression.done {
+		logger.Info("Expression is not computing, ignoring result", zap.String("id", result.Id))
+		return nil
+	}
+
+	task := expression.task(result.Id)
+	if task == nil {
+		logger.Error("Invalid task id", zap.String("id", result.Id))
+		return nil
 	}
 
 	// Если таска не "в прогрессе", значит либо она уже посчиталась, либо вернулась и посчитается позже
-	if expression.Tasks[len(expression.Tasks)-1].Status != entities.InProgress {
+	if task.Status != entities.InProgress {
 		logger.Info("Task is not in progress, ignoring result", zap.String("id", result.Id))
-		return
+		return nil
+	}
+
+	// результат принимаем только от агента, которому выдана таска
+	if task.AgentID != result.AgentId {
+		logger.Warn("Task is leased by another agent, rejecting result", zap.String("id", result.Id), zap.String("agent id", result.AgentId))
+		return errors.ErrTaskNotLeased
+	}
+
+	outcome := entities.AttemptCompleted
+	if result.Error != "" {
+		outcome = entities.AttemptFailed
+	}
+	if errdb := db.FinishTaskAttempt(ctx, task.ID, task.Attempts, outcome, result.Error); errdb != nil {
+		logger.Error("Failed to finish task attempt", zap.Error(errdb), zap.String("id", task.ID))
 	}
 
 	// Если таска пришла с ошибкой, добавляем результат выражения
 	if result.Error != "" {
 		// меняем результат в бд
-		if errdb := db.UpdateExpressionResult(ctx, exprID, result.Error, entities.CompletedWithError); errdb != nil {
+		if errdb := db.UpdateExpressionError(ctx, exprID, entities.ErrorCodeComputation, result.Error); errdb != nil {
 			logger.Error("Failed to update expression result", zap.Error(errdb), zap.Int("id", exprID))
-			return
+			return nil
 		}
 		// сносим выражение локально
-		delete(s.data, exprID)
+		s.finish(expression)
+		s.publish(expression, Event{
+			Type:         EventResult,
+			Status:       entities.CompletedWithError,
+			ErrorCode:    entities.ErrorCodeComputation,
+			ErrorMessage: result.Error,
+		})
 
 		logger.Info("Task error, expression completed with error", zap.Int("expression id", expression.ID))
-		return
+		return nil
+	}
+
+	task.Status = entities.Completed
+	task.Result = result.Result
+	task.LastUpdated = time.Now()
+	value := fmt.Sprint(result.Result)
+	// в точном режиме передаем дальше десятичную строку, а не double
+	if expression.Precision != nil {
+		task.Result = result.ExactResult
+		value = result.ExactResult
 	}
 
-	// Если стек и ОПН пусты, добавляем результат выражения
-	if len(expression.Stack) == 0 && len(expression.RPN) == 0 {
+	// Если это последняя таска, добавляем результат выражения
+	if task.Parent < 0 {
 		// меняем результат в бд
-		if errdb := db.UpdateExpressionResult(ctx, exprID, result.Result, entities.Completed); errdb != nil {
+		var errdb error
+		if expression.Precision != nil {
+			errdb = db.UpdateExpressionExactResult(ctx, exprID, result.ExactResult, result.Result)
+		} else {
+			errdb = db.UpdateExpressionResult(ctx, exprID, result.Result)
+		}
+		if errdb != nil {
 			logger.Error("Failed to update expression result", zap.Error(errdb), zap.Int("id", exprID))
-			return
+			return nil
 		}
 		// сносим выражение локально
-		delete(s.data, exprID)
+		s.finish(expression)
+		s.publishTask(expression, task)
+		event := Event{Type: EventResult, Status: entities.Completed, Result: result.Result}
+		if expression.Precision != nil {
+			event.ExactResult = &result.ExactResult
+		}
+		s.publish(expression, event)
 
 		logger.Info("Tasks completed, expression completed", zap.Int("expression id", expression.ID))
-		return
+		return nil
 	}
 
-	// Если стек не пуст, продолжаем вычислять выражение
-	s.data[exprID].Stack = append(expression.Stack, fmt.Sprint(result.Result))
-
-	arg1, arg2, operation, newRPN, newStack, err := calculation.NextTask(expression.RPN, expression.Stack)
-	if err != nil {
-		// меняем результат в бд
-		if errdb := db.UpdateExpressionResult(ctx, exprID, err.Error(), entities.CompletedWithError); errdb != nil {
-			logger.Error("Failed to update expression result", zap.Error(errdb), zap.Int("id", exprID))
-			return
-		}
-		// сносим выражение локально
-		delete(s.data, exprID)
+	// Передаем результат ожидающей таске, если у нее собраны все операнды - она готова к вычислению
+	parent := expression.Tasks[task.Parent]
+	parent.Args[task.ParentArg] = value
+	parent.Pending--
+	if parent.Pending == 0 {
+		parent.Status = entities.Accepted // Таска принята
+		parent.LastUpdated = time.Now()
+	}
 
-		logger.Info("End with RPN error", zap.Error(err))
-		return
+	if errdb := db.CompleteTask(ctx, task, parent); errdb != nil {
+		logger.Error("Failed to save task result", zap.Error(errdb), zap.String("id", task.ID))
 	}
+	s.publishTask(expression, task)
 
-	// Добавляем новую таску
-	taskID := fmt.Sprintf("%d_%s", expression.ID, uuid.New().String())
-	expression.Tasks = append(expression.Tasks, &entities.Task{
-		ID:        taskID,
-		Arg1:      arg1,
-		Arg2:      arg2,
-		Operation: operation,
-		Status:    entities.Accepted, // Таска принята
-	})
-	expression.RPN = newRPN
-	expression.Stack = newStack
-	logger.Info("Add task", zap.Any("task", expression.Tasks[len(expression.Tasks)-1]))
+	// отдать таску агенту можно только после записи в бд, иначе она обгонит результат
+	if parent.Pending == 0 {
+		s.push(expression, task.Parent)
+		logger.Info("Task ready", zap.Any("task", parent))
+	}
+	return nil
 }
 
-// Ищем таску для агента
-func (s *Storage) GetTaskForAgent(db *db.Database) *entities.Task {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
+// Ищем таску для агента, agentID пустой у незарегистрированных агентов.
+// Возвращает копию таски, nil - готовых тасок нет
+func (s *Storage) GetTaskForAgent(db db.Repository, agentID string) *entities.Task {
 	logger := logger.FromContext(s.ctx)
 
-	for _, expr := range s.data {
-		for _, task := range expr.Tasks {
-			if task.Status == entities.Accepted {
-				task.Status = entities.InProgress // таска принята в работу
-				task.LastUpdated = time.Now()
-				expr.Status = entities.InProgress // выражение принято в работу
-				// меняем статус в бд
-				if errdb := db.UpdateExpressionStatus(s.ctx, expr.ID, entities.InProgress); errdb != nil {
-					logger.Error("Failed to update expression result", zap.Error(errdb), zap.Int("id", expr.ID))
-					return nil
-				}
+	for {
+		s.mu.Lock()
+		ready, ok := s.dequeue()
+		s.mu.Unlock()
+		if !ok {
+			return nil
+		}
+
+		expr := ready.expr
+		expr.mu.Lock()
+		task := expr.Tasks[ready.index]
+		// выражение сняли, пока таска ждала в очереди
+		if expr.done || task.Status != entities.Accepted {
+			expr.mu.Unlock()
+			continue
+		}
+
+		task.Status = entities.InProgress // таска принята в работу
+		task.AgentID = agentID
+		task.Attempts++
+		task.LastUpdated = time.Now()
+		s.lease(expr.ID, task)
 
-				return task
+		started := expr.Status != entities.InProgress
+		if started {
+			expr.Status = entities.InProgress // выражение принято в работу
+			s.publish(expr, Event{Type: EventStatus, Status: entities.InProgress})
+		}
+		s.publishTask(expr, task)
+
+		taken := *task
+		expr.mu.Unlock()
+
+		// в бд пишем уже без блокировки выражения. Агент получит таску только после записи,
+		// поэтому его результат попытку не обгонит
+		if started {
+			if errdb := db.StartExpression(s.ctx, expr.ID); errdb != nil {
+				logger.Error("Failed to update expression status", zap.Error(errdb), zap.Int("id", expr.ID))
 			}
 		}
+		if errdb := db.StartTaskAttempt(s.ctx, expr.ID, &taken); errdb != nil {
+			logger.Error("Failed to start task attempt", zap.Error(errdb), zap.String("id", taken.ID))
+		}
+		return &taken
 	}
+}
 
-	return nil
+// Возвращает в очередь все таски агента, который перестал отвечать
+func (s *Storage) RequeueAgentTasks(db db.Repository, agentID string) int {
+	s.mu.Lock()
+	expressions := make([]*expression, 0, len(s.data))
+	for _, e := range s.data {
+		expressions = append(expressions, e)
+	}
+	s.mu.Unlock()
+
+	requeued := 0
+	for _, e := range expressions {
+		e.mu.Lock()
+		for _, task := range e.Tasks {
+			if e.done {
+				break
+			}
+			if task.Status != entities.InProgress || task.AgentID != agentID {
+				continue
+			}
+			requeued++
+			s.retryTask(db, e, task, entities.AttemptAgentDead)
+		}
+		e.mu.Unlock()
+	}
+	return requeued
 }
 
-// Проверка тасок на время исполнения
-func (s *Storage) CheckAndRecoverTasks(ctx context.Context) {
+// Возвращает таску в очередь после неудачной попытки, а когда попытки кончились - завершает выражение с ошибкой.
+// Вызывать под e.mu
+func (s *Storage) retryTask(db db.Repository, e *expression, task *entities.Task, outcome string) {
+	ctx := s.ctx
 	logger := logger.FromContext(ctx)
 
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	if errdb := db.FinishTaskAttempt(ctx, task.ID, task.Attempts, outcome, ""); errdb != nil {
+		logger.Error("Failed to finish task attempt", zap.Error(errdb), zap.String("id", task.ID))
+	}
 
-	for _, expr := range s.data {
-		for _, task := range expr.Tasks {
-			if task.Status == entities.InProgress && time.Since(task.LastUpdated) > 2*time.Minute {
-				// Возвращаем задачу в статус accepted через 2 минуты
-				task.Status = entities.Accepted
-				task.LastUpdated = time.Now()
-				logger.Info("Task recovered to 'accepted' status", zap.String("task id", task.ID))
-			}
+	// таска "отравлена": раз за разом губит агентов или не успевает посчитаться
+	if task.Attempts >= s.cfg.MaxTaskAttempts {
+		reason := fmt.Sprintf("operation '%s' failed after %d attempts (last: %s)", task.Operation, task.Attempts, outcome)
+		if errdb := db.UpdateExpressionError(ctx, e.ID, entities.ErrorCodeAttemptsExhausted, reason); errdb != nil {
+			logger.Error("Failed to update expression result", zap.Error(errdb), zap.Int("id", e.ID))
 		}
+		s.finish(e)
+		s.publish(e, Event{
+			Type:         EventResult,
+			Status:       entities.CompletedWithError,
+			ErrorCode:    entities.ErrorCodeAttemptsExhausted,
+			ErrorMessage: reason,
+		})
+		logger.Warn("Task attempts exhausted, expression completed with error",
+			zap.String("task id", task.ID),
+			zap.Int("expression id", e.ID),
+			zap.Int("attempts", task.Attempts),
+		)
+		return
+	}
+
+	task.Status = entities.Accepted
+	task.AgentID = ""
+	task.LastUpdated = time.Now()
+	if errdb := db.UpdateTaskStatus(ctx, task.ID, entities.Accepted); errdb != nil {
+		logger.Error("Failed to update task status", zap.Error(errdb), zap.String("id", task.ID))
 	}
+	s.push(e, e.index[task.ID])
+	s.publishTask(e, task)
+	logger.Info("Task requeued", zap.String("task id", task.ID), zap.String("reason", outcome), zap.Int("attempts", task.Attempts))
 }
@@ -0,0 +1,427 @@
+package server
+
+import (
+	"context"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/YattaDeSune/calc-project/internal/db"
+	"github.com/YattaDeSune/calc-project/internal/entities"
+	"github.com/YattaDeSune/calc-project/internal/errors"
+	"github.com/YattaDeSune/calc-project/internal/logger"
+	pb "github.com/YattaDeSune/calc-project/internal/proto"
+	"github.com/YattaDeSune/calc-project/pkg/calculation"
+	"go.uber.org/zap"
+)
+
+// Хранилище с пустой бд во временной директории
+func newTestStorage(tb testing.TB) (*Storage, *db.Database) {
+	tb.Helper()
+
+	ctx := logger.WithLogger(context.Background(), zap.NewNop())
+	database, err := db.New(ctx, filepath.Join(tb.TempDir(), "calculator.db"))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { database.Close() })
+
+	cfg := &Config{LeaseMarginMs: 60000, MaxTaskAttempts: 3}
+	return NewStorage(ctx, cfg), database
+}
+
+// Добавляет выражение пользователя 1 только в память, без записи тасок в бд
+func addPending(tb testing.TB, storage *Storage, id int, expr string) {
+	tb.Helper()
+	addPendingFor(tb, storage, 1, id, expr)
+}
+
+func addPendingFor(tb testing.TB, storage *Storage, userID, id int, expr string) {
+	tb.Helper()
+
+	if err := storage.Reserve(userID); err != nil {
+		tb.Fatal(err)
+	}
+
+	RPN, err := calculation.Parse(expr)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	nodes, err := calculation.BuildTasks(RPN)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	storage.add(newExpression(&entities.Expression{
+		ID:         id,
+		Expression: expr,
+		UserID:     userID,
+		Status:     entities.Accepted,
+		Tasks:      newTasks(id, nodes, nil),
+	}))
+}
+
+// Считает таску так же, как агент (только нужные в тестах операции)
+func compute(task *entities.Task) *pb.SubmitResultRequest {
+	a, _ := strconv.ParseFloat(task.Args[0], 64)
+	b, _ := strconv.ParseFloat(task.Args[1], 64)
+	switch task.Operation {
+	case "+":
+		return &pb.SubmitResultRequest{Id: task.ID, Result: a + b}
+	case "*":
+		return &pb.SubmitResultRequest{Id: task.ID, Result: a * b}
+	}
+	return &pb.SubmitResultRequest{Id: task.ID, Error: "unexpected operation"}
+}
+
+func TestStorage_ComputesExpression(t *testing.T) {
+	storage, database := newTestStorage(t)
+	ctx := storage.ctx
+
+	const expr = "(1+2)*(3+4)"
+	id, err := database.CreateExpression(ctx, 1, entities.Accepted, entities.NewExpression{Expression: expr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	RPN, err := calculation.Parse(expr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Reserve(1); err != nil {
+		t.Fatal(err)
+	}
+	storage.AddExpression(database, &entities.Expression{ID: id, Expression: expr, UserID: 1}, RPN)
+
+	// обе суммы независимы и выдаются сразу, умножение - только после них
+	first := storage.GetTaskForAgent(database, "")
+	second := storage.GetTaskForAgent(database, "")
+	if first == nil || second == nil {
+		t.Fatal("expected two ready tasks")
+	}
+	if task := storage.GetTaskForAgent(database, ""); task != nil {
+		t.Fatalf("unexpected ready task %s", task.Operation)
+	}
+
+	storage.SubmitTaskResult(database, compute(first))
+	storage.SubmitTaskResult(database, compute(second))
+
+	last := storage.GetTaskForAgent(database, "")
+	if last == nil || last.Operation != "*" {
+		t.Fatalf("expected multiplication task, got %v", last)
+	}
+	storage.SubmitTaskResult(database, compute(last))
+
+	got, err := database.GetExpressionByID(ctx, id, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Status != entities.Completed || got.Result == nil || *got.Result != 21 {
+		t.Errorf("expected completed with 21, but got %s with %v", got.Status, got.Result)
+	}
+	if got.ErrorCode != nil || got.TaskCount != 3 || got.StartedAt == nil || got.FinishedAt == nil || got.FinishedAt.Before(*got.StartedAt) {
+		t.Errorf("unexpected expression details %+v", got)
+	}
+	if storage.GetTasks(id) != nil {
+		t.Error("expected expression to be removed from storage")
+	}
+	if pending, total := storage.Usage(1); pending != 0 || total != 0 {
+		t.Errorf("expected quota to be released, got %d pending of %d", pending, total)
+	}
+}
+
+func TestStorage_ComputationError(t *testing.T) {
+	storage, database := newTestStorage(t)
+	ctx := storage.ctx
+
+	id, err := database.CreateExpression(ctx, 1, entities.Accepted, entities.NewExpression{Expression: "5-3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	RPN, err := calculation.Parse("5-3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Reserve(1); err != nil {
+		t.Fatal(err)
+	}
+	storage.AddExpression(database, &entities.Expression{ID: id, Expression: "5-3", UserID: 1}, RPN)
+
+	// вычитание compute не умеет и возвращает ошибку, как агент
+	storage.SubmitTaskResult(database, compute(storage.GetTaskForAgent(database, "")))
+
+	got, err := database.GetExpressionByID(ctx, id, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Status != entities.CompletedWithError || got.Result != nil {
+		t.Errorf("expected completed with error without result, got %s with %v", got.Status, got.Result)
+	}
+	if got.ErrorCode == nil || *got.ErrorCode != entities.ErrorCodeComputation ||
+		got.ErrorMessage == nil || *got.ErrorMessage != "unexpected operation" {
+		t.Errorf("expected computation error, got %v: %v", got.ErrorCode, got.ErrorMessage)
+	}
+	if got.FinishedAt == nil {
+		t.Error("expected finished_at")
+	}
+}
+
+// Выражения с переменными досчитываются после перезапуска оркестратора
+func TestStorage_RestoreWithVariables(t *testing.T) {
+	storage, database := newTestStorage(t)
+	ctx := storage.ctx
+
+	// упал до сохранения тасок: выражение разбирается заново
+	notStarted, err := database.CreateExpression(ctx, 1, entities.Accepted, entities.NewExpression{
+		Expression: "x*(y+1)",
+		Variables:  map[string]float64{"x": 2, "y": 3},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// упал посреди вычисления: таски уже в бд
+	const expr = "(a+b)*a"
+	variables := map[string]float64{"a": 3, "b": 4}
+	started, err := database.CreateExpression(ctx, 1, entities.Accepted, entities.NewExpression{Expression: expr, Variables: variables})
+	if err != nil {
+		t.Fatal(err)
+	}
+	RPN, err := calculation.Parse(expr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if RPN, err = calculation.Bind(RPN, variables); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Reserve(1); err != nil {
+		t.Fatal(err)
+	}
+	storage.AddExpression(database, &entities.Expression{ID: started, Expression: expr, UserID: 1, Variables: variables}, RPN)
+	if task := storage.GetTaskForAgent(database, ""); task == nil {
+		t.Fatal("expected ready task")
+	}
+
+	restarted := NewStorage(ctx, storage.cfg)
+	if err := restarted.Restore(database); err != nil {
+		t.Fatal(err)
+	}
+	for task := restarted.GetTaskForAgent(database, ""); task != nil; task = restarted.GetTaskForAgent(database, "") {
+		restarted.SubmitTaskResult(database, compute(task))
+	}
+
+	for id, want := range map[int]float64{notStarted: 8, started: 21} {
+		got, err := database.GetExpressionByID(ctx, id, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Status != entities.Completed || got.Result == nil || *got.Result != want {
+			t.Errorf("expression %d: expected completed with %v, but got %s with %v (%v)", id, want, got.Status, got.Result, got.ErrorMessage)
+		}
+		if len(got.Variables) != 2 {
+			t.Errorf("expression %d: expected variables to be kept, got %v", id, got.Variables)
+		}
+	}
+}
+
+func TestStorage_CancelSkipsQueuedTasks(t *testing.T) {
+	storage, database := newTestStorage(t)
+
+	addPending(t, storage, 1, "1+2")
+	addPending(t, storage, 2, "3+4")
+	if _, err := storage.CancelExpression(database, 1); err != nil {
+		t.Fatal(err)
+	}
+	if n := storage.ReadyLen(); n != 1 {
+		t.Errorf("expected 1 ready task after cancel, got %d", n)
+	}
+
+	task := storage.GetTaskForAgent(database, "")
+	if task == nil || task.Args[0] != "3" {
+		t.Fatalf("expected task of second expression, got %v", task)
+	}
+	if task := storage.GetTaskForAgent(database, ""); task != nil {
+		t.Fatalf("unexpected task %v", task)
+	}
+}
+
+// Продлить аренду и сдать результат может только агент, которому выдана таска
+func TestStorage_TaskOwnedByAgent(t *testing.T) {
+	storage, database := newTestStorage(t)
+	ctx := storage.ctx
+
+	id, err := database.CreateExpression(ctx, 1, entities.Accepted, entities.NewExpression{Expression: "1+2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	RPN, err := calculation.Parse("1+2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Reserve(1); err != nil {
+		t.Fatal(err)
+	}
+	storage.AddExpression(database, &entities.Expression{ID: id, Expression: "1+2", UserID: 1}, RPN)
+
+	task := storage.GetTaskForAgent(database, "owner")
+	if task == nil {
+		t.Fatal("expected ready task")
+	}
+
+	if _, ok := storage.RenewLease(task.ID, "other"); ok {
+		t.Error("expected lease renewal by other agent to be rejected")
+	}
+	if _, ok := storage.RenewLease(task.ID, "owner"); !ok {
+		t.Error("expected lease renewal by owner")
+	}
+
+	for _, agentID := range []string{"other", ""} {
+		result := compute(task)
+		result.AgentId = agentID
+		if err := storage.SubmitTaskResult(database, result); err != errors.ErrTaskNotLeased {
+			t.Errorf("agent %q: expected ErrTaskNotLeased, got %v", agentID, err)
+		}
+	}
+
+	result := compute(task)
+	result.AgentId = "owner"
+	if err := storage.SubmitTaskResult(database, result); err != nil {
+		t.Fatal(err)
+	}
+	got, err := database.GetExpressionByID(ctx, id, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Status != entities.Completed || got.Result == nil || *got.Result != 3 {
+		t.Errorf("expected completed with 3, but got %s with %v", got.Status, got.Result)
+	}
+}
+
+func TestStorage_Quota(t *testing.T) {
+	storage, database := newTestStorage(t)
+	storage.cfg.MaxPendingPerUser = 2
+	storage.cfg.MaxPendingTotal = 3
+
+	for _, userID := range []int{1, 1, 2} {
+		if err := storage.Reserve(userID); err != nil {
+			t.Fatalf("unexpected error for user %d: %v", userID, err)
+		}
+	}
+	if err := storage.Reserve(1); err != errors.ErrUserQuota {
+		t.Errorf("expected user quota error, got %v", err)
+	}
+	if err := storage.Reserve(2); err != errors.ErrServerQuota {
+		t.Errorf("expected server quota error, got %v", err)
+	}
+
+	// выражение занимает место, пока не досчитается или не будет отменено
+	storage.Release(1)
+	storage.Release(1)
+	addPending(t, storage, 1, "1+2")
+	if pending, total := storage.Usage(1); pending != 1 || total != 2 {
+		t.Errorf("expected 1 pending of 2 total, got %d of %d", pending, total)
+	}
+	if _, err := storage.CancelExpression(database, 1); err != nil {
+		t.Fatal(err)
+	}
+	if pending, total := storage.Usage(1); pending != 0 || total != 1 {
+		t.Errorf("expected 0 pending of 1 total, got %d of %d", pending, total)
+	}
+}
+
+func TestQueue(t *testing.T) {
+	var q queue[readyTask]
+	next := 0
+	// чередуем вставки и чтения, чтобы очередь сдвигалась
+	for i := 0; i < 1000; i++ {
+		q.push(readyTask{index: i})
+		if i%3 == 0 {
+			task, ok := q.pop()
+			if !ok || task.index != next {
+				t.Fatalf("expected %d, got %d", next, task.index)
+			}
+			next++
+		}
+	}
+	for q.len() > 0 {
+		task, _ := q.pop()
+		if task.index != next {
+			t.Fatalf("expected %d, got %d", next, task.index)
+		}
+		next++
+	}
+	if _, ok := q.pop(); ok || next != 1000 {
+		t.Fatalf("expected empty queue after 1000 tasks, got %d", next)
+	}
+}
+
+const benchPending = 10000
+
+// Выдача и прием таски при 10k выражений в очереди, вместе с записью в бд
+func BenchmarkStorage_TaskCycle(b *testing.B) {
+	storage, database := newTestStorage(b)
+	for i := 1; i <= benchPending; i++ {
+		addPending(b, storage, i, "1+2")
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		task := storage.GetTaskForAgent(database, "")
+		storage.SubmitTaskResult(database, compute(task))
+		// держим в очереди все те же 10k выражений
+		addPending(b, storage, benchPending+i+1, "1+2")
+	}
+}
+
+// То же самое, но агенты забирают таски параллельно
+func BenchmarkStorage_TaskCycleParallel(b *testing.B) {
+	storage, database := newTestStorage(b)
+	for i := 1; i <= benchPending; i++ {
+		addPending(b, storage, i, "1+2")
+	}
+
+	var mu sync.Mutex
+	nextID := benchPending
+	b.ResetTimer()
+	b.RunParallel(func(p *testing.PB) {
+		for p.Next() {
+			task := storage.GetTaskForAgent(database, "")
+			storage.SubmitTaskResult(database, compute(task))
+
+			mu.Lock()
+			nextID++
+			id := nextID
+			mu.Unlock()
+			addPending(b, storage, id, "1+2")
+		}
+	})
+}
+
+// 10k выражений у 1000 пользователей: выдача идет по кругу, каждое выражение досчитывается и снимается
+func BenchmarkStorage_ManyUsers(b *testing.B) {
+	const users = 1000
+	storage, database := newTestStorage(b)
+	for i := 1; i <= benchPending; i++ {
+		addPendingFor(b, storage, i%users, i, "1+2")
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		task := storage.GetTaskForAgent(database, "")
+		storage.SubmitTaskResult(database, compute(task))
+		addPendingFor(b, storage, i%users, benchPending+i+1, "1+2")
+	}
+}
+
+// Только очередь, без бд: выдача не зависит от количества ожидающих выражений
+func BenchmarkReadyQueue(b *testing.B) {
+	q := newScheduler()
+	for i := 0; i < benchPending; i++ {
+		q.push(i%100, 0, readyTask{index: i})
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		task, _ := q.pop()
+		q.push(i%100, 0, task)
+	}
+}
@@ -0,0 +1,330 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/YattaDeSune/calc-project/internal/entities"
+	"github.com/YattaDeSune/calc-project/internal/logger"
+	"go.uber.org/zap"
+)
+
+const (
+	webhookBatch      = 16 // сколько вебхуков доставляется параллельно за один проход
+	maxCallbackURL    = 2048
+	minCallbackSecret = 16 // минимальная длина секрета
+
+	callbackLookupTimeout = 2 * time.Second // резолв хоста callback_url при приеме выражения
+)
+
+var errInternalCallback = errors.New("callback_url must not point to an internal address")
+
+// Заголовки запроса вебхука
+const (
+	WebhookSignatureHeader = "X-Calc-Signature" // sha256=<hex HMAC-SHA256(secret, timestamp + "." + body)>
+	WebhookTimestampHeader = "X-Calc-Timestamp" // unix-время подписи, защищает от повторной отправки старых запросов
+	WebhookDeliveryHeader  = "X-Calc-Delivery"  // id доставки, одинаковый у всех повторов - по нему получатель отсекает дубли
+)
+
+// Тело вебхука
+type WebhookPayload struct {
+	ID           int      `json:"id"`
+	Expression   string   `json:"expression"`
+	Status       string   `json:"status"`
+	Result       *float64 `json:"result"`
+	ExactResult  *string  `json:"exact_result,omitempty"`
+	ErrorCode    *string  `json:"error_code,omitempty"`
+	ErrorMessage *string  `json:"error_message,omitempty"`
+}
+
+func validateCallback(ctx context.Context, policy *callbackPolicy, callbackURL, secret string) error {
+	if callbackURL == "" || secret == "" {
+		return fmt.Errorf("callback_url and callback_secret must be set together")
+	}
+	if len(callbackURL) > maxCallbackURL {
+		return fmt.Errorf("callback_url is too long")
+	}
+	u, err := url.Parse(callbackURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("callback_url must be an absolute http(s) URL")
+	}
+	if len(secret) < minCallbackSecret {
+		return fmt.Errorf("callback_secret must be at least %d characters", minCallbackSecret)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, callbackLookupTimeout)
+	defer cancel()
+	return policy.checkHost(ctx, u.Hostname())
+}
+
+var sharedAddressSpace = netip.MustParsePrefix("100.64.0.0/10") // CGNAT
+
+// Внутренний адрес: loopback, частные сети, link-local (в том числе метаданные облака 169.254.169.254) и т.п.
+// Вебхук на такой адрес позволил бы через callback_url достучаться до сервисов рядом с оркестратором
+func internalAddr(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsUnspecified() ||
+		ip.IsMulticast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() ||
+		sharedAddressSpace.Contains(ip)
+}
+
+// Куда можно слать вебхуки: внешние адреса и внутренние из WEBHOOK_ALLOWED_HOSTS
+type callbackPolicy struct {
+	hosts  map[string]bool // разрешенные имена хостов
+	nets   []netip.Prefix  // разрешенные адреса и подсети
+	lookup func(ctx context.Context, host string) ([]netip.Addr, error)
+}
+
+// Разбирает список разрешенных хостов: имена, адреса и подсети через запятую
+func newCallbackPolicy(allowed string) (*callbackPolicy, error) {
+	p := &callbackPolicy{
+		hosts: make(map[string]bool),
+		lookup: func(ctx context.Context, host string) ([]netip.Addr, error) {
+			return net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+		},
+	}
+
+	for _, item := range strings.Split(allowed, ",") {
+		item = strings.ToLower(strings.TrimSpace(item))
+		if item == "" {
+			continue
+		}
+		if strings.Contains(item, "/") {
+			prefix, err := netip.ParsePrefix(item)
+			if err != nil {
+				return nil, fmt.Errorf("invalid allowed webhook network %q: %w", item, err)
+			}
+			p.nets = append(p.nets, prefix.Masked())
+			continue
+		}
+		if ip, err := netip.ParseAddr(item); err == nil {
+			ip = ip.Unmap()
+			p.nets = append(p.nets, netip.PrefixFrom(ip, ip.BitLen()))
+			continue
+		}
+		p.hosts[strings.TrimSuffix(item, ".")] = true
+	}
+	return p, nil
+}
+
+func (p *callbackPolicy) allowedHost(host string) bool {
+	return p.hosts[strings.TrimSuffix(strings.ToLower(host), ".")]
+}
+
+func (p *callbackPolicy) allowedAddr(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	if !internalAddr(ip) {
+		return true
+	}
+	for _, prefix := range p.nets {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Проверяет хост callback_url при приеме выражения. Окончательная проверка - при подключении (см. client),
+// ответ DNS к тому времени может поменяться
+func (p *callbackPolicy) checkHost(ctx context.Context, host string) error {
+	if p.allowedHost(host) {
+		return nil
+	}
+	name := strings.TrimSuffix(strings.ToLower(host), ".")
+	if name == "localhost" || strings.HasSuffix(name, ".localhost") {
+		return errInternalCallback
+	}
+
+	if ip, err := netip.ParseAddr(host); err == nil {
+		if !p.allowedAddr(ip) {
+			return errInternalCallback
+		}
+		return nil
+	}
+
+	addrs, err := p.lookup(ctx, host)
+	if err != nil {
+		// хост может появиться позже, адрес все равно проверится при доставке
+		return nil
+	}
+	for _, ip := range addrs {
+		if !p.allowedAddr(ip) {
+			return errInternalCallback
+		}
+	}
+	return nil
+}
+
+// HTTP-клиент вебхуков. Адрес проверяется при каждом подключении, уже после резолва,
+// поэтому подмена ответа DNS после приема выражения (DNS rebinding) и редиректы не помогают
+func (p *callbackPolicy) client(timeout time.Duration) *http.Client {
+	checked := &net.Dialer{Timeout: timeout, Control: p.control}
+	allowed := &net.Dialer{Timeout: timeout}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// через прокси проверялся бы адрес прокси, а не получателя
+	transport.Proxy = nil
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if host, _, err := net.SplitHostPort(addr); err == nil && p.allowedHost(host) {
+			return allowed.DialContext(ctx, network, addr)
+		}
+		return checked.DialContext(ctx, network, addr)
+	}
+	return &http.Client{Timeout: timeout, Transport: transport}
+}
+
+func (p *callbackPolicy) control(network, address string, _ syscall.RawConn) error {
+	addr, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return fmt.Errorf("invalid webhook address %q: %w", address, err)
+	}
+	if !p.allowedAddr(addr.Addr()) {
+		return fmt.Errorf("%w: %s", errInternalCallback, addr.Addr())
+	}
+	return nil
+}
+
+// Подпись тела вебхука
+func SignWebhook(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Доставляет вебхуки из outbox. Outbox в бд, поэтому недоставленное переживает перезапуск
+func (s *Server) StartWebhooks() {
+	ctx := s.ctx
+
+	client := s.callbacks.client(time.Duration(s.cfg.WebhookTimeoutMs) * time.Millisecond)
+	ticker := time.NewTicker(time.Duration(s.cfg.WebhookPollMs) * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			// пока есть полные пачки, доставляем без ожидания
+			for s.deliverWebhooks(client) == webhookBatch && ctx.Err() == nil {
+			}
+		}
+	}
+}
+
+// Один проход по outbox, возвращает количество взятых вебхуков
+func (s *Server) deliverWebhooks(client *http.Client) int {
+	ctx := s.ctx
+	logger := logger.FromContext(ctx)
+
+	webhooks, err := s.db.GetDueWebhooks(ctx, time.Now(), webhookBatch)
+	if err != nil {
+		logger.Error("Failed to get webhooks", zap.Error(err))
+		return 0
+	}
+
+	var wg sync.WaitGroup
+	for _, webhook := range webhooks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.deliverWebhook(client, webhook)
+		}()
+	}
+	wg.Wait()
+	return len(webhooks)
+}
+
+func (s *Server) deliverWebhook(client *http.Client, webhook entities.Webhook) {
+	ctx := s.ctx
+	logger := logger.FromContext(ctx)
+
+	err := sendWebhook(client, webhook)
+	attempts := webhook.Attempts + 1
+	if err == nil {
+		if errdb := s.db.FinishWebhook(ctx, webhook.ID, entities.WebhookDelivered, attempts, ""); errdb != nil {
+			logger.Error("Failed to finish webhook", zap.Int("id", webhook.ID), zap.Error(errdb))
+		}
+		logger.Info("Webhook delivered", zap.Int("expression id", webhook.ExpressionID), zap.Int("attempts", attempts))
+		return
+	}
+
+	if attempts >= s.cfg.WebhookMaxAttempts {
+		if errdb := s.db.FinishWebhook(ctx, webhook.ID, entities.WebhookFailed, attempts, err.Error()); errdb != nil {
+			logger.Error("Failed to finish webhook", zap.Int("id", webhook.ID), zap.Error(errdb))
+		}
+		logger.Warn("Webhook delivery failed, attempts exhausted",
+			zap.Int("expression id", webhook.ExpressionID),
+			zap.Int("attempts", attempts),
+			zap.Error(err),
+		)
+		return
+	}
+
+	backoff := s.cfg.WebhookBackoff(attempts)
+	if errdb := s.db.RetryWebhook(ctx, webhook.ID, attempts, time.Now().Add(backoff), err.Error()); errdb != nil {
+		logger.Error("Failed to reschedule webhook", zap.Int("id", webhook.ID), zap.Error(errdb))
+	}
+	logger.Info("Webhook delivery failed, will retry",
+		zap.Int("expression id", webhook.ExpressionID),
+		zap.Int("attempts", attempts),
+		zap.Duration("backoff", backoff),
+		zap.Error(err),
+	)
+}
+
+// Отправляет вебхук, успех - любой ответ 2xx
+func sendWebhook(client *http.Client, webhook entities.Webhook) error {
+	body, err := json.Marshal(WebhookPayload{
+		ID:           webhook.ExpressionID,
+		Expression:   webhook.Expression,
+		Status:       webhook.Status,
+		Result:       webhook.Result,
+		ExactResult:  webhook.ExactResult,
+		ErrorCode:    webhook.ErrorCode,
+		ErrorMessage: webhook.ErrorMessage,
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	timestamp := time.Now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookTimestampHeader, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(WebhookSignatureHeader, SignWebhook(webhook.Secret, timestamp, body))
+	req.Header.Set(WebhookDeliveryHeader, strconv.Itoa(webhook.ID))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// дочитываем тело, чтобы соединение вернулось в пул
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
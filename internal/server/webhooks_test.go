@@ -0,0 +1,289 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/YattaDeSune/calc-project/internal/entities"
+	"github.com/YattaDeSune/calc-project/pkg/calculation"
+)
+
+const testSecret = "0123456789abcdef"
+
+// Получатель вебхуков: проверяет подпись и отвечает кодами из statuses по очереди (дальше - 200)
+type webhookReceiver struct {
+	t        *testing.T
+	mu       sync.Mutex
+	statuses []int
+	payloads []WebhookPayload
+}
+
+func (rcv *webhookReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	timestamp, _ := strconv.ParseInt(r.Header.Get(WebhookTimestampHeader), 10, 64)
+	if got := r.Header.Get(WebhookSignatureHeader); got != SignWebhook(testSecret, timestamp, body) {
+		rcv.t.Errorf("invalid signature %q", got)
+	}
+	if r.Header.Get(WebhookDeliveryHeader) == "" {
+		rcv.t.Error("expected delivery id")
+	}
+
+	rcv.mu.Lock()
+	defer rcv.mu.Unlock()
+
+	status := http.StatusOK
+	if len(rcv.statuses) > 0 {
+		status, rcv.statuses = rcv.statuses[0], rcv.statuses[1:]
+	}
+	if status == http.StatusOK {
+		var payload WebhookPayload
+		if err := json.Unmarshal(body, &payload); err != nil {
+			rcv.t.Error(err)
+		}
+		rcv.payloads = append(rcv.payloads, payload)
+	}
+	w.WriteHeader(status)
+}
+
+// Выражение с вебхуком на url, уже добавленное в хранилище
+func addWithCallback(t *testing.T, s *Server, expr, url string) int {
+	t.Helper()
+
+	callback := &entities.Callback{URL: url, Secret: testSecret}
+	id, err := s.db.CreateExpression(s.ctx, 1, entities.Accepted, entities.NewExpression{Expression: expr, Callback: callback})
+	if err != nil {
+		t.Fatal(err)
+	}
+	RPN, err := calculation.Parse(expr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.storage.Reserve(1); err != nil {
+		t.Fatal(err)
+	}
+	s.storage.AddExpression(s.db, &entities.Expression{ID: id, Expression: expr, UserID: 1}, RPN)
+	return id
+}
+
+func newWebhookServer(t *testing.T) *Server {
+	storage, database := newTestStorage(t)
+	storage.cfg.WebhookMaxAttempts = 3
+	storage.cfg.WebhookBackoffMs = 50
+	storage.cfg.WebhookMaxBackoffMs = 1000
+	return &Server{ctx: storage.ctx, cfg: storage.cfg, storage: storage, db: database}
+}
+
+func TestWebhooks_Delivered(t *testing.T) {
+	s := newWebhookServer(t)
+	receiver := &webhookReceiver{t: t}
+	srv := httptest.NewServer(receiver)
+	defer srv.Close()
+
+	computed := addWithCallback(t, s, "1+2", srv.URL)
+	cancelled := addWithCallback(t, s, "3+4", srv.URL)
+	// без вебхука - в outbox не попадает
+	if _, err := s.db.CreateExpression(s.ctx, 1, entities.Accepted, entities.NewExpression{Expression: "5+6"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := s.deliverWebhooks(srv.Client()); n != 0 {
+		t.Fatalf("expected no webhooks before completion, got %d", n)
+	}
+
+	task := s.storage.GetTaskForAgent(s.db, "")
+	s.storage.SubmitTaskResult(s.db, compute(task))
+	if _, err := s.storage.CancelExpression(s.db, cancelled); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := s.deliverWebhooks(srv.Client()); n != 2 {
+		t.Fatalf("expected 2 webhooks, got %d", n)
+	}
+	if n := s.deliverWebhooks(srv.Client()); n != 0 {
+		t.Fatalf("expected webhooks to be delivered once, got %d more", n)
+	}
+
+	got := map[int]WebhookPayload{}
+	for _, payload := range receiver.payloads {
+		got[payload.ID] = payload
+	}
+	if p := got[computed]; p.Status != entities.Completed || p.Result == nil || *p.Result != 3 {
+		t.Errorf("expected completed with 3, got %+v", p)
+	}
+	if p := got[cancelled]; p.Status != entities.Cancelled {
+		t.Errorf("expected cancelled, got %+v", p)
+	}
+}
+
+func TestWebhooks_RetryWithBackoff(t *testing.T) {
+	s := newWebhookServer(t)
+	receiver := &webhookReceiver{t: t, statuses: []int{http.StatusInternalServerError, http.StatusBadGateway}}
+	srv := httptest.NewServer(receiver)
+	defer srv.Close()
+
+	id := addWithCallback(t, s, "1+2", srv.URL)
+	task := s.storage.GetTaskForAgent(s.db, "")
+	s.storage.SubmitTaskResult(s.db, compute(task))
+
+	// первая попытка неудачная, следующая - не раньше чем через 50ms
+	if n := s.deliverWebhooks(srv.Client()); n != 1 {
+		t.Fatalf("expected first attempt, got %d", n)
+	}
+	if n := s.deliverWebhooks(srv.Client()); n != 0 {
+		t.Fatalf("expected retry to wait for backoff, got %d", n)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for len(receiver.payloads) == 0 && time.Now().Before(deadline) {
+		s.deliverWebhooks(srv.Client())
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(receiver.payloads) != 1 || receiver.payloads[0].ID != id {
+		t.Fatalf("expected webhook to be delivered on third attempt, got %+v", receiver.payloads)
+	}
+}
+
+func TestWebhooks_AttemptsExhausted(t *testing.T) {
+	s := newWebhookServer(t)
+	s.cfg.WebhookBackoffMs = 1
+	s.cfg.WebhookMaxAttempts = 2
+	receiver := &webhookReceiver{t: t, statuses: []int{500, 500, 500}}
+	srv := httptest.NewServer(receiver)
+	defer srv.Close()
+
+	addWithCallback(t, s, "1+2", srv.URL)
+	task := s.storage.GetTaskForAgent(s.db, "")
+	s.storage.SubmitTaskResult(s.db, compute(task))
+
+	attempts := 0
+	for i := 0; i < 10; i++ {
+		attempts += s.deliverWebhooks(srv.Client())
+		time.Sleep(5 * time.Millisecond)
+	}
+	if attempts != 2 || len(receiver.statuses) != 1 {
+		t.Errorf("expected delivery to stop after 2 attempts, got %d", attempts)
+	}
+}
+
+func TestConfig_WebhookBackoff(t *testing.T) {
+	cfg := &Config{WebhookBackoffMs: 1000, WebhookMaxBackoffMs: 5000}
+	want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}
+	for i, backoff := range want {
+		if got := cfg.WebhookBackoff(i + 1); got != backoff {
+			t.Errorf("attempt %d: expected %s, got %s", i+1, backoff, got)
+		}
+	}
+}
+
+// Политика с подмененным DNS: internal.example.com указывает во внутреннюю сеть
+func newTestCallbackPolicy(t *testing.T, allowed string) *callbackPolicy {
+	t.Helper()
+
+	policy, err := newCallbackPolicy(allowed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy.lookup = func(ctx context.Context, host string) ([]netip.Addr, error) {
+		switch host {
+		case "example.com":
+			return []netip.Addr{netip.MustParseAddr("93.184.215.14")}, nil
+		case "internal.example.com":
+			return []netip.Addr{netip.MustParseAddr("93.184.215.14"), netip.MustParseAddr("10.0.0.7")}, nil
+		}
+		return nil, errors.New("no such host")
+	}
+	return policy
+}
+
+func TestValidateCallback(t *testing.T) {
+	strict := newTestCallbackPolicy(t, "")
+	allowlist := newTestCallbackPolicy(t, "127.0.0.1, 10.0.0.0/8, Hooks.Internal")
+
+	testCases := []struct {
+		name   string
+		url    string
+		secret string
+		policy *callbackPolicy
+		valid  bool
+	}{
+		{name: "valid", url: "https://example.com/hook", secret: testSecret, policy: strict, valid: true},
+		{name: "unresolved host", url: "https://unknown.example.org/hook", secret: testSecret, policy: strict, valid: true},
+		{name: "no secret", url: "https://example.com/hook", secret: "", policy: strict, valid: false},
+		{name: "short secret", url: "https://example.com/hook", secret: "123", policy: strict, valid: false},
+		{name: "relative url", url: "/hook", secret: testSecret, policy: strict, valid: false},
+		{name: "not http", url: "ftp://example.com/hook", secret: testSecret, policy: strict, valid: false},
+
+		{name: "localhost", url: "http://localhost:8080/hook", secret: testSecret, policy: strict, valid: false},
+		{name: "localhost subdomain", url: "http://api.localhost/hook", secret: testSecret, policy: strict, valid: false},
+		{name: "loopback", url: "http://127.0.0.1/hook", secret: testSecret, policy: strict, valid: false},
+		{name: "loopback ipv6", url: "http://[::1]/hook", secret: testSecret, policy: strict, valid: false},
+		{name: "mapped loopback", url: "http://[::ffff:127.0.0.1]/hook", secret: testSecret, policy: strict, valid: false},
+		{name: "unspecified", url: "http://0.0.0.0/hook", secret: testSecret, policy: strict, valid: false},
+		{name: "private 10/8", url: "http://10.1.2.3/hook", secret: testSecret, policy: strict, valid: false},
+		{name: "private 172.16/12", url: "http://172.16.0.1/hook", secret: testSecret, policy: strict, valid: false},
+		{name: "private 192.168/16", url: "http://192.168.1.1/hook", secret: testSecret, policy: strict, valid: false},
+		{name: "private ipv6", url: "http://[fd00::1]/hook", secret: testSecret, policy: strict, valid: false},
+		{name: "cloud metadata", url: "http://169.254.169.254/latest/meta-data", secret: testSecret, policy: strict, valid: false},
+		{name: "link-local ipv6", url: "http://[fe80::1]/hook", secret: testSecret, policy: strict, valid: false},
+		{name: "shared address space", url: "http://100.64.0.1/hook", secret: testSecret, policy: strict, valid: false},
+		{name: "resolves to private", url: "https://internal.example.com/hook", secret: testSecret, policy: strict, valid: false},
+
+		{name: "allowed address", url: "http://127.0.0.1:9000/hook", secret: testSecret, policy: allowlist, valid: true},
+		{name: "allowed network", url: "https://internal.example.com/hook", secret: testSecret, policy: allowlist, valid: true},
+		{name: "allowed host", url: "http://hooks.internal/hook", secret: testSecret, policy: allowlist, valid: true},
+		{name: "not in allowlist", url: "http://192.168.1.1/hook", secret: testSecret, policy: allowlist, valid: false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := validateCallback(context.Background(), tc.policy, tc.url, tc.secret); (err == nil) != tc.valid {
+				t.Errorf("expected valid = %v, got %v", tc.valid, err)
+			}
+		})
+	}
+}
+
+func TestNewCallbackPolicy_Invalid(t *testing.T) {
+	if _, err := newCallbackPolicy("10.0.0.0/33"); err == nil {
+		t.Error("expected error for invalid network")
+	}
+}
+
+// Адрес проверяется при подключении: выражение с внутренним callback_url (например, DNS поменял ответ
+// после приема) не доставляется, пока адрес не разрешен
+func TestWebhooks_InternalAddressBlockedOnDial(t *testing.T) {
+	receiver := &webhookReceiver{t: t}
+	srv := httptest.NewServer(receiver)
+	defer srv.Close()
+
+	s := newWebhookServer(t)
+	addWithCallback(t, s, "1+2", srv.URL)
+	task := s.storage.GetTaskForAgent(s.db, "")
+	s.storage.SubmitTaskResult(s.db, compute(task))
+
+	if n := s.deliverWebhooks(newTestCallbackPolicy(t, "").client(time.Second)); n != 1 {
+		t.Fatalf("expected delivery attempt, got %d", n)
+	}
+	if len(receiver.payloads) != 0 {
+		t.Fatalf("expected webhook to internal address to be blocked, got %+v", receiver.payloads)
+	}
+
+	allowed := newTestCallbackPolicy(t, "127.0.0.0/8").client(time.Second)
+	deadline := time.Now().Add(2 * time.Second)
+	for len(receiver.payloads) == 0 && time.Now().Before(deadline) {
+		s.deliverWebhooks(allowed)
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(receiver.payloads) != 1 {
+		t.Fatalf("expected webhook to allowed address to be delivered, got %+v", receiver.payloads)
+	}
+}
@@ -1,6 +1,8 @@
 package calculation
 
 import (
+	"math"
+	"slices"
 	"strconv"
 	"strings"
 	"unicode"
@@ -12,86 +14,368 @@ var priority = map[string]int{
 	"*": 2,
 	"/": 2,
 	"~": 3, // unary -
+	"^": 4,
 }
 
-// Приведение к ОПН
+// Правоассоциативные операции: 2^3^2 = 2^(3^2)
+var rightAssociative = map[string]bool{
+	"^": true,
+}
+
+// Альтернативные записи операций
+var aliases = map[string]string{
+	"**": "^",
+}
+
+// Токен выражения и его позиция (номер символа-руны от начала строки)
+type Token struct {
+	Value string
+	Pos   int
+}
+
+// Разбор выражения: токенизация и приведение к ОПН.
+// Ошибки возвращаются как *ParseError с позицией в исходной строке
+func Parse(expression string) ([]string, error) {
+	return toRPN(Lex(expression))
+}
+
+// Приведение к ОПН. Позиция в *ParseError - индекс токена
 func ToRPN(tokens []string) ([]string, error) {
-	var stack []string
-	var out []string
+	positioned := make([]Token, len(tokens))
+	for i, token := range tokens {
+		positioned[i] = Token{Value: token, Pos: i}
+	}
+	return toRPN(positioned)
+}
+
+func toRPN(tokens []Token) ([]string, error) {
+	var stack []Token
+	var out []Token
+	// количество аргументов для каждого открытого вызова функции
+	var calls []int
 
 	if len(tokens) == 0 {
-		return nil, ErrEmptyExpression
+		return nil, newParseError(ErrEmptyExpression, Token{})
 	}
 
 	if len(tokens) <= 2 {
-		return nil, ErrShortExpression
+		return nil, newParseError(ErrShortExpression, tokens[len(tokens)-1])
+	}
+
+	// значение токена по индексу, "" за пределами выражения
+	value := func(i int) string {
+		if i < 0 || i >= len(tokens) {
+			return ""
+		}
+		return tokens[i].Value
 	}
 
 	for i, token := range tokens {
+		token.Value = normalize(token.Value)
 		switch {
-		case isNum(token):
+		case isNum(token.Value):
 			out = append(out, token)
-		case token == "(":
+		case isFunction(token.Value) && value(i+1) == "(":
+			stack = append(stack, token)
+		case token.Value == "(":
 			stack = append(stack, token)
-		case token == ")":
-			for len(stack) > 0 && stack[len(stack)-1] != "(" {
+			if isFunction(value(i - 1)) {
+				argc := 1
+				if value(i+1) == ")" {
+					argc = 0
+				}
+				calls = append(calls, argc)
+			}
+		case token.Value == ",":
+			for len(stack) > 0 && stack[len(stack)-1].Value != "(" {
+				out = append(out, stack[len(stack)-1])
+				stack = stack[:len(stack)-1]
+			}
+			// запятая разделяет только аргументы функции
+			if len(stack) < 2 || !isFunction(stack[len(stack)-2].Value) {
+				return nil, newParseError(ErrInvalidExpression, token)
+			}
+			calls[len(calls)-1]++
+		case token.Value == ")":
+			for len(stack) > 0 && stack[len(stack)-1].Value != "(" {
 				out = append(out, stack[len(stack)-1])
 				stack = stack[:len(stack)-1]
 			}
 			if len(stack) == 0 {
-				return nil, ErrNoOpeningParenthesis
+				return nil, newParseError(ErrNoOpeningParenthesis, token)
 			}
 			stack = stack[:len(stack)-1]
-		case isOperation(token):
-			if token == "-" && (i == 0 || tokens[i-1] == "(" || isOperation(tokens[i-1])) {
-				token = "~"
+
+			// закрылся вызов функции
+			if len(stack) > 0 && isFunction(stack[len(stack)-1].Value) {
+				function := stack[len(stack)-1]
+				stack = stack[:len(stack)-1]
+				argc := calls[len(calls)-1]
+				calls = calls[:len(calls)-1]
+				if !Functions[function.Value].accepts(argc) {
+					return nil, newParseError(ErrInvalidArgsCount, function)
+				}
+				out = append(out, Token{Value: funcToken(function.Value, argc), Pos: function.Pos})
+			}
+		case isOperation(token.Value):
+			prev := normalize(value(i - 1))
+			if token.Value == "-" && (i == 0 || prev == "(" || prev == "," || isOperation(prev)) {
+				// унарный минус стоит перед операндом, поэтому ничего из стека не выталкивает
+				stack = append(stack, Token{Value: "~", Pos: token.Pos})
+				continue
 			}
 
-			for len(stack) > 0 && isOperation(stack[len(stack)-1]) && (priority[stack[len(stack)-1]] >= priority[token]) {
+			for len(stack) > 0 && isOperation(stack[len(stack)-1].Value) && pops(stack[len(stack)-1].Value, token.Value) {
 				out = append(out, stack[len(stack)-1])
 				stack = stack[:len(stack)-1]
 			}
 			stack = append(stack, token)
+		case isIdentifier(token.Value) && value(i+1) == "(":
+			return nil, newParseError(ErrUnknownFunction, token)
+		case isIdentifier(token.Value):
+			// переменная, значение подставляется позже (Bind)
+			out = append(out, token)
 		default:
-			return nil, ErrInvalidExpression
+			return nil, newParseError(ErrInvalidExpression, token)
 		}
 	}
 
 	for len(stack) > 0 {
-		if stack[len(stack)-1] == "(" {
-			return nil, ErrNoClosingParenthesis
+		if stack[len(stack)-1].Value == "(" {
+			return nil, newParseError(ErrNoClosingParenthesis, stack[len(stack)-1])
 		}
 		out = append(out, stack[len(stack)-1])
 		stack = stack[:len(stack)-1]
 	}
 
-	return out, nil
+	if err := validateRPN(out); err != nil {
+		return nil, err
+	}
+
+	rpn := make([]string, len(out))
+	for i, token := range out {
+		rpn[i] = token.Value
+	}
+	return rpn, nil
+}
+
+// Подставляет в ОПН значения переменных.
+// Если значения каких-то переменных не переданы, возвращает *UndefinedVariablesError со всеми такими именами
+func Bind(rpn []string, variables map[string]float64) ([]string, error) {
+	bound := make([]string, len(rpn))
+	var missing []string
+
+	for i, token := range rpn {
+		if !isIdentifier(token) {
+			bound[i] = token
+			continue
+		}
+		value, ok := variables[token]
+		if !ok {
+			if !slices.Contains(missing, token) {
+				missing = append(missing, token)
+			}
+			continue
+		}
+		bound[i] = strconv.FormatFloat(value, 'g', -1, 64)
+	}
+
+	if len(missing) > 0 {
+		return nil, &UndefinedVariablesError{Names: missing}
+	}
+	return bound, nil
+}
+
+// Проверяет, что каждой операции хватает операндов и в итоге остается ровно одно значение
+func validateRPN(rpn []Token) error {
+	// позиции начала подвыражений, которые сейчас лежат в стеке
+	var stack []int
+
+	for _, token := range rpn {
+		argc := arity(token.Value)
+		if argc == 0 {
+			stack = append(stack, token.Pos)
+			continue
+		}
+		if len(stack) < argc {
+			return &ParseError{Code: CodeMissingOperand, Pos: token.Pos, Token: token.Value, Err: ErrShortExpression}
+		}
+		start := stack[len(stack)-argc]
+		stack = append(stack[:len(stack)-argc], min(start, token.Pos))
+	}
+
+	switch len(stack) {
+	case 0:
+		return newParseError(ErrEmptyExpression, Token{})
+	case 1:
+		return nil
+	default:
+		// между подвыражениями не хватает операции
+		return &ParseError{Code: CodeMissingOperator, Pos: stack[1], Err: ErrInvalidExpression}
+	}
+}
+
+// Количество операндов операции в ОПН (0 - токен сам является операндом)
+func arity(token string) int {
+	if _, argc, ok := parseFuncToken(token); ok {
+		return argc
+	}
+	switch {
+	case token == "~":
+		return 1
+	case isOperation(token):
+		return 2
+	default:
+		return 0
+	}
+}
+
+// Глубина вложенности операций в ОПН (результат Parse): 1 - одна операция над числами, 2 для (1+2)*3 и т.д.
+// Это длина самой длинной цепочки тасок, которые придется считать друг за другом
+func Depth(rpn []string) int {
+	// глубины подвыражений, которые сейчас лежат в стеке
+	var stack []int
+	depth := 0
+
+	for _, token := range rpn {
+		argc := arity(token)
+		if argc == 0 {
+			stack = append(stack, 0)
+			continue
+		}
+		argc = min(argc, len(stack))
+
+		level := 1
+		for _, d := range stack[len(stack)-argc:] {
+			level = max(level, d+1)
+		}
+		stack = append(stack[:len(stack)-argc], level)
+		depth = max(depth, level)
+	}
+	return depth
 }
 
 // Токенизация выражения
 func Tokenize(expression string) []string {
 	var tokens []string
-	var buffer strings.Builder
-
-	for _, char := range expression {
-		if unicode.IsDigit(char) || char == '.' {
-			buffer.WriteRune(char)
-		} else {
-			if buffer.Len() > 0 {
-				tokens = append(tokens, buffer.String())
-				buffer.Reset()
+	for _, token := range Lex(expression) {
+		tokens = append(tokens, token.Value)
+	}
+	return tokens
+}
+
+// Токенизация выражения с позициями токенов
+func Lex(expression string) []Token {
+	var tokens []Token
+	runes := []rune(expression)
+
+	for i := 0; i < len(runes); {
+		char := runes[i]
+		switch {
+		case unicode.IsSpace(char):
+			i++
+		case isDigit(char) || char == '.':
+			end := scanNumber(runes, i)
+			tokens = append(tokens, Token{Value: normalizeNumber(string(runes[i:end])), Pos: i})
+			i = end
+		case isIdentChar(char, true):
+			end := i + 1
+			for end < len(runes) && isIdentChar(runes[end], false) {
+				end++
 			}
-			if !unicode.IsSpace(char) {
-				tokens = append(tokens, string(char))
+			tokens = append(tokens, Token{Value: string(runes[i:end]), Pos: i})
+			i = end
+		case char == '*' && i+1 < len(runes) && runes[i+1] == '*':
+			// ** - степень
+			tokens = append(tokens, Token{Value: "**", Pos: i})
+			i += 2
+		default:
+			tokens = append(tokens, Token{Value: string(char), Pos: i})
+			i++
+		}
+	}
+
+	return tokens
+}
+
+// Ищет конец числа, которое начинается с позиции start.
+// Поддерживаются 1_000.5, 1.5e-3, а также целые 0xff, 0b101, 0o17
+func scanNumber(runes []rune, start int) int {
+	end := start
+	if runes[start] == '0' && start+1 < len(runes) && strings.ContainsRune("xXbBoO", runes[start+1]) {
+		end = start + 2
+		for end < len(runes) && (isHexDigit(runes[end]) || runes[end] == '_') {
+			end++
+		}
+		return end
+	}
+
+	for end < len(runes) && (isDigit(runes[end]) || runes[end] == '.' || runes[end] == '_') {
+		end++
+	}
+
+	// экспонента: e, необязательный знак и хотя бы одна цифра, иначе e - начало идентификатора
+	if end < len(runes) && (runes[end] == 'e' || runes[end] == 'E') {
+		exp := end + 1
+		if exp < len(runes) && (runes[exp] == '+' || runes[exp] == '-') {
+			exp++
+		}
+		if exp < len(runes) && isDigit(runes[exp]) {
+			end = exp
+			for end < len(runes) && (isDigit(runes[end]) || runes[end] == '_') {
+				end++
 			}
 		}
 	}
 
-	if buffer.Len() > 0 {
-		tokens = append(tokens, buffer.String())
+	return end
+}
+
+// Приводит числовой литерал к виду, который понимает strconv.ParseFloat:
+// убирает разделители _ и переводит 0x/0b/0o в десятичную запись.
+// Некорректный литерал возвращается как есть, чтобы разбор указал на него
+func normalizeNumber(literal string) string {
+	if len(literal) > 1 && literal[0] == '0' && strings.ContainsRune("xXbBoO", rune(literal[1])) {
+		value, err := strconv.ParseUint(literal, 0, 64)
+		if err != nil {
+			return literal
+		}
+		return strconv.FormatUint(value, 10)
 	}
 
-	return tokens
+	if !strings.Contains(literal, "_") {
+		return literal
+	}
+	// _ допустим только между цифрами
+	for i, char := range literal {
+		if char == '_' && (i == 0 || i == len(literal)-1 || !isDigit(rune(literal[i-1])) || !isDigit(rune(literal[i+1]))) {
+			return literal
+		}
+	}
+	return strings.ReplaceAll(literal, "_", "")
+}
+
+func isDigit(char rune) bool {
+	return '0' <= char && char <= '9'
+}
+
+func isHexDigit(char rune) bool {
+	return isDigit(char) || ('a' <= char && char <= 'f') || ('A' <= char && char <= 'F')
+}
+
+func normalize(token string) string {
+	if alias, ok := aliases[token]; ok {
+		return alias
+	}
+	return token
+}
+
+// Нужно ли вытолкнуть операцию top из стека перед добавлением token
+func pops(top, token string) bool {
+	if rightAssociative[token] {
+		return priority[top] > priority[token]
+	}
+	return priority[top] >= priority[token]
 }
 
 func isOperation(token string) bool {
@@ -100,48 +384,65 @@ func isOperation(token string) bool {
 }
 
 func isNum(token string) bool {
-	_, err := strconv.ParseFloat(token, 64)
-	return err == nil
+	value, err := strconv.ParseFloat(token, 64)
+	// ParseFloat понимает "inf" и "nan", но в выражении это идентификаторы
+	return err == nil && !math.IsInf(value, 0) && !math.IsNaN(value)
 }
 
-// Вычисляет новую таску для заданного ОПН и текущего стека
-func NextTask(rpn []string, stack []string) (arg1, arg2 string, operation string, newRPN []string, newStack []string, err error) {
-	if len(rpn) == 0 {
-		err = ErrEmptyExpression
-		return
-	}
+// Операнд таски: либо готовое число, либо результат другой таски
+type Operand struct {
+	Value string // число, если операнд уже известен
+	Task  int    // индекс таски, результат которой станет операндом (-1 если операнд - число)
+}
 
-	element := rpn[0]
-	newRPN = rpn[1:]
+// Узел графа вычислений - одна операция со своими операндами
+type TaskNode struct {
+	Operation string
+	Args      []Operand
+}
 
-	switch {
-	case isNum(element):
-		newStack = append(stack, element)
-		return NextTask(newRPN, newStack)
-
-	case isOperation(element):
-		if element == "~" {
-			if len(stack) < 1 {
-				err = ErrShortExpression
-				return
+// Строит по ОПН граф тасок. Таски идут в порядке зависимостей (операнды раньше операций),
+// последняя таска дает результат всего выражения. Независимые таски можно считать параллельно
+func BuildTasks(rpn []string) ([]TaskNode, error) {
+	var nodes []TaskNode
+	var stack []Operand
+
+	for _, element := range rpn {
+		switch {
+		case isNum(element):
+			stack = append(stack, Operand{Value: element, Task: -1})
+
+		case isOperation(element) || isFuncToken(element):
+			operation, argc := element, 2
+			if element == "~" {
+				argc = 1
 			}
-			arg1 = stack[len(stack)-1]
-			newStack = stack[:len(stack)-1]
-			operation = element
-			return arg1, "", operation, newRPN, newStack, nil
-		}
+			if name, n, ok := parseFuncToken(element); ok {
+				operation, argc = name, n
+			}
+			if len(stack) < argc {
+				return nil, ErrShortExpression
+			}
+
+			args := make([]Operand, argc)
+			copy(args, stack[len(stack)-argc:])
+			stack = stack[:len(stack)-argc]
+
+			nodes = append(nodes, TaskNode{Operation: operation, Args: args})
+			stack = append(stack, Operand{Task: len(nodes) - 1})
 
-		if len(stack) < 2 {
-			err = ErrShortExpression
-			return
+		default:
+			return nil, ErrInvalidExpression
 		}
-		arg2, arg1 = stack[len(stack)-1], stack[len(stack)-2]
-		newStack = stack[:len(stack)-2]
-		operation = element
-		return arg1, arg2, operation, newRPN, newStack, nil
+	}
 
-	default:
-		err = ErrInvalidExpression
-		return
+	if len(nodes) == 0 {
+		return nil, ErrEmptyExpression
+	}
+	// В стеке должен остаться только результат последней таски
+	if len(stack) != 1 {
+		return nil, ErrInvalidExpression
 	}
+
+	return nodes, nil
 }
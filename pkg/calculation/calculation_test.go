@@ -1,6 +1,8 @@
 package calculation
 
 import (
+	"errors"
+	"reflect"
 	"testing"
 )
 
@@ -36,6 +38,54 @@ func TestToRPN(t *testing.T) {
 				expected:  []string{"2", "~", "3", "*"},
 				expectErr: false,
 			},
+			{
+				name:      "power is right associative",
+				tokens:    []string{"2", "^", "3", "^", "2"},
+				expected:  []string{"2", "3", "2", "^", "^"},
+				expectErr: false,
+			},
+			{
+				name:      "power over multiplication",
+				tokens:    []string{"2", "*", "3", "**", "2"},
+				expected:  []string{"2", "3", "2", "^", "*"},
+				expectErr: false,
+			},
+			{
+				name:      "unary minus with power",
+				tokens:    []string{"-", "2", "^", "2"},
+				expected:  []string{"2", "2", "^", "~"},
+				expectErr: false,
+			},
+			{
+				name:      "negative exponent",
+				tokens:    []string{"2", "^", "-", "1", "*", "3"},
+				expected:  []string{"2", "1", "~", "^", "3", "*"},
+				expectErr: false,
+			},
+			{
+				name:      "function call",
+				tokens:    []string{"sqrt", "(", "4", ")", "+", "1"},
+				expected:  []string{"4", "sqrt:1", "1", "+"},
+				expectErr: false,
+			},
+			{
+				name:      "variadic function with expressions",
+				tokens:    []string{"max", "(", "1", ",", "-", "2", "*", "3", ",", "abs", "(", "4", ")", ")"},
+				expected:  []string{"1", "2", "~", "3", "*", "4", "abs:1", "max:3"},
+				expectErr: false,
+			},
+			{
+				name:      "inf is a variable, not a number",
+				tokens:    []string{"inf", "+", "1"},
+				expected:  []string{"inf", "1", "+"},
+				expectErr: false,
+			},
+			{
+				name:      "double unary minus",
+				tokens:    []string{"-", "-", "2", "+", "1"},
+				expected:  []string{"2", "~", "~", "1", "+"},
+				expectErr: false,
+			},
 		}
 
 		for _, tc := range testCases {
@@ -82,12 +132,32 @@ func TestToRPN(t *testing.T) {
 				tokens:      []string{"%", "+", "4"},
 				expectedErr: ErrInvalidExpression,
 			},
+			{
+				name:        "unknown function",
+				tokens:      []string{"foo", "(", "4", ")"},
+				expectedErr: ErrUnknownFunction,
+			},
+			{
+				name:        "too many arguments",
+				tokens:      []string{"sqrt", "(", "4", ",", "2", ")"},
+				expectedErr: ErrInvalidArgsCount,
+			},
+			{
+				name:        "no arguments",
+				tokens:      []string{"max", "(", ")"},
+				expectedErr: ErrInvalidArgsCount,
+			},
+			{
+				name:        "comma outside function",
+				tokens:      []string{"(", "1", ",", "2", ")"},
+				expectedErr: ErrInvalidExpression,
+			},
 		}
 
 		for _, tc := range testCases {
 			t.Run(tc.name, func(t *testing.T) {
 				_, err := ToRPN(tc.tokens)
-				if err != tc.expectedErr {
+				if !errors.Is(err, tc.expectedErr) {
 					t.Errorf("expected error %v, but got %v", tc.expectedErr, err)
 				}
 			})
@@ -95,6 +165,164 @@ func TestToRPN(t *testing.T) {
 	})
 }
 
+func TestParse(t *testing.T) {
+	t.Run("positive", func(t *testing.T) {
+		testCases := []struct {
+			name       string
+			expression string
+			expected   []string
+		}{
+			{
+				name:       "with parenthesis",
+				expression: "2 * (3 + 4)",
+				expected:   []string{"2", "3", "4", "+", "*"},
+			},
+			{
+				name:       "variables",
+				expression: "price*qty*(1+tax)",
+				expected:   []string{"price", "qty", "*", "1", "tax", "+", "*"},
+			},
+			{
+				name:       "numeric literals",
+				expression: "1.5e3 - 0x10 * 1_000",
+				expected:   []string{"1.5e3", "16", "1000", "*", "-"},
+			},
+		}
+
+		for _, tc := range testCases {
+			t.Run(tc.name, func(t *testing.T) {
+				got, err := Parse(tc.expression)
+				if err != nil {
+					t.Fatalf("unexpected error %v", err)
+				}
+				if !equalSlices(got, tc.expected) {
+					t.Errorf("expected %v, but got %v", tc.expected, got)
+				}
+			})
+		}
+	})
+
+	t.Run("negative", func(t *testing.T) {
+		testCases := []struct {
+			name        string
+			expression  string
+			expectedErr error
+			code        string
+			pos         int
+			token       string
+		}{
+			{
+				name:        "no closing parenthesis",
+				expression:  "2 + 3 * (4 - 1",
+				expectedErr: ErrNoClosingParenthesis,
+				code:        CodeUnbalancedParen,
+				pos:         8,
+				token:       "(",
+			},
+			{
+				name:        "no opening parenthesis",
+				expression:  "2 + 3) * 4",
+				expectedErr: ErrNoOpeningParenthesis,
+				code:        CodeUnbalancedParen,
+				pos:         5,
+				token:       ")",
+			},
+			{
+				name:        "unexpected token",
+				expression:  "2 + 3 % 4",
+				expectedErr: ErrInvalidExpression,
+				code:        CodeUnexpectedToken,
+				pos:         6,
+				token:       "%",
+			},
+			{
+				name:        "missing operand",
+				expression:  "2 + * 4",
+				expectedErr: ErrShortExpression,
+				code:        CodeMissingOperand,
+				pos:         2,
+				token:       "+",
+			},
+			{
+				name:        "missing operator",
+				expression:  "(1 + 2) (3)",
+				expectedErr: ErrInvalidExpression,
+				code:        CodeMissingOperator,
+				pos:         9,
+			},
+			{
+				name:        "unknown function",
+				expression:  "1 + foo(2)",
+				expectedErr: ErrUnknownFunction,
+				code:        CodeUnknownFunction,
+				pos:         4,
+				token:       "foo",
+			},
+			{
+				name:        "invalid literal",
+				expression:  "1 + 0b12",
+				expectedErr: ErrInvalidExpression,
+				code:        CodeUnexpectedToken,
+				pos:         4,
+				token:       "0b12",
+			},
+			{
+				name:        "positions in runes",
+				expression:  "(2 + 3) × 4",
+				expectedErr: ErrInvalidExpression,
+				code:        CodeUnexpectedToken,
+				pos:         8,
+				token:       "×",
+			},
+		}
+
+		for _, tc := range testCases {
+			t.Run(tc.name, func(t *testing.T) {
+				_, err := Parse(tc.expression)
+				if !errors.Is(err, tc.expectedErr) {
+					t.Fatalf("expected error %v, but got %v", tc.expectedErr, err)
+				}
+				var parseErr *ParseError
+				if !errors.As(err, &parseErr) {
+					t.Fatalf("expected *ParseError, but got %T", err)
+				}
+				if parseErr.Code != tc.code || parseErr.Pos != tc.pos || parseErr.Token != tc.token {
+					t.Errorf("expected %s at %d (%q), but got %s at %d (%q)", tc.code, tc.pos, tc.token, parseErr.Code, parseErr.Pos, parseErr.Token)
+				}
+			})
+		}
+	})
+}
+
+func TestBind(t *testing.T) {
+	rpn := []string{"price", "qty", "*", "1", "tax", "+", "*", "price", "max:2"}
+
+	t.Run("positive", func(t *testing.T) {
+		got, err := Bind(rpn, map[string]float64{"price": 9.5, "qty": 3, "tax": -0.2, "unused": 1})
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		expected := []string{"9.5", "3", "*", "1", "-0.2", "+", "*", "9.5", "max:2"}
+		if !equalSlices(got, expected) {
+			t.Errorf("expected %v, but got %v", expected, got)
+		}
+	})
+
+	t.Run("negative", func(t *testing.T) {
+		_, err := Bind(rpn, map[string]float64{"qty": 3})
+		if !errors.Is(err, ErrUndefinedVariable) {
+			t.Fatalf("expected error %v, but got %v", ErrUndefinedVariable, err)
+		}
+		var undefinedErr *UndefinedVariablesError
+		if !errors.As(err, &undefinedErr) {
+			t.Fatalf("expected *UndefinedVariablesError, but got %T", err)
+		}
+		if !equalSlices(undefinedErr.Names, []string{"price", "tax"}) {
+			t.Errorf("expected names %v, but got %v", []string{"price", "tax"}, undefinedErr.Names)
+		}
+	})
+}
+
 func TestTokenize(t *testing.T) {
 	testCases := []struct {
 		name       string
@@ -121,6 +349,61 @@ func TestTokenize(t *testing.T) {
 			expression: "3.14 + 2.71",
 			expected:   []string{"3.14", "+", "2.71"},
 		},
+		{
+			name:       "power",
+			expression: "2**3 ^ 2",
+			expected:   []string{"2", "**", "3", "^", "2"},
+		},
+		{
+			name:       "functions",
+			expression: "max(x1, 2)+sqrt(16)",
+			expected:   []string{"max", "(", "x1", ",", "2", ")", "+", "sqrt", "(", "16", ")"},
+		},
+		{
+			name:       "number before identifier",
+			expression: "2pi",
+			expected:   []string{"2", "pi"},
+		},
+		{
+			name:       "scientific notation",
+			expression: "1e-3 + 2.5E+2 * 3e2",
+			expected:   []string{"1e-3", "+", "2.5E+2", "*", "3e2"},
+		},
+		{
+			name:       "result of a previous task",
+			expression: "1e+21 / 2",
+			expected:   []string{"1e+21", "/", "2"},
+		},
+		{
+			name:       "exponent without digits is an identifier",
+			expression: "2e + 1",
+			expected:   []string{"2", "e", "+", "1"},
+		},
+		{
+			name:       "hex, binary and octal literals",
+			expression: "0xff + 0b101 - 0o17",
+			expected:   []string{"255", "+", "5", "-", "15"},
+		},
+		{
+			name:       "digit separators",
+			expression: "1_000_000 * 0x_ff_ff + 1_0.5",
+			expected:   []string{"1000000", "*", "65535", "+", "10.5"},
+		},
+		{
+			name:       "misplaced separator is kept",
+			expression: "1__0 + 1_",
+			expected:   []string{"1__0", "+", "1_"},
+		},
+		{
+			name:       "invalid binary literal is kept",
+			expression: "0b12 + 1",
+			expected:   []string{"0b12", "+", "1"},
+		},
+		{
+			name:       "separated stars",
+			expression: "2* *3",
+			expected:   []string{"2", "*", "*", "3"},
+		},
 	}
 
 	for _, tc := range testCases {
@@ -133,119 +416,118 @@ func TestTokenize(t *testing.T) {
 	}
 }
 
-func TestNextTask(t *testing.T) {
+func TestDepth(t *testing.T) {
 	testCases := []struct {
-		name          string
-		rpn           []string
-		stack         []string
-		expectedArg1  string
-		expectedArg2  string
-		expectedOp    string
-		expectedRPN   []string
-		expectedStack []string
-		expectErr     bool
+		name       string
+		expression string
+		expected   int
 	}{
 		{
-			name:          "simple operation",
-			rpn:           []string{"2", "3", "+"},
-			stack:         []string{},
-			expectedArg1:  "2",
-			expectedArg2:  "3",
-			expectedOp:    "+",
-			expectedRPN:   []string{},
-			expectedStack: []string{},
-			expectErr:     false,
+			name:       "one operation",
+			expression: "1+2",
+			expected:   1,
+		},
+		{
+			name:       "independent operations",
+			expression: "(1+2)*(3+4)",
+			expected:   2,
 		},
 		{
-			name:          "unary operation",
-			rpn:           []string{"2", "~"},
-			stack:         []string{},
-			expectedArg1:  "2",
-			expectedArg2:  "",
-			expectedOp:    "~",
-			expectedRPN:   []string{},
-			expectedStack: []string{},
-			expectErr:     false,
+			name:       "chain",
+			expression: "1+2+3+4",
+			expected:   3,
 		},
 		{
-			name:          "not enough operands",
-			rpn:           []string{"+"},
-			stack:         []string{"2"},
-			expectedArg1:  "",
-			expectedArg2:  "",
-			expectedOp:    "",
-			expectedRPN:   []string{},
-			expectedStack: []string{},
-			expectErr:     true,
+			name:       "unary minus",
+			expression: "-(2*3)",
+			expected:   2,
 		},
 		{
-			name:          "multiplication operation",
-			rpn:           []string{"2", "3", "*"},
-			stack:         []string{},
-			expectedArg1:  "2",
-			expectedArg2:  "3",
-			expectedOp:    "*",
-			expectedRPN:   []string{},
-			expectedStack: []string{},
-			expectErr:     false,
+			name:       "function",
+			expression: "max(1, 2+3, sqrt(4))",
+			expected:   2,
 		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			rpn, err := Parse(tc.expression)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := Depth(rpn); got != tc.expected {
+				t.Errorf("expected %d, but got %d", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestBuildTasks(t *testing.T) {
+	testCases := []struct {
+		name        string
+		rpn         []string
+		expected    []TaskNode
+		expectedErr error
+	}{
 		{
-			name:          "division operation",
-			rpn:           []string{"6", "2", "/"},
-			stack:         []string{},
-			expectedArg1:  "6",
-			expectedArg2:  "2",
-			expectedOp:    "/",
-			expectedRPN:   []string{},
-			expectedStack: []string{},
-			expectErr:     false,
+			name: "simple operation",
+			rpn:  []string{"2", "3", "+"},
+			expected: []TaskNode{
+				{Operation: "+", Args: []Operand{{Value: "2", Task: -1}, {Value: "3", Task: -1}}},
+			},
 		},
 		{
-			name:          "subtraction operation",
-			rpn:           []string{"5", "3", "-"},
-			stack:         []string{},
-			expectedArg1:  "5",
-			expectedArg2:  "3",
-			expectedOp:    "-",
-			expectedRPN:   []string{},
-			expectedStack: []string{},
-			expectErr:     false,
+			name: "independent subexpressions",
+			rpn:  []string{"1", "2", "+", "3", "4", "+", "*", "5", "6", "+", "*"},
+			expected: []TaskNode{
+				{Operation: "+", Args: []Operand{{Value: "1", Task: -1}, {Value: "2", Task: -1}}},
+				{Operation: "+", Args: []Operand{{Value: "3", Task: -1}, {Value: "4", Task: -1}}},
+				{Operation: "*", Args: []Operand{{Task: 0}, {Task: 1}}},
+				{Operation: "+", Args: []Operand{{Value: "5", Task: -1}, {Value: "6", Task: -1}}},
+				{Operation: "*", Args: []Operand{{Task: 2}, {Task: 3}}},
+			},
 		},
 		{
-			name:          "not enough operands for unary operation",
-			rpn:           []string{"~"},
-			stack:         []string{},
-			expectedArg1:  "",
-			expectedArg2:  "",
-			expectedOp:    "",
-			expectedRPN:   []string{},
-			expectedStack: []string{},
-			expectErr:     true,
+			name: "unary operation",
+			rpn:  []string{"2", "~", "3", "*"},
+			expected: []TaskNode{
+				{Operation: "~", Args: []Operand{{Value: "2", Task: -1}}},
+				{Operation: "*", Args: []Operand{{Task: 0}, {Value: "3", Task: -1}}},
+			},
 		},
 		{
-			name:          "empty rpn",
-			rpn:           []string{},
-			stack:         []string{},
-			expectedArg1:  "",
-			expectedArg2:  "",
-			expectedOp:    "",
-			expectedRPN:   []string{},
-			expectedStack: []string{},
-			expectErr:     true,
+			name: "function call",
+			rpn:  []string{"1", "2", "3", "+", "4", "max:3"},
+			expected: []TaskNode{
+				{Operation: "+", Args: []Operand{{Value: "2", Task: -1}, {Value: "3", Task: -1}}},
+				{Operation: "max", Args: []Operand{{Value: "1", Task: -1}, {Task: 0}, {Value: "4", Task: -1}}},
+			},
+		},
+		{
+			name:        "not enough operands",
+			rpn:         []string{"2", "+"},
+			expectedErr: ErrShortExpression,
+		},
+		{
+			name:        "no operations",
+			rpn:         []string{"2"},
+			expectedErr: ErrEmptyExpression,
+		},
+		{
+			name:        "extra operands",
+			rpn:         []string{"1", "2", "3", "+"},
+			expectedErr: ErrInvalidExpression,
 		},
 	}
 
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
-			arg1, arg2, op, newRPN, newStack, err := NextTask(tc.rpn, tc.stack)
-			if (err != nil) != tc.expectErr {
-				t.Errorf("expected error %v, but got %v", tc.expectErr, err)
+			got, err := BuildTasks(tc.rpn)
+			if err != tc.expectedErr {
+				t.Fatalf("expected error %v, but got %v", tc.expectedErr, err)
 			}
-			if arg1 != tc.expectedArg1 || arg2 != tc.expectedArg2 || op != tc.expectedOp {
-				t.Errorf("expected args %s, %s and op %s, but got %s, %s and %s", tc.expectedArg1, tc.expectedArg2, tc.expectedOp, arg1, arg2, op)
-			}
-			if !equalSlices(newRPN, tc.expectedRPN) || !equalSlices(newStack, tc.expectedStack) {
-				t.Errorf("expected RPN %v and stack %v, but got %v and %v", tc.expectedRPN, tc.expectedStack, newRPN, newStack)
+			if !reflect.DeepEqual(got, tc.expected) {
+				t.Errorf("expected %v, but got %v", tc.expected, got)
 			}
 		})
 	}
@@ -262,3 +544,35 @@ func equalSlices(a, b []string) bool {
 	}
 	return true
 }
+
+func TestCallFunction(t *testing.T) {
+	testCases := []struct {
+		name        string
+		function    string
+		args        []float64
+		expected    float64
+		expectedErr error
+	}{
+		{name: "sqrt", function: "sqrt", args: []float64{16}, expected: 4},
+		{name: "max", function: "max", args: []float64{1, 5, 3}, expected: 5},
+		{name: "min", function: "min", args: []float64{1, -5, 3}, expected: -5},
+		{name: "log with base", function: "log", args: []float64{8, 2}, expected: 3},
+		{name: "round to digits", function: "round", args: []float64{3.14159, 2}, expected: 3.14},
+		{name: "sqrt of negative", function: "sqrt", args: []float64{-1}, expectedErr: ErrFunctionDomain},
+		{name: "log of zero", function: "log", args: []float64{0}, expectedErr: ErrFunctionDomain},
+		{name: "wrong args count", function: "abs", args: []float64{1, 2}, expectedErr: ErrInvalidArgsCount},
+		{name: "unknown function", function: "foo", args: []float64{1}, expectedErr: ErrUnknownFunction},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := CallFunction(tc.function, tc.args)
+			if err != tc.expectedErr {
+				t.Fatalf("expected error %v, but got %v", tc.expectedErr, err)
+			}
+			if got != tc.expected {
+				t.Errorf("expected %v, but got %v", tc.expected, got)
+			}
+		})
+	}
+}
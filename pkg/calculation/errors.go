@@ -1,6 +1,10 @@
 package calculation
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
 
 var (
 	ErrEmptyExpression      = errors.New("empty expression")
@@ -8,4 +12,67 @@ var (
 	ErrNoOpeningParenthesis = errors.New("no opening parenthesis")
 	ErrNoClosingParenthesis = errors.New("no closing parenthesis")
 	ErrInvalidExpression    = errors.New("expression is not valid")
+	ErrUnknownFunction      = errors.New("unknown function")
+	ErrInvalidArgsCount     = errors.New("invalid number of function arguments")
+	ErrFunctionDomain       = errors.New("function argument is out of domain")
+	ErrUndefinedVariable    = errors.New("undefined variable")
+)
+
+// Коды ошибок разбора для клиентов API
+const (
+	CodeEmptyExpression  = "empty_expression"
+	CodeShortExpression  = "short_expression"
+	CodeUnbalancedParen  = "unbalanced_paren"
+	CodeUnexpectedToken  = "unexpected_token"
+	CodeMissingOperand   = "missing_operand"
+	CodeMissingOperator  = "missing_operator"
+	CodeUnknownFunction  = "unknown_function"
+	CodeInvalidArgsCount = "invalid_args_count"
 )
+
+var errorCodes = map[error]string{
+	ErrEmptyExpression:      CodeEmptyExpression,
+	ErrShortExpression:      CodeShortExpression,
+	ErrNoOpeningParenthesis: CodeUnbalancedParen,
+	ErrNoClosingParenthesis: CodeUnbalancedParen,
+	ErrInvalidExpression:    CodeUnexpectedToken,
+	ErrUnknownFunction:      CodeUnknownFunction,
+	ErrInvalidArgsCount:     CodeInvalidArgsCount,
+}
+
+// Ошибка разбора выражения с местом, где она найдена.
+// Исходная ошибка доступна через errors.Is: errors.Is(err, ErrNoClosingParenthesis)
+type ParseError struct {
+	Code  string // вид ошибки
+	Pos   int    // номер символа (руны) в выражении
+	Token string // токен, на котором найдена ошибка
+	Err   error
+}
+
+func newParseError(err error, token Token) *ParseError {
+	return &ParseError{Code: errorCodes[err], Pos: token.Pos, Token: token.Value, Err: err}
+}
+
+func (e *ParseError) Error() string {
+	if e.Token == "" {
+		return fmt.Sprintf("%s (position %d)", e.Err, e.Pos)
+	}
+	return fmt.Sprintf("%s: %q (position %d)", e.Err, e.Token, e.Pos)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// Переменные выражения, значения которых не переданы
+type UndefinedVariablesError struct {
+	Names []string // в порядке появления в выражении
+}
+
+func (e *UndefinedVariablesError) Error() string {
+	return fmt.Sprintf("undefined variables: %s", strings.Join(e.Names, ", "))
+}
+
+func (e *UndefinedVariablesError) Unwrap() error {
+	return ErrUndefinedVariable
+}
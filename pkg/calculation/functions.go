@@ -0,0 +1,151 @@
+package calculation
+
+import (
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Встроенная функция выражения
+type Function struct {
+	MinArgs int
+	MaxArgs int // -1 - любое количество аргументов
+	Eval    func(args []float64) (float64, error)
+}
+
+// Реестр встроенных функций
+var Functions = map[string]Function{
+	"sqrt": {MinArgs: 1, MaxArgs: 1, Eval: func(args []float64) (float64, error) {
+		if args[0] < 0 {
+			return 0, ErrFunctionDomain
+		}
+		return math.Sqrt(args[0]), nil
+	}},
+	"abs": {MinArgs: 1, MaxArgs: 1, Eval: func(args []float64) (float64, error) {
+		return math.Abs(args[0]), nil
+	}},
+	"min": {MinArgs: 1, MaxArgs: -1, Eval: func(args []float64) (float64, error) {
+		result := args[0]
+		for _, arg := range args[1:] {
+			result = math.Min(result, arg)
+		}
+		return result, nil
+	}},
+	"max": {MinArgs: 1, MaxArgs: -1, Eval: func(args []float64) (float64, error) {
+		result := args[0]
+		for _, arg := range args[1:] {
+			result = math.Max(result, arg)
+		}
+		return result, nil
+	}},
+	// log(x) - натуральный логарифм, log(x, base) - по основанию
+	"log": {MinArgs: 1, MaxArgs: 2, Eval: func(args []float64) (float64, error) {
+		if args[0] <= 0 {
+			return 0, ErrFunctionDomain
+		}
+		if len(args) == 1 {
+			return math.Log(args[0]), nil
+		}
+		if args[1] <= 0 || args[1] == 1 {
+			return 0, ErrFunctionDomain
+		}
+		return math.Log(args[0]) / math.Log(args[1]), nil
+	}},
+	"exp": {MinArgs: 1, MaxArgs: 1, Eval: func(args []float64) (float64, error) {
+		return math.Exp(args[0]), nil
+	}},
+	"sin": {MinArgs: 1, MaxArgs: 1, Eval: func(args []float64) (float64, error) {
+		return math.Sin(args[0]), nil
+	}},
+	"cos": {MinArgs: 1, MaxArgs: 1, Eval: func(args []float64) (float64, error) {
+		return math.Cos(args[0]), nil
+	}},
+	"tan": {MinArgs: 1, MaxArgs: 1, Eval: func(args []float64) (float64, error) {
+		return math.Tan(args[0]), nil
+	}},
+	// round(x) - до целого, round(x, n) - до n знаков после запятой
+	"round": {MinArgs: 1, MaxArgs: 2, Eval: func(args []float64) (float64, error) {
+		if len(args) == 1 {
+			return math.Round(args[0]), nil
+		}
+		scale := math.Pow(10, math.Trunc(args[1]))
+		return math.Round(args[0]*scale) / scale, nil
+	}},
+	"floor": {MinArgs: 1, MaxArgs: 1, Eval: func(args []float64) (float64, error) {
+		return math.Floor(args[0]), nil
+	}},
+	"ceil": {MinArgs: 1, MaxArgs: 1, Eval: func(args []float64) (float64, error) {
+		return math.Ceil(args[0]), nil
+	}},
+}
+
+// Вычисляет функцию, проверяя количество аргументов и результат
+func CallFunction(name string, args []float64) (float64, error) {
+	fn, ok := Functions[name]
+	if !ok {
+		return 0, ErrUnknownFunction
+	}
+	if !fn.accepts(len(args)) {
+		return 0, ErrInvalidArgsCount
+	}
+
+	result, err := fn.Eval(args)
+	if err != nil {
+		return 0, err
+	}
+	if math.IsNaN(result) || math.IsInf(result, 0) {
+		return 0, ErrFunctionDomain
+	}
+	return result, nil
+}
+
+func (f Function) accepts(argc int) bool {
+	return argc >= f.MinArgs && (f.MaxArgs < 0 || argc <= f.MaxArgs)
+}
+
+func isFunction(token string) bool {
+	_, exists := Functions[token]
+	return exists
+}
+
+// В ОПН вызов функции записывается вместе с количеством аргументов: max(1,2,3) -> max:3
+func funcToken(name string, argc int) string {
+	return name + ":" + strconv.Itoa(argc)
+}
+
+// Разбирает токен вызова функции из ОПН
+func parseFuncToken(token string) (name string, argc int, ok bool) {
+	name, count, found := strings.Cut(token, ":")
+	if !found || !isFunction(name) {
+		return "", 0, false
+	}
+	argc, err := strconv.Atoi(count)
+	if err != nil {
+		return "", 0, false
+	}
+	return name, argc, true
+}
+
+func isFuncToken(token string) bool {
+	_, _, ok := parseFuncToken(token)
+	return ok
+}
+
+func isIdentifier(token string) bool {
+	if token == "" {
+		return false
+	}
+	for i, char := range token {
+		if !isIdentChar(char, i == 0) {
+			return false
+		}
+	}
+	return true
+}
+
+func isIdentChar(char rune, first bool) bool {
+	if char == '_' || ('a' <= char && char <= 'z') || ('A' <= char && char <= 'Z') {
+		return true
+	}
+	return !first && '0' <= char && char <= '9'
+}
@@ -0,0 +1,116 @@
+package decimal
+
+import (
+	"math/big"
+	"strings"
+)
+
+// Режимы округления
+const (
+	HalfUp   = "half_up"   // 2.5 -> 3, -2.5 -> -3
+	HalfDown = "half_down" // 2.5 -> 2, -2.5 -> -2
+	HalfEven = "half_even" // 2.5 -> 2, 3.5 -> 4 (банковское)
+	Up       = "up"        // от нуля
+	Down     = "down"      // к нулю
+	Ceiling  = "ceiling"   // к +бесконечности
+	Floor    = "floor"     // к -бесконечности
+)
+
+var modes = map[string]bool{
+	HalfUp:   true,
+	HalfDown: true,
+	HalfEven: true,
+	Up:       true,
+	Down:     true,
+	Ceiling:  true,
+	Floor:    true,
+}
+
+// Максимальное количество знаков после запятой
+const MaxScale = 100
+
+func IsValidMode(mode string) bool {
+	return modes[mode]
+}
+
+// Разбирает десятичную строку (в том числе 1.5e-3) в точное рациональное число
+func Parse(value string) (*big.Rat, error) {
+	r, ok := new(big.Rat).SetString(value)
+	// SetString понимает и дроби вида 1/3, но операнды всегда десятичные
+	if !ok || strings.Contains(value, "/") {
+		return nil, ErrInvalidDecimal
+	}
+	return r, nil
+}
+
+// Округляет число до scale знаков после запятой и возвращает десятичную строку ровно с scale знаками
+func Round(r *big.Rat, scale int, mode string) string {
+	return format(roundScaled(r, scale, mode), scale)
+}
+
+// Округленное значение r * 10^scale
+func roundScaled(r *big.Rat, scale int, mode string) *big.Int {
+	num := new(big.Int).Mul(r.Num(), pow10(scale))
+	denom := r.Denom()
+
+	// QuoRem отбрасывает дробную часть (округление к нулю)
+	quo, rem := new(big.Int).QuoRem(num, denom, new(big.Int))
+	if rem.Sign() == 0 {
+		return quo
+	}
+
+	negative := num.Sign() < 0
+	// сравниваем остаток с половиной: 2*|rem| ? denom
+	half := new(big.Int).Abs(rem)
+	half.Lsh(half, 1)
+	cmp := half.Cmp(denom)
+
+	var away bool // округлять от нуля
+	switch mode {
+	case Up:
+		away = true
+	case Down:
+		away = false
+	case Ceiling:
+		away = !negative
+	case Floor:
+		away = negative
+	case HalfDown:
+		away = cmp > 0
+	case HalfEven:
+		away = cmp > 0 || (cmp == 0 && quo.Bit(0) == 1)
+	default: // HalfUp
+		away = cmp >= 0
+	}
+
+	if away {
+		if negative {
+			quo.Sub(quo, big.NewInt(1))
+		} else {
+			quo.Add(quo, big.NewInt(1))
+		}
+	}
+	return quo
+}
+
+// Записывает scaled / 10^scale десятичной строкой
+func format(scaled *big.Int, scale int) string {
+	digits := new(big.Int).Abs(scaled).String()
+	sign := ""
+	if scaled.Sign() < 0 {
+		sign = "-"
+	}
+	if scale == 0 {
+		return sign + digits
+	}
+
+	if len(digits) <= scale {
+		digits = strings.Repeat("0", scale-len(digits)+1) + digits
+	}
+	point := len(digits) - scale
+	return sign + digits[:point] + "." + digits[point:]
+}
+
+func pow10(n int) *big.Int {
+	return new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(n)), nil)
+}
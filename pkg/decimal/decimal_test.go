@@ -0,0 +1,67 @@
+package decimal
+
+import (
+	"testing"
+)
+
+func TestRound(t *testing.T) {
+	testCases := []struct {
+		name     string
+		value    string
+		scale    int
+		mode     string
+		expected string
+	}{
+		{name: "exact sum", value: "0.30", scale: 2, mode: HalfUp, expected: "0.30"},
+		{name: "pads zeros", value: "5", scale: 3, mode: HalfUp, expected: "5.000"},
+		{name: "small value", value: "0.0005", scale: 3, mode: HalfUp, expected: "0.001"},
+		{name: "zero scale", value: "2.5", scale: 0, mode: HalfUp, expected: "3"},
+		{name: "exponent form", value: "1.5e-3", scale: 4, mode: HalfUp, expected: "0.0015"},
+		{name: "half up negative", value: "-2.5", scale: 0, mode: HalfUp, expected: "-3"},
+		{name: "half down", value: "2.5", scale: 0, mode: HalfDown, expected: "2"},
+		{name: "half down above half", value: "2.51", scale: 0, mode: HalfDown, expected: "3"},
+		{name: "half even down", value: "2.5", scale: 0, mode: HalfEven, expected: "2"},
+		{name: "half even up", value: "3.5", scale: 0, mode: HalfEven, expected: "4"},
+		{name: "up", value: "1.001", scale: 2, mode: Up, expected: "1.01"},
+		{name: "down", value: "-1.009", scale: 2, mode: Down, expected: "-1.00"},
+		{name: "ceiling negative", value: "-1.009", scale: 2, mode: Ceiling, expected: "-1.00"},
+		{name: "floor negative", value: "-1.001", scale: 2, mode: Floor, expected: "-1.01"},
+		{name: "negative below one", value: "-0.05", scale: 2, mode: HalfUp, expected: "-0.05"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r, err := Parse(tc.value)
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			got := Round(r, tc.scale, tc.mode)
+			if got != tc.expected {
+				t.Errorf("expected %s, but got %s", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestParse(t *testing.T) {
+	testCases := []struct {
+		name      string
+		value     string
+		expectErr bool
+	}{
+		{name: "integer", value: "42", expectErr: false},
+		{name: "decimal", value: "-0.1", expectErr: false},
+		{name: "exponent", value: "1e+21", expectErr: false},
+		{name: "fraction", value: "1/3", expectErr: true},
+		{name: "not a number", value: "abc", expectErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := Parse(tc.value)
+			if (err != nil) != tc.expectErr {
+				t.Errorf("expected error %v, but got %v", tc.expectErr, err)
+			}
+		})
+	}
+}
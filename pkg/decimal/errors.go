@@ -0,0 +1,7 @@
+package decimal
+
+import "errors"
+
+var (
+	ErrInvalidDecimal = errors.New("operand is not a decimal number")
+)